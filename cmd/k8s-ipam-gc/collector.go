@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	ipamclient "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned"
+	ipamlisters "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/listers/k8s.pgc.umn.edu/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+// Reasons for the events recorded on an IPPool
+const (
+	// EventReasonReservationFreed is recorded for each orphaned reservation freed
+	EventReasonReservationFreed = "ReservationFreed"
+	// EventReasonReservationOrphaned is recorded for each orphaned reservation found in dry run mode
+	EventReasonReservationOrphaned = "ReservationOrphaned"
+	// EventReasonBlockReleased is recorded for each block released from a node that no longer exists
+	EventReasonBlockReleased = "BlockReleased"
+	// EventReasonBlockOrphaned is recorded for each block of a node that no longer exists found in dry run mode
+	EventReasonBlockOrphaned = "BlockOrphaned"
+)
+
+// Collector frees dynamic reservations held by pods, or in namespaces, that no longer exist, and releases blocks
+// claimed by nodes that no longer exist
+type Collector struct {
+	Client     ipamclient.Interface
+	Pools      ipamlisters.IPPoolLister
+	Pods       corelisters.PodLister
+	Namespaces corelisters.NamespaceLister
+	Nodes      corelisters.NodeLister
+	Recorder   record.EventRecorder
+	// DryRun reports orphaned reservations and blocks without freeing them
+	DryRun bool
+	// GracePeriod is how long after it was last allocated a reservation, or claimed a block, is left alone, so a pod
+	// or node missing from the cache isn't mistaken for one that's gone
+	GracePeriod time.Duration
+}
+
+// orphan is a dynamic reservation whose pod no longer exists
+type orphan struct {
+	Namespace   string
+	PodName     string
+	IfName      string
+	Reservation v1alpha1.IPReservation
+	Reason      string
+}
+
+// Run collects orphaned reservations from every pool each interval until stop is closed
+func (c *Collector) Run(interval time.Duration, stop <-chan struct{}) {
+	wait.Until(c.CollectAll, interval, stop)
+}
+
+// CollectAll collects orphaned reservations from every pool in the cache
+func (c *Collector) CollectAll() {
+	pools, err := c.Pools.List(labels.Everything())
+	if err != nil {
+		log.Printf("unable to list ip pools: %v", err)
+		return
+	}
+
+	for _, pool := range pools {
+		if err := c.Collect(pool); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// Collect frees the orphaned reservations in pool and releases blocks claimed by nodes that no longer exist.  The pool
+// is read again before it's updated, so reservations and blocks claimed since the cache was filled are kept.
+func (c *Collector) Collect(pool *v1alpha1.IPPool) error {
+	orphans, err := c.orphans(pool)
+	if err != nil {
+		return fmt.Errorf("unable to find orphaned reservations in pool %s: %v", pool.Name, err)
+	}
+
+	blocks, err := c.orphanedBlocks(pool)
+	if err != nil {
+		return fmt.Errorf("unable to find orphaned blocks in pool %s: %v", pool.Name, err)
+	}
+
+	if len(orphans) == 0 && len(blocks) == 0 {
+		return nil
+	}
+
+	if c.DryRun {
+		for _, o := range orphans {
+			log.Printf("dry run: would free %s reserved by %s/%s in pool %s: %s", o.Reservation.IP, o.Namespace, o.PodName, pool.Name, o.Reason)
+			c.Recorder.Eventf(pool, corev1.EventTypeNormal, EventReasonReservationOrphaned, "%s reserved by %s/%s is orphaned: %s", o.Reservation.IP, o.Namespace, o.PodName, o.Reason)
+		}
+		for _, block := range blocks {
+			log.Printf("dry run: would release block %s of node %s in pool %s: the node no longer exists", block.CIDR, block.NodeName, pool.Name)
+			c.Recorder.Eventf(pool, corev1.EventTypeNormal, EventReasonBlockOrphaned, "block %s is claimed by node %s, which no longer exists", block.CIDR, block.NodeName)
+		}
+		return nil
+	}
+
+	var freed []orphan
+	var released []v1alpha1.BlockAffinity
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := c.Client.K8sV1alpha1().IPPools().Get(pool.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		freed, err = c.orphans(latest)
+		if err != nil {
+			return err
+		}
+		released, err = c.orphanedBlocks(latest)
+		if err != nil || len(freed) == 0 && len(released) == 0 {
+			return err
+		}
+
+		for _, o := range freed {
+			latest.FreeDynamicPodReservation(o.Namespace, o.PodName, o.IfName, o.Reservation.ContainerID)
+		}
+		for _, block := range released {
+			latest.ReleaseBlock(block)
+		}
+		_, err = c.Client.K8sV1alpha1().IPPools().Update(latest)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to free orphaned reservations in pool %s: %v", pool.Name, err)
+	}
+
+	for _, o := range freed {
+		log.Printf("freed %s reserved by %s/%s in pool %s: %s", o.Reservation.IP, o.Namespace, o.PodName, pool.Name, o.Reason)
+		c.Recorder.Eventf(pool, corev1.EventTypeNormal, EventReasonReservationFreed, "freed %s reserved by %s/%s: %s", o.Reservation.IP, o.Namespace, o.PodName, o.Reason)
+	}
+	for _, block := range released {
+		log.Printf("released block %s of node %s in pool %s: the node no longer exists", block.CIDR, block.NodeName, pool.Name)
+		c.Recorder.Eventf(pool, corev1.EventTypeNormal, EventReasonBlockReleased, "released block %s of node %s, which no longer exists", block.CIDR, block.NodeName)
+	}
+	return nil
+}
+
+// orphanedBlocks returns the blocks in pool claimed by nodes that no longer exist, other than those claimed within
+// the grace period
+func (c *Collector) orphanedBlocks(pool *v1alpha1.IPPool) ([]v1alpha1.BlockAffinity, error) {
+	orphans := make([]v1alpha1.BlockAffinity, 0)
+	for _, block := range pool.Status.Blocks {
+		if time.Since(block.Claimed.Time) < c.GracePeriod {
+			continue
+		}
+
+		if _, err := c.Nodes.Get(block.NodeName); kubeerrors.IsNotFound(err) {
+			orphans = append(orphans, block)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
+// orphans returns the dynamic reservations in pool held by pods that no longer exist, sorted by namespace and pod
+func (c *Collector) orphans(pool *v1alpha1.IPPool) ([]orphan, error) {
+	orphans := make([]orphan, 0)
+	for namespace, nsMap := range pool.Status.DynamicReservations {
+		namespaceGone := false
+		if _, err := c.Namespaces.Get(namespace); kubeerrors.IsNotFound(err) {
+			namespaceGone = true
+		} else if err != nil {
+			return nil, err
+		}
+
+		for key, reservation := range nsMap {
+			if c.recent(reservation) {
+				continue
+			}
+
+			podName, ifName := v1alpha1.ParseReservationKey(key)
+			o := orphan{Namespace: namespace, PodName: podName, IfName: ifName, Reservation: reservation}
+			if namespaceGone {
+				o.Reason = fmt.Sprintf("namespace %s no longer exists", namespace)
+				orphans = append(orphans, o)
+				continue
+			}
+
+			if _, err := c.Pods.Pods(namespace).Get(podName); kubeerrors.IsNotFound(err) {
+				o.Reason = fmt.Sprintf("pod %s/%s no longer exists", namespace, podName)
+				orphans = append(orphans, o)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Namespace != orphans[j].Namespace {
+			return orphans[i].Namespace < orphans[j].Namespace
+		}
+		return v1alpha1.ReservationKey(orphans[i].PodName, orphans[i].IfName) < v1alpha1.ReservationKey(orphans[j].PodName, orphans[j].IfName)
+	})
+	return orphans, nil
+}
+
+// recent returns true if the reservation was allocated within the grace period.  Reservations that don't record when
+// they were allocated are never recent.
+func (c *Collector) recent(reservation v1alpha1.IPReservation) bool {
+	last := reservation.LastSeen
+	if last == nil {
+		last = reservation.Created
+	}
+	return last != nil && time.Since(last.Time) < c.GracePeriod
+}
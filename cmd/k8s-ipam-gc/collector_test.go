@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	ipamfake "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned/fake"
+	ipamlisters "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/listers/k8s.pgc.umn.edu/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestCollector(t *testing.T, dryRun bool) (*Collector, *ipamfake.Clientset, *record.FakeRecorder) {
+	recent := metav1.NewTime(time.Now())
+	old := metav1.NewTime(time.Now().Add(-time.Hour))
+
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("10.2.3.0/24"),
+			NetmaskBits: 24,
+		},
+	}
+	pool.Spec.StaticReservations = v1alpha1.NewIPReservationMap()
+	pool.Spec.StaticReservations.Reserve("foo", "static", "", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.2")})
+	pool.Reserve("foo", "running", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.10"), Created: &old})
+	pool.Reserve("foo", "deleted", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.11"), Created: &old, LastSeen: &old})
+	pool.Reserve("foo", "legacy", "", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.12")})
+	pool.Reserve("foo", "starting", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.13"), Created: &recent, LastSeen: &recent})
+	pool.Reserve("gone", "web", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.14"), Created: &old})
+	pool.Status.Blocks = []v1alpha1.BlockAffinity{
+		{CIDR: "10.2.3.0/28", NodeName: "node-a", Claimed: old},
+		{CIDR: "10.2.3.16/28", NodeName: "node-gone", Claimed: old},
+		{CIDR: "10.2.3.32/28", NodeName: "node-joining", Claimed: recent},
+	}
+
+	pools := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	if err := pools.Add(pool); err != nil {
+		t.Fatalf("unable to add pool to cache: %v", err)
+	}
+	if err := namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}); err != nil {
+		t.Fatalf("unable to add namespace to cache: %v", err)
+	}
+	if err := pods.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "running"}}); err != nil {
+		t.Fatalf("unable to add pod to cache: %v", err)
+	}
+	if err := nodes.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}}); err != nil {
+		t.Fatalf("unable to add node to cache: %v", err)
+	}
+
+	client := ipamfake.NewSimpleClientset(pool.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	c := &Collector{
+		Client:      client,
+		Pools:       ipamlisters.NewIPPoolLister(pools),
+		Pods:        corelisters.NewPodLister(pods),
+		Namespaces:  corelisters.NewNamespaceLister(namespaces),
+		Nodes:       corelisters.NewNodeLister(nodes),
+		Recorder:    recorder,
+		DryRun:      dryRun,
+		GracePeriod: 5 * time.Minute,
+	}
+	return c, client, recorder
+}
+
+// events returns the events recorded so far
+func events(recorder *record.FakeRecorder) []string {
+	recorded := make([]string, 0)
+	for {
+		select {
+		case event := <-recorder.Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+func TestCollectorCollect(t *testing.T) {
+	c, client, recorder := newTestCollector(t, false)
+	c.CollectAll()
+
+	pool, err := client.K8sV1alpha1().IPPools().Get("pool", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+
+	tests := []struct {
+		namespace string
+		podName   string
+		ifName    string
+		kept      bool
+	}{
+		{"foo", "static", "", true},
+		{"foo", "running", "eth0", true},
+		{"foo", "starting", "eth0", true},
+		{"foo", "deleted", "eth0", false},
+		{"foo", "legacy", "", false},
+		{"gone", "web", "eth0", false},
+	}
+
+	for _, test := range tests {
+		if kept := pool.GetReservation(test.namespace, test.podName, test.ifName) != nil; kept != test.kept {
+			t.Errorf("%s/%s: expected kept to be %t, got %t", test.namespace, test.podName, test.kept, kept)
+		}
+	}
+
+	// Only the block of the node that's gone is released, node-joining may not be in the cache yet
+	if len(pool.Status.Blocks) != 2 || pool.Status.Blocks[0].NodeName != "node-a" || pool.Status.Blocks[1].NodeName != "node-joining" {
+		t.Errorf("expected the blocks of node-a and node-joining to be kept, got %v", pool.Status.Blocks)
+	}
+
+	recorded := events(recorder)
+	if len(recorded) != 4 {
+		t.Fatalf("expected an event for each freed reservation and released block, got %v", recorded)
+	}
+	for i, event := range recorded {
+		reason := EventReasonReservationFreed
+		if i == 3 {
+			reason = EventReasonBlockReleased
+		}
+		if !strings.Contains(event, reason) {
+			t.Errorf("unexpected event: %s", event)
+		}
+	}
+}
+
+func TestCollectorDryRun(t *testing.T) {
+	c, client, recorder := newTestCollector(t, true)
+	c.CollectAll()
+
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("pool updated in dry run mode")
+		}
+	}
+
+	recorded := events(recorder)
+	if len(recorded) != 4 {
+		t.Fatalf("expected an event for each orphaned reservation and block, got %v", recorded)
+	}
+	for i, event := range recorded {
+		reason := EventReasonReservationOrphaned
+		if i == 3 {
+			reason = EventReasonBlockOrphaned
+		}
+		if !strings.Contains(event, reason) {
+			t.Errorf("unexpected event: %s", event)
+		}
+	}
+}
+
+func TestCollectorKeepsClaimedReservations(t *testing.T) {
+	c, client, _ := newTestCollector(t, false)
+
+	// The pod was recreated and claimed its reservation after the cache was filled
+	pool, err := client.K8sV1alpha1().IPPools().Get("pool", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+	now := metav1.Now()
+	pool.ClaimDynamicReservation("foo", "deleted", "eth0", v1alpha1.IPReservation{ContainerID: "new", LastSeen: &now})
+	if _, err := client.K8sV1alpha1().IPPools().Update(pool); err != nil {
+		t.Fatalf("unable to update pool: %v", err)
+	}
+
+	c.CollectAll()
+
+	pool, err = client.K8sV1alpha1().IPPools().Get("pool", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+	if pool.GetReservation("foo", "deleted", "eth0") == nil {
+		t.Errorf("reservation claimed since the cache was filled was freed")
+	}
+}
@@ -0,0 +1,97 @@
+// k8s-ipam-gc periodically frees dynamic reservations in IPPools that are held by pods, or in namespaces, that no
+// longer exist, such as those left behind by force deleted pods or a lost DEL.  Blocks claimed by nodes that no longer
+// exist are released too.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ipamclient "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned"
+	ipamscheme "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned/scheme"
+	ipaminformers "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/informers/externalversions"
+	corev1 "k8s.io/api/core/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("k8s-ipam-gc", flag.ContinueOnError)
+	kubeConfig := flags.String("kubeconfig", "", "path to a kubeconfig file, the in-cluster config is used if unset")
+	interval := flags.Duration("interval", 5*time.Minute, "how often to look for orphaned reservations")
+	gracePeriod := flags.Duration("grace-period", 5*time.Minute, "how long after it was allocated a reservation, or claimed a block, is left alone")
+	resync := flags.Duration("resync", 10*time.Minute, "resync period for the pod, namespace, node and ip pool caches")
+	dryRun := flags.Bool("dry-run", false, "report orphaned reservations without freeing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conf, err := clientcmd.BuildConfigFromFlags("", *kubeConfig)
+	if err != nil {
+		return fmt.Errorf("unable to configure kubernetes client: %v", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return fmt.Errorf("unable to create kubernetes client: %v", err)
+	}
+
+	ipamClient, err := ipamclient.NewForConfig(conf)
+	if err != nil {
+		return fmt.Errorf("unable to create ipam client: %v", err)
+	}
+
+	kubeFactory := kubeinformers.NewSharedInformerFactory(kubeClient, *resync)
+	ipamFactory := ipaminformers.NewSharedInformerFactory(ipamClient, *resync)
+
+	broadcaster := record.NewBroadcaster()
+	logging := broadcaster.StartLogging(log.Printf)
+	defer logging.Stop()
+	recording := broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	defer recording.Stop()
+
+	collector := &Collector{
+		Client:      ipamClient,
+		Pools:       ipamFactory.K8s().V1alpha1().IPPools().Lister(),
+		Pods:        kubeFactory.Core().V1().Pods().Lister(),
+		Namespaces:  kubeFactory.Core().V1().Namespaces().Lister(),
+		Nodes:       kubeFactory.Core().V1().Nodes().Lister(),
+		Recorder:    broadcaster.NewRecorder(ipamscheme.Scheme, corev1.EventSource{Component: "k8s-ipam-gc"}),
+		DryRun:      *dryRun,
+		GracePeriod: *gracePeriod,
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	kubeFactory.Start(stop)
+	ipamFactory.Start(stop)
+	if !cache.WaitForCacheSync(stop, kubeFactory.Core().V1().Pods().Informer().HasSynced, kubeFactory.Core().V1().Namespaces().Informer().HasSynced, kubeFactory.Core().V1().Nodes().Informer().HasSynced, ipamFactory.K8s().V1alpha1().IPPools().Informer().HasSynced) {
+		return fmt.Errorf("unable to sync caches")
+	}
+
+	log.Printf("collecting orphaned reservations and blocks every %v, dry run: %t", *interval, *dryRun)
+	collector.Run(*interval, stop)
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "k8s-ipam-gc: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// KubeAuth describes how the plugin authenticates to the kubernetes api.  The first usable method is chosen in order:
+// an explicit kubeconfig file, a service account token file, the KUBECONFIG environment variable and finally the
+// in-cluster service account environment.
+type KubeAuth struct {
+	KubeConfig string
+	APIServer  string
+	TokenFile  string
+	CAFile     string
+	// Timeout bounds each request to the api server, requests aren't limited if it's zero
+	Timeout time.Duration
+}
+
+// RestConfig returns the client configuration for the first usable authentication method
+func (a KubeAuth) RestConfig() (*rest.Config, error) {
+	conf, err := a.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.Timeout = a.Timeout
+	return conf, nil
+}
+
+func (a KubeAuth) restConfig() (*rest.Config, error) {
+	if a.KubeConfig != "" {
+		return kubeConfigRestConfig(a.KubeConfig)
+	}
+
+	if a.TokenFile != "" {
+		return a.tokenRestConfig()
+	}
+
+	if kubeConfig := os.Getenv(clientcmd.RecommendedConfigPathEnvVar); kubeConfig != "" {
+		return kubeConfigRestConfig(kubeConfig)
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("no kubeConfig or serviceAccountTokenFile configured and unable to use in-cluster config: %v", err)
+	}
+	return conf, nil
+}
+
+func kubeConfigRestConfig(kubeConfig string) (*rest.Config, error) {
+	conf, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig from %s: %v", kubeConfig, err)
+	}
+	return conf, nil
+}
+
+// tokenRestConfig builds a client configuration from the service account token file.  If no api server is given,
+// the in-cluster service environment variables are used to locate it.
+func (a KubeAuth) tokenRestConfig() (*rest.Config, error) {
+	token, err := ioutil.ReadFile(a.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token from %s: %v", a.TokenFile, err)
+	}
+
+	host := a.APIServer
+	if host == "" {
+		serviceHost, servicePort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if serviceHost == "" || servicePort == "" {
+			return nil, fmt.Errorf("kubeApiServer is required when KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+		}
+		host = "https://" + net.JoinHostPort(serviceHost, servicePort)
+	}
+
+	return &rest.Config{
+		Host:            host,
+		BearerToken:     strings.TrimSpace(string(token)),
+		TLSClientConfig: rest.TLSClientConfig{CAFile: a.CAFile},
+	}, nil
+}
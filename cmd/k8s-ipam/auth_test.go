@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://kubeconfig.example.com:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: kubeconfig-token
+`
+
+func setEnv(key, value string) func() {
+	old, set := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if set {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestKubeAuthRestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s-ipam-auth")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kubeConfig := filepath.Join(dir, "kubeconfig")
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(kubeConfig, []byte(testKubeConfig), 0600); err != nil {
+		t.Fatalf("unable to write kubeconfig: %v", err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("unable to write token: %v", err)
+	}
+
+	defer setEnv("KUBECONFIG", "")()
+	defer setEnv("KUBERNETES_SERVICE_HOST", "")()
+	defer setEnv("KUBERNETES_SERVICE_PORT", "")()
+
+	tests := []struct {
+		name          string
+		auth          KubeAuth
+		env           map[string]string
+		expectedHost  string
+		expectedToken string
+		expectedCA    string
+		expectErr     bool
+	}{
+		{
+			name:          "request timeout",
+			auth:          KubeAuth{TokenFile: tokenFile, APIServer: "https://api.example.com", Timeout: 5 * time.Second},
+			expectedHost:  "https://api.example.com",
+			expectedToken: "file-token",
+		},
+		{
+			name:          "kubeconfig takes precedence",
+			auth:          KubeAuth{KubeConfig: kubeConfig, TokenFile: tokenFile, APIServer: "https://api.example.com"},
+			expectedHost:  "https://kubeconfig.example.com:6443",
+			expectedToken: "kubeconfig-token",
+		},
+		{
+			name:          "token file with api server",
+			auth:          KubeAuth{TokenFile: tokenFile, CAFile: "/etc/ca.crt", APIServer: "https://api.example.com"},
+			expectedHost:  "https://api.example.com",
+			expectedToken: "file-token",
+			expectedCA:    "/etc/ca.crt",
+		},
+		{
+			name:          "token file with service environment",
+			auth:          KubeAuth{TokenFile: tokenFile},
+			env:           map[string]string{"KUBERNETES_SERVICE_HOST": "10.96.0.1", "KUBERNETES_SERVICE_PORT": "443"},
+			expectedHost:  "https://10.96.0.1:443",
+			expectedToken: "file-token",
+		},
+		{
+			name:      "token file without api server",
+			auth:      KubeAuth{TokenFile: tokenFile},
+			expectErr: true,
+		},
+		{
+			name:      "missing token file",
+			auth:      KubeAuth{TokenFile: filepath.Join(dir, "missing"), APIServer: "https://api.example.com"},
+			expectErr: true,
+		},
+		{
+			name:          "KUBECONFIG environment variable",
+			env:           map[string]string{"KUBECONFIG": kubeConfig},
+			expectedHost:  "https://kubeconfig.example.com:6443",
+			expectedToken: "kubeconfig-token",
+		},
+		{
+			name:      "nothing configured",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		restores := make([]func(), 0, len(test.env))
+		for key, value := range test.env {
+			restores = append(restores, setEnv(key, value))
+		}
+
+		conf, err := test.auth.RestConfig()
+
+		for _, restore := range restores {
+			restore()
+		}
+
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got config for %s", test.name, conf.Host)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if conf.Host != test.expectedHost || conf.BearerToken != test.expectedToken || conf.TLSClientConfig.CAFile != test.expectedCA {
+			t.Errorf("%s: got host %s, token %s, ca %s", test.name, conf.Host, conf.BearerToken, conf.TLSClientConfig.CAFile)
+		}
+
+		if conf.Timeout != test.auth.Timeout {
+			t.Errorf("%s: expected request timeout %v, got %v", test.name, test.auth.Timeout, conf.Timeout)
+		}
+	}
+}
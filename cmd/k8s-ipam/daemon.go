@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	ipamclient "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned"
+	ipaminformers "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/informers/externalversions"
+	ipamlisters "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/listers/k8s.pgc.umn.edu/v1alpha1"
+	"github.com/containernetworking/cni/pkg/types"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// DefaultBatchInterval is how long the daemon collects requests for a pool before writing them in one update
+	DefaultBatchInterval = 20 * time.Millisecond
+	// DefaultBatchSize caps the number of requests written in one update
+	DefaultBatchSize = 64
+	// maxRequestSize caps the size of a request body from the CNI plugin
+	maxRequestSize = 1 << 20
+)
+
+// ErrDaemonStopped is returned for requests still waiting on a pool's batcher when the daemon stops
+var ErrDaemonStopped = errors.New("allocation daemon is stopping")
+
+// Daemon serves allocate and free requests for the pods on a node, keeping IPPools in an informer cache and batching
+// the updates made to each pool
+type Daemon struct {
+	// Pods looks up the pods and namespaces requests are made for, and the nodes the pods are on
+	Pods PodRequestRetriever
+	// Client is used to write pool updates, and to read pools when the cache is known to be stale
+	Client ipamclient.Interface
+	// Pools reads pools from the informer cache
+	Pools ipamlisters.IPPoolLister
+	// Retry is used for requests whose config has no retry settings of its own
+	Retry         RetryPolicy
+	BatchInterval time.Duration
+	BatchSize     int
+
+	lock     sync.Mutex
+	batchers map[string]*poolBatcher
+	stop     chan struct{}
+}
+
+// NewDaemon returns a daemon with the default batching settings
+func NewDaemon(pods PodRequestRetriever, client ipamclient.Interface, pools ipamlisters.IPPoolLister, retry RetryPolicy) *Daemon {
+	return &Daemon{
+		Pods:          pods,
+		Client:        client,
+		Pools:         pools,
+		Retry:         retry,
+		BatchInterval: DefaultBatchInterval,
+		BatchSize:     DefaultBatchSize,
+		batchers:      make(map[string]*poolBatcher),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Stop ends the daemon's batching goroutines
+func (d *Daemon) Stop() {
+	close(d.stop)
+}
+
+// Add allocates addresses for the pod interface in req
+func (d *Daemon) Add(ctx context.Context, req IPAMRequest) (*IPAMResult, error) {
+	retry, err := d.retryPolicy(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := retry.Context(ctx)
+	defer cancel()
+	return addPod(ctx, retry, d.Pods, d, d.allocators(ctx), req)
+}
+
+// Del frees the reservations for the pod interface in req
+func (d *Daemon) Del(ctx context.Context, req IPAMRequest) error {
+	retry, err := d.retryPolicy(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := retry.Context(ctx)
+	defer cancel()
+	return delPod(ctx, retry, d.Pods, d, d.allocators(ctx), req)
+}
+
+// retryPolicy returns the retry policy from the plugin's config in req, so the daemon gives up when the plugin
+// expects it to, or the daemon's own if the config has none
+func (d *Daemon) retryPolicy(req IPAMRequest) (RetryPolicy, error) {
+	if req.Retry == nil {
+		return d.Retry, nil
+	}
+
+	retry, err := req.Retry.Policy()
+	if err != nil {
+		return retry, fmt.Errorf("invalid retry configuration: %v", err)
+	}
+	return retry, nil
+}
+
+// ListIPPools returns the pools in the cache matching selector
+func (d *Daemon) ListIPPools(selector labels.Selector) ([]*v1alpha1.IPPool, error) {
+	return d.Pools.List(selector)
+}
+
+// allocators returns a function creating allocators that queue operations with the pools' batchers, giving up
+// waiting on them once ctx is done
+func (d *Daemon) allocators(ctx context.Context) AllocatorFactory {
+	return func(poolNames []string, liveness LivenessPolicy) []Allocator {
+		allocators := make([]Allocator, 0, len(poolNames))
+		for _, poolName := range poolNames {
+			allocators = append(allocators, &batchedAllocator{ctx: ctx, batcher: d.batcher(poolName), liveness: liveness})
+		}
+		return allocators
+	}
+}
+
+// batcher returns the batcher for the named pool, starting one if needed
+func (d *Daemon) batcher(poolName string) *poolBatcher {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if b, ok := d.batchers[poolName]; ok {
+		return b
+	}
+
+	b := &poolBatcher{
+		name:     poolName,
+		daemon:   d,
+		requests: make(chan *batchOp),
+	}
+	d.batchers[poolName] = b
+	go b.run(d.stop)
+	return b
+}
+
+// ServeHTTP handles allocate and free requests from the CNI plugin
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := &daemonResponse{}
+	req := IPAMRequest{}
+
+	var err error
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("unsupported method %s", r.Method)
+	} else if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		err = fmt.Errorf("unable to parse request: %v", err)
+	} else {
+		switch r.URL.Path {
+		case "/allocate":
+			resp.Result, err = d.Add(r.Context(), req)
+		case "/free":
+			err = d.Del(r.Context(), req)
+		default:
+			err = fmt.Errorf("unknown request %s", r.URL.Path)
+		}
+	}
+
+	if err != nil {
+		log.Printf("%s %s/%s %s: %v", r.URL.Path, req.Namespace, req.PodName, req.IfName, err)
+		cniErr, ok := err.(*types.Error)
+		if !ok {
+			cniErr = types.NewError(types.ErrInternal, err.Error(), "")
+		}
+		resp.Error = cniErr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("unable to write response: %v", err)
+	}
+}
+
+// batchOp is an allocator operation waiting to be applied to a pool.  It's skipped if ctx is done by the time its
+// batch is processed.
+type batchOp struct {
+	ctx   context.Context
+	apply func(*KubernetesAllocator) error
+	done  chan error
+}
+
+// poolBatcher applies the operations queued for a pool to a single copy of it, then writes them with one update
+type poolBatcher struct {
+	name     string
+	daemon   *Daemon
+	requests chan *batchOp
+
+	// latest is the pool returned by our last update, used in place of the cached pool until the informer has seen
+	// the update.  replaced is the resource version the update replaced.
+	latest   *v1alpha1.IPPool
+	replaced string
+	// stale is set after a conflict, forcing the next batch to read the pool from the api server
+	stale bool
+}
+
+// do queues op and waits for the batch containing it to be written.  ErrRetryTimeout is returned if ctx is done
+// first, and ErrDaemonStopped if the daemon stops.
+func (b *poolBatcher) do(ctx context.Context, op func(*KubernetesAllocator) error) error {
+	batch := &batchOp{ctx: ctx, apply: op, done: make(chan error, 1)}
+	select {
+	case b.requests <- batch:
+	case <-ctx.Done():
+		return ErrRetryTimeout
+	case <-b.daemon.stop:
+		return ErrDaemonStopped
+	}
+
+	select {
+	case err := <-batch.done:
+		return err
+	case <-ctx.Done():
+		return ErrRetryTimeout
+	case <-b.daemon.stop:
+		return ErrDaemonStopped
+	}
+}
+
+func (b *poolBatcher) run(stop <-chan struct{}) {
+	for {
+		var batch []*batchOp
+		select {
+		case <-stop:
+			return
+		case op := <-b.requests:
+			batch = append(batch, op)
+		}
+
+		timeout := time.After(b.daemon.BatchInterval)
+	collect:
+		for len(batch) < b.daemon.BatchSize {
+			select {
+			case op := <-b.requests:
+				batch = append(batch, op)
+			case <-timeout:
+				break collect
+			}
+		}
+
+		b.process(batch)
+	}
+}
+
+// pool returns a copy of the current state of the pool
+func (b *poolBatcher) pool() (*v1alpha1.IPPool, error) {
+	if !b.stale {
+		cached, err := b.daemon.Pools.Get(b.name)
+		if err == nil {
+			if b.latest != nil && cached.ResourceVersion == b.replaced {
+				return b.latest.DeepCopy(), nil
+			}
+			return cached.DeepCopy(), nil
+		}
+	}
+
+	pool, err := b.daemon.Client.K8sV1alpha1().IPPools().Get(b.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	b.stale = false
+	b.latest = nil
+	return pool, nil
+}
+
+// process applies each operation in the batch to the pool in turn.  Operations that fail leave the pool untouched.
+// The results are returned once the pool has been written, so nobody is handed an address that wasn't saved.
+func (b *poolBatcher) process(batch []*batchOp) {
+	pool, err := b.pool()
+	if err != nil {
+		for _, op := range batch {
+			op.done <- err
+		}
+		return
+	}
+
+	working := pool
+	modified := false
+	succeeded := make([]*batchOp, 0, len(batch))
+	for _, op := range batch {
+		// Nobody is waiting for the result of an abandoned operation, so it mustn't reserve anything
+		if op.ctx.Err() != nil {
+			op.done <- ErrRetryTimeout
+			continue
+		}
+
+		client := &batchClient{PodRequestRetriever: b.daemon.Pods, pool: working.DeepCopy()}
+		if err := op.apply(&KubernetesAllocator{Client: client}); err != nil {
+			op.done <- err
+			continue
+		}
+
+		if client.updated {
+			working = client.pool
+			modified = true
+		}
+		succeeded = append(succeeded, op)
+	}
+
+	if modified {
+		err = b.update(pool.ResourceVersion, working)
+	}
+
+	for _, op := range succeeded {
+		op.done <- err
+	}
+}
+
+func (b *poolBatcher) update(replaced string, pool *v1alpha1.IPPool) error {
+	updated, err := b.daemon.Client.K8sV1alpha1().IPPools().Update(pool)
+	if err != nil {
+		if kubeerrors.IsConflict(err) {
+			b.stale = true
+			return ErrUpdateConflict
+		}
+		return err
+	}
+
+	b.latest = updated
+	b.replaced = replaced
+	return nil
+}
+
+// batchClient hands a batch's working copy of the pool to a KubernetesAllocator, recording updates instead of
+// writing them
+type batchClient struct {
+	PodRequestRetriever
+	pool    *v1alpha1.IPPool
+	updated bool
+}
+
+func (c *batchClient) GetIPPool() (*v1alpha1.IPPool, error) {
+	return c.pool, nil
+}
+
+func (c *batchClient) UpdateIPPool(pool *v1alpha1.IPPool) error {
+	c.pool = pool
+	c.updated = true
+	return nil
+}
+
+// batchedAllocator queues allocations with a pool's batcher, waiting for them until ctx is done
+type batchedAllocator struct {
+	ctx      context.Context
+	batcher  *poolBatcher
+	liveness LivenessPolicy
+}
+
+func (a *batchedAllocator) Allocate(ctx context.Context, namespace, podName, ifName, containerID string, request *PodRequest) (net.IPNet, *v1alpha1.IPPool, bool, error) {
+	var ip net.IPNet
+	var pool *v1alpha1.IPPool
+	var created bool
+	err := a.batcher.do(ctx, func(allocator *KubernetesAllocator) error {
+		var err error
+		allocator.Liveness = a.liveness
+		ip, pool, created, err = allocator.Allocate(ctx, namespace, podName, ifName, containerID, request)
+		return err
+	})
+	return ip, pool, created, err
+}
+
+func (a *batchedAllocator) Free(namespace, podName, ifName, containerID string) error {
+	return a.batcher.do(a.ctx, func(allocator *KubernetesAllocator) error {
+		return allocator.Free(namespace, podName, ifName, containerID)
+	})
+}
+
+// runDaemon runs the node-local allocation daemon until it's signalled to stop
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := flags.String("socket", DefaultDaemonSocket, "path of the unix socket to serve requests on")
+	kubeConfig := flags.String("kubeconfig", "", "path to a kubeconfig file, the in-cluster config is used if unset")
+	resync := flags.Duration("resync", 10*time.Minute, "resync period for the ip pool cache")
+	batchInterval := flags.Duration("batch-interval", DefaultBatchInterval, "how long to collect requests for a pool before updating it")
+	batchSize := flags.Int("batch-size", DefaultBatchSize, "maximum number of requests to apply in one pool update")
+	retryTimeout := flags.Duration("retry-timeout", DefaultRetryTimeout, "how long to retry conflicting pool updates for plugin configs without retry settings")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conf, err := KubeAuth{KubeConfig: *kubeConfig}.RestConfig()
+	if err != nil {
+		return fmt.Errorf("unable to configure kubernetes client: %v", err)
+	}
+
+	// Lookups and pool updates made while handling requests mustn't hang past the retry deadline, but the informer's
+	// watches are long lived
+	requestConf := rest.CopyConfig(conf)
+	requestConf.Timeout = *retryTimeout
+
+	kubeClient, err := kubernetes.NewForConfig(requestConf)
+	if err != nil {
+		return fmt.Errorf("unable to create kubernetes client: %v", err)
+	}
+
+	ipamClient, err := ipamclient.NewForConfig(requestConf)
+	if err != nil {
+		return fmt.Errorf("unable to create ipam client: %v", err)
+	}
+
+	informerClient, err := ipamclient.NewForConfig(conf)
+	if err != nil {
+		return fmt.Errorf("unable to create ipam client: %v", err)
+	}
+
+	factory := ipaminformers.NewSharedInformerFactory(informerClient, *resync)
+	pools := factory.K8s().V1alpha1().IPPools().Lister()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	for informer, synced := range factory.WaitForCacheSync(stop) {
+		if !synced {
+			return fmt.Errorf("unable to sync cache for %v", informer)
+		}
+	}
+
+	retry := DefaultRetryPolicy()
+	retry.Timeout = *retryTimeout
+	daemon := NewDaemon(&ClientsetRetriever{Client: kubeClient}, ipamClient, pools, retry)
+	daemon.BatchInterval = *batchInterval
+	daemon.BatchSize = *batchSize
+	defer daemon.Stop()
+
+	if err := os.MkdirAll(filepath.Dir(*socket), 0700); err != nil {
+		return fmt.Errorf("unable to create socket directory: %v", err)
+	}
+	// A socket left behind by a previous daemon would stop us listening
+	if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove stale socket: %v", err)
+	}
+
+	listener, err := net.Listen("unix", *socket)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", *socket, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Closing the listener removes the socket, so the plugin falls back to direct mode
+		listener.Close()
+	}()
+
+	log.Printf("serving ip allocations on %s", *socket)
+	if err := http.Serve(listener, daemon); err != nil && !isClosedListener(err) {
+		return err
+	}
+	return nil
+}
+
+// isClosedListener returns true if err is the error returned by Serve after the listener has been closed
+func isClosedListener(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "accept"
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// DefaultDaemonSocket is where the CNI plugin looks for the allocation daemon unless daemonSocket is set
+const DefaultDaemonSocket = "/run/k8s-ipam/k8s-ipam.sock"
+
+// DaemonTimeoutMargin is added to the retry timeout when waiting for the daemon, which gives up at the retry timeout
+// itself, so its answer arrives before the plugin stops waiting
+const DaemonTimeoutMargin = 2 * time.Second
+
+// ErrDaemonUnavailable is returned when the allocation daemon isn't listening, the plugin then allocates directly
+var ErrDaemonUnavailable = errors.New("allocation daemon is not available")
+
+// daemonResponse is the body of every response from the allocation daemon
+type daemonResponse struct {
+	Result *IPAMResult  `json:"result,omitempty"`
+	Error  *types.Error `json:"error,omitempty"`
+}
+
+// DaemonClient forwards ADD and DEL requests to the allocation daemon over its unix socket
+type DaemonClient struct {
+	Socket  string
+	Timeout time.Duration
+}
+
+// Add asks the daemon to allocate addresses for the pod interface in req
+func (c *DaemonClient) Add(req IPAMRequest) (*IPAMResult, error) {
+	resp, err := c.post("/allocate", req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Result == nil {
+		return nil, fmt.Errorf("allocation daemon returned an empty result")
+	}
+	return resp.Result, nil
+}
+
+// Del asks the daemon to free the reservations for the pod interface in req
+func (c *DaemonClient) Del(req IPAMRequest) error {
+	_, err := c.post("/free", req)
+	return err
+}
+
+func (c *DaemonClient) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", c.Socket)
+			},
+		},
+		Timeout: c.Timeout,
+	}
+}
+
+// post sends req to the daemon.  ErrDaemonUnavailable is returned if the socket is missing or nothing is listening
+// on it, as the request can't have been seen by the daemon.  If the daemon doesn't answer in time, the runtime is
+// asked to try again later.
+func (c *DaemonClient) post(path string, req IPAMRequest) (*daemonResponse, error) {
+	if _, err := os.Stat(c.Socket); os.IsNotExist(err) {
+		return nil, ErrDaemonUnavailable
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize request for allocation daemon: %v", err)
+	}
+
+	httpResp, err := c.httpClient().Post("http://k8s-ipam"+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			if opErr, ok := urlErr.Err.(*net.OpError); ok && opErr.Op == "dial" {
+				return nil, ErrDaemonUnavailable
+			}
+			if urlErr.Timeout() {
+				return nil, types.NewError(types.ErrTryAgainLater, "allocation daemon timed out", err.Error())
+			}
+		}
+		return nil, fmt.Errorf("unable to reach allocation daemon: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	resp := &daemonResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("unable to parse response from allocation daemon (%s): %v", httpResp.Status, err)
+	}
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp, nil
+}
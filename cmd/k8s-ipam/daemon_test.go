@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	ipamfake "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned/fake"
+	ipamlisters "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/listers/k8s.pgc.umn.edu/v1alpha1"
+	"github.com/containernetworking/cni/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestDaemon(t *testing.T, podCount int) (*Daemon, *ipamfake.Clientset) {
+	pool := &v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("10.2.3.0/24"),
+			NetmaskBits: 24,
+			Gateway:     net.ParseIP("10.2.3.1"),
+		},
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(pool); err != nil {
+		t.Fatalf("unable to add pool to cache: %v", err)
+	}
+	client := ipamfake.NewSimpleClientset(pool.DeepCopy())
+
+	pods := &FakePodKubernetesClient{Pods: make(map[string]*corev1.Pod)}
+	for i := 0; i < podCount; i++ {
+		pod := &corev1.Pod{}
+		pod.Namespace = "foo"
+		pod.Name = fmt.Sprintf("pod-%d", i)
+		pods.Pods["foo/"+pod.Name] = pod
+	}
+
+	d := NewDaemon(pods, client, ipamlisters.NewIPPoolLister(indexer), DefaultRetryPolicy())
+	return d, client
+}
+
+func TestDaemonBatchesUpdates(t *testing.T) {
+	podCount := 20
+	d, client := newTestDaemon(t, podCount)
+	d.BatchInterval = 50 * time.Millisecond
+	defer d.Stop()
+
+	results := make([]*IPAMResult, podCount)
+	errs := make([]error, podCount)
+	wg := sync.WaitGroup{}
+	for i := 0; i < podCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := IPAMRequest{
+				Namespace:   "foo",
+				PodName:     fmt.Sprintf("pod-%d", i),
+				IfName:      "eth0",
+				ContainerID: fmt.Sprintf("container-%d", i),
+				IPPoolNames: []string{"pool"},
+			}
+			results[i], errs[i] = d.Add(context.Background(), req)
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := make(map[string]bool)
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("pod-%d: unable to allocate: %v", i, errs[i])
+		}
+		if len(results[i].IPs) != 1 {
+			t.Fatalf("pod-%d: expected one address, got %v", i, results[i].IPs)
+		}
+		ip := results[i].IPs[0].Address.IP.String()
+		if allocated[ip] {
+			t.Errorf("pod-%d: address %s allocated twice", i, ip)
+		}
+		allocated[ip] = true
+	}
+
+	updates := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			updates++
+		}
+	}
+	if updates == 0 || updates >= podCount {
+		t.Errorf("expected allocations to be batched into fewer than %d updates, got %d", podCount, updates)
+	}
+
+	pool, err := client.K8sV1alpha1().IPPools().Get("pool", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+	for i := 0; i < podCount; i++ {
+		ip := pool.GetExistingReservation("foo", fmt.Sprintf("pod-%d", i), "eth0")
+		if ip == nil || !allocated[ip.String()] {
+			t.Errorf("pod-%d: reservation not saved, got %v", i, ip)
+		}
+	}
+}
+
+func TestDaemonSocket(t *testing.T) {
+	d, client := newTestDaemon(t, 1)
+	defer d.Stop()
+
+	dir, err := ioutil.TempDir("", "k8s-ipam-daemon")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "k8s-ipam.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, d)
+
+	shim := &DaemonClient{Socket: socket, Timeout: 5 * time.Second}
+	req := IPAMRequest{Namespace: "foo", PodName: "pod-0", IfName: "eth0", ContainerID: "container-0", IPPoolNames: []string{"pool"}}
+	result, err := shim.Add(req)
+	if err != nil {
+		t.Fatalf("unable to allocate through daemon: %v", err)
+	}
+
+	if len(result.IPs) != 1 || !result.IPs[0].Gateway.Equal(net.ParseIP("10.2.3.1")) || len(result.Routes) != 1 {
+		t.Errorf("wrong result from daemon: %v", result)
+	}
+
+	if err := shim.Del(req); err != nil {
+		t.Fatalf("unable to free through daemon: %v", err)
+	}
+
+	pool, err := client.K8sV1alpha1().IPPools().Get("pool", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+	if ip := pool.GetExistingReservation("foo", "pod-0", "eth0"); ip != nil {
+		t.Errorf("reservation %v not freed", ip)
+	}
+
+	// Errors from the daemon are returned to the runtime as CNI errors
+	req.IPPoolNames = []string{"missing"}
+	_, err = shim.Add(req)
+	if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != types.ErrInternal {
+		t.Errorf("expected an internal CNI error for a missing pool, got %v", err)
+	}
+}
+
+func TestDaemonClientUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s-ipam-daemon")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A socket left behind by a daemon that has gone away
+	staleSocket := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", staleSocket)
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	for _, socket := range []string{filepath.Join(dir, "missing.sock"), staleSocket} {
+		shim := &DaemonClient{Socket: socket, Timeout: time.Second}
+		if _, err := shim.Add(IPAMRequest{}); err != ErrDaemonUnavailable {
+			t.Errorf("%s: expected ErrDaemonUnavailable from Add, got %v", socket, err)
+		}
+		if err := shim.Del(IPAMRequest{}); err != ErrDaemonUnavailable {
+			t.Errorf("%s: expected ErrDaemonUnavailable from Del, got %v", socket, err)
+		}
+	}
+}
+
+func TestDaemonGivesUpWaiting(t *testing.T) {
+	d, client := newTestDaemon(t, 2)
+	req := IPAMRequest{Namespace: "foo", PodName: "pod-0", IfName: "eth0", ContainerID: "container-0", IPPoolNames: []string{"pool"}}
+
+	// A request whose deadline has passed is abandoned without reserving anything
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.Add(ctx, req)
+	if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != types.ErrTryAgainLater {
+		t.Errorf("expected a try again later error for an expired request, got %v", err)
+	}
+
+	pool, err := client.K8sV1alpha1().IPPools().Get("pool", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+	if ip := pool.GetExistingReservation("foo", "pod-0", "eth0"); ip != nil {
+		t.Errorf("abandoned request reserved %v", ip)
+	}
+
+	// Requests don't hang once the daemon has stopped
+	d.Stop()
+	done := make(chan error, 1)
+	go func() {
+		req.PodName = "pod-1"
+		_, err := d.Add(context.Background(), req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error from a stopped daemon")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request to a stopped daemon hung")
+	}
+}
+
+func TestDaemonRetryPolicy(t *testing.T) {
+	d, _ := newTestDaemon(t, 0)
+	defer d.Stop()
+
+	if retry, err := d.retryPolicy(IPAMRequest{}); err != nil || retry != d.Retry {
+		t.Errorf("expected the daemon's retry policy for a config without one, got %+v, %v", retry, err)
+	}
+
+	if retry, err := d.retryPolicy(IPAMRequest{Retry: &RetryConfig{Timeout: "3s"}}); err != nil || retry.Timeout != 3*time.Second {
+		t.Errorf("expected the config's retry timeout, got %+v, %v", retry, err)
+	}
+
+	if _, err := d.retryPolicy(IPAMRequest{Retry: &RetryConfig{Timeout: "soon"}}); err == nil {
+		t.Errorf("expected an invalid retry config to be rejected")
+	}
+}
+
+func TestDaemonRequestSizeLimit(t *testing.T) {
+	d, _ := newTestDaemon(t, 0)
+	defer d.Stop()
+
+	body := `{"namespace": "` + strings.Repeat("a", maxRequestSize) + `"}`
+	recorder := httptest.NewRecorder()
+	d.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/allocate", strings.NewReader(body)))
+
+	resp := &daemonResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(resp); err != nil {
+		t.Fatalf("unable to parse response: %v", err)
+	}
+	if resp.Error == nil {
+		t.Errorf("expected an oversized request to be rejected")
+	}
+}
+
+func TestDaemonClientTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8s-ipam-daemon")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "slow.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+
+	shim := &DaemonClient{Socket: socket, Timeout: 50 * time.Millisecond}
+	_, err = shim.Add(IPAMRequest{})
+	if cniErr, ok := err.(*types.Error); !ok || cniErr.Code != types.ErrTryAgainLater {
+		t.Errorf("expected a try again later error when the daemon doesn't answer in time, got %v", err)
+	}
+}
@@ -1,25 +1,106 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
 	ipamclient "github.com/PolarGeospatialCenter/k8s-ipam/pkg/client/clientset/versioned"
 	corev1 "k8s.io/api/core/v1"
 	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 var ErrUpdateConflict = errors.New("failed to update, most likely due to resource version mismatch.  Did someone else update this?  Retry.")
 
+var ErrRequestedIPUnavailable = errors.New("requested ip is not available")
+
+var ErrPoolExhausted = errors.New("ip pool exhausted")
+
+var ErrNamespaceNotAllowed = errors.New("namespace is not allowed to use ip pool")
+
+var (
+	ErrNoTopologyPool        = errors.New("no ip pool matches the pod's node")
+	ErrAmbiguousTopologyPool = errors.New("more than one ip pool matches the pod's node")
+)
+
+const (
+	// IPAnnotation requests specific addresses for a pod, as a comma separated list.
+	IPAnnotation = "k8s.pgc.umn.edu/ip"
+	// IPPoolAnnotation overrides the ip pools named in the CNI config, as a comma separated list.  It may be set on
+	// a pod or its namespace, the pod's annotation takes precedence.
+	IPPoolAnnotation = "k8s.pgc.umn.edu/ip-pool"
+)
+
+var (
+	ErrReservationNotFound = errors.New("no reservation found for pod")
+	ErrReservationMoved    = errors.New("address is reserved by another pod")
+	ErrReservationMismatch = errors.New("attachment doesn't match the reservation in the ip pool")
+)
+
+// ReservationCheckError is returned by Check when an attachment no longer matches the IPPool.  Err is one of the
+// ErrReservation* values.
+type ReservationCheckError struct {
+	Err     error
+	Details string
+}
+
+func (e *ReservationCheckError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Details)
+}
+
+// PoolExhaustedError is returned by Allocate when every address in the pool that can be allocated is reserved,
+// or, for a pod matching one of the pool's selector reservations, when every address in the reservation is taken.
+type PoolExhaustedError struct {
+	Pool     string
+	Capacity *big.Int
+	// Reservation is the name of the selector reservation the pod matched, empty if it matched none
+	Reservation string
+}
+
+func (e *PoolExhaustedError) Error() string {
+	if e.Reservation != "" {
+		return fmt.Sprintf("%v: every address in selector reservation %s of pool %s is reserved", ErrPoolExhausted, e.Reservation, e.Pool)
+	}
+	return fmt.Sprintf("%v: all %v allocatable addresses in pool %s are reserved", ErrPoolExhausted, e.Capacity, e.Pool)
+}
+
+// NamespaceNotAllowedError is returned by Allocate when the pool's allowed namespaces and namespace selector don't
+// admit the pod's namespace
+type NamespaceNotAllowedError struct {
+	Pool      string
+	Namespace string
+}
+
+func (e *NamespaceNotAllowedError) Error() string {
+	return fmt.Sprintf("%v: pods in namespace %s may not allocate from pool %s", ErrNamespaceNotAllowed, e.Namespace, e.Pool)
+}
+
 type PodRetriever interface {
 	GetPod(string, string) (*corev1.Pod, error)
 }
 
+type NamespaceRetriever interface {
+	GetNamespace(string) (*corev1.Namespace, error)
+}
+
+type NodeRetriever interface {
+	GetNode(string) (*corev1.Node, error)
+}
+
+// IPPoolListRetriever lists the ip pools matching a label selector
+type IPPoolListRetriever interface {
+	ListIPPools(labels.Selector) ([]*v1alpha1.IPPool, error)
+}
+
 type IPPoolManipulator interface {
 	GetIPPool() (*v1alpha1.IPPool, error)
 	UpdateIPPool(*v1alpha1.IPPool) error
@@ -27,18 +108,19 @@ type IPPoolManipulator interface {
 
 type KubernetesAllocatorClient interface {
 	PodRetriever
+	NamespaceRetriever
 	IPPoolManipulator
 }
 
 type KubeClient struct {
-	KubeConfig string
+	Auth       KubeAuth
 	IPPoolName string
 }
 
 func (k *KubeClient) client() (*kubernetes.Clientset, error) {
-	conf, err := clientcmd.BuildConfigFromFlags("", k.KubeConfig)
+	conf, err := k.Auth.RestConfig()
 	if err != nil {
-		return nil, fmt.Errorf("unable to load kubeconfig from %s: %v", k.KubeConfig, err)
+		return nil, err
 	}
 
 	return kubernetes.NewForConfig(conf)
@@ -50,7 +132,35 @@ func (k *KubeClient) GetPod(namespace, podName string) (*corev1.Pod, error) {
 		return nil, fmt.Errorf("error getting client: %v", err)
 	}
 
-	pod, err := client.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+	return (&ClientsetRetriever{Client: client}).GetPod(namespace, podName)
+}
+
+func (k *KubeClient) GetNamespace(name string) (*corev1.Namespace, error) {
+	client, err := k.client()
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %v", err)
+	}
+
+	return (&ClientsetRetriever{Client: client}).GetNamespace(name)
+}
+
+func (k *KubeClient) GetNode(name string) (*corev1.Node, error) {
+	client, err := k.client()
+	if err != nil {
+		return nil, fmt.Errorf("error getting client: %v", err)
+	}
+
+	return (&ClientsetRetriever{Client: client}).GetNode(name)
+}
+
+// ClientsetRetriever looks up pods, namespaces and nodes with an existing clientset.  Missing objects are returned as
+// nil.
+type ClientsetRetriever struct {
+	Client kubernetes.Interface
+}
+
+func (r *ClientsetRetriever) GetPod(namespace, podName string) (*corev1.Pod, error) {
+	pod, err := r.Client.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
 	if err != nil && kubeerrors.IsNotFound(err) {
 		return nil, nil
 	}
@@ -58,10 +168,28 @@ func (k *KubeClient) GetPod(namespace, podName string) (*corev1.Pod, error) {
 	return pod, err
 }
 
+func (r *ClientsetRetriever) GetNamespace(name string) (*corev1.Namespace, error) {
+	namespace, err := r.Client.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	return namespace, err
+}
+
+func (r *ClientsetRetriever) GetNode(name string) (*corev1.Node, error) {
+	node, err := r.Client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil && kubeerrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	return node, err
+}
+
 func (k *KubeClient) GetIPPool() (*v1alpha1.IPPool, error) {
-	conf, err := clientcmd.BuildConfigFromFlags("", k.KubeConfig)
+	conf, err := k.Auth.RestConfig()
 	if err != nil {
-		return nil, fmt.Errorf("unable to load kubeconfig from %s: %v", k.KubeConfig, err)
+		return nil, err
 	}
 
 	client, err := ipamclient.NewForConfig(conf)
@@ -72,10 +200,34 @@ func (k *KubeClient) GetIPPool() (*v1alpha1.IPPool, error) {
 	return client.K8sV1alpha1().IPPools().Get(k.IPPoolName, metav1.GetOptions{})
 }
 
+// ListIPPools returns the pools matching selector
+func (k *KubeClient) ListIPPools(selector labels.Selector) ([]*v1alpha1.IPPool, error) {
+	conf, err := k.Auth.RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ipamclient.NewForConfig(conf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create client: %v", err)
+	}
+
+	list, err := client.K8sV1alpha1().IPPools().List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make([]*v1alpha1.IPPool, 0, len(list.Items))
+	for i := range list.Items {
+		pools = append(pools, &list.Items[i])
+	}
+	return pools, nil
+}
+
 func (k *KubeClient) UpdateIPPool(pool *v1alpha1.IPPool) error {
-	conf, err := clientcmd.BuildConfigFromFlags("", k.KubeConfig)
+	conf, err := k.Auth.RestConfig()
 	if err != nil {
-		return fmt.Errorf("unable to load kubeconfig from %s: %v", k.KubeConfig, err)
+		return err
 	}
 
 	client, err := ipamclient.NewForConfig(conf)
@@ -87,48 +239,212 @@ func (k *KubeClient) UpdateIPPool(pool *v1alpha1.IPPool) error {
 	return err
 }
 
+// PodRequest holds the pools and addresses requested through a pod's annotations, along with the pod's UID and the
+// node it's scheduled to, which are recorded in its reservations, and its labels, which selector reservations are
+// matched against.
+type PodRequest struct {
+	IPPoolNames []string
+	IPs         []net.IP
+	PodUID      types.UID
+	NodeName    string
+	Labels      map[string]string
+}
+
+// NewPodRequest parses the ip and ip pool annotations on pod.  A nil pod results in an empty request.
+func NewPodRequest(pod *corev1.Pod) (*PodRequest, error) {
+	request := &PodRequest{}
+	if pod == nil {
+		return request, nil
+	}
+
+	request.PodUID = pod.UID
+	request.NodeName = pod.Spec.NodeName
+	request.Labels = pod.Labels
+	request.IPPoolNames = splitAnnotation(pod.Annotations[IPPoolAnnotation])
+
+	for _, ipString := range splitAnnotation(pod.Annotations[IPAnnotation]) {
+		ip := net.ParseIP(ipString)
+		if ip == nil {
+			return nil, fmt.Errorf("unable to parse %s annotation on pod %s/%s: %s is not a valid ip", IPAnnotation, pod.Namespace, pod.Name, ipString)
+		}
+		request.IPs = append(request.IPs, ip)
+	}
+
+	return request, nil
+}
+
+// Reservation returns a reservation record for the pod's interface in the sandbox containerID, created now.  The
+// address is left for the allocator to fill in.
+func (r *PodRequest) Reservation(ifName, containerID string) v1alpha1.IPReservation {
+	now := metav1.Now()
+	return v1alpha1.IPReservation{
+		PodUID:      r.PodUID,
+		NodeName:    r.NodeName,
+		ContainerID: containerID,
+		Interface:   ifName,
+		Created:     &now,
+		LastSeen:    &now,
+	}
+}
+
+// NamespaceIPPoolNames returns the default pools named by the ip pool annotation on ns
+func NamespaceIPPoolNames(ns *corev1.Namespace) []string {
+	if ns == nil {
+		return nil
+	}
+	return splitAnnotation(ns.Annotations[IPPoolAnnotation])
+}
+
+func splitAnnotation(value string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 type KubernetesAllocator struct {
 	Client KubernetesAllocatorClient
+	// Liveness decides whether the pod holding an address is dead, so the address can be reclaimed.  The default
+	// policy is used if it's nil.
+	Liveness LivenessPolicy
 }
 
-func (a *KubernetesAllocator) Allocate(namespace, podName string) (ip net.IPNet, gateway net.IP, err error) {
+// Allocate reserves an address in the pool for the pod's interface in the sandbox containerID.  If one of the addresses
+// in request is within the pool's range, that address is reserved, otherwise an address is chosen from the pool.  The
+// reservation records the pod's UID and node from request.  In pools divided into blocks, addresses are chosen from the
+// node's blocks first and the block of a newly chosen address is claimed for the node if it's unclaimed.  A pod whose
+// labels match one of the pool's selector reservations is only given an address from that reservation, and other pods
+// are never given one of its addresses.  Dynamic reservations held by pods the liveness policy finds dead are
+// reclaimed, and those conflicting with static reservations are dropped.  The pool is returned so its gateway, routes
+// and DNS settings can be added to the result, along with whether the reservation was created rather than one the pod
+// already held.  ErrRetryTimeout is returned if ctx is done before the pods holding addresses have been checked.
+func (a *KubernetesAllocator) Allocate(ctx context.Context, namespace, podName, ifName, containerID string, request *PodRequest) (ip net.IPNet, pool *v1alpha1.IPPool, created bool, err error) {
 	p, err := a.Client.GetIPPool()
 	if err != nil {
-		return ip, gateway, err
+		return ip, nil, false, err
 	}
 
 	if err := p.Spec.Validate(); err != nil {
-		return ip, gateway, fmt.Errorf("IP Pool Spec is invalid.  Please check your configuration.  Error was: %v Got Spec: %v", err, p.Spec)
+		return ip, p, false, fmt.Errorf("IP Pool Spec is invalid.  Please check your configuration.  Error was: %v Got Spec: %v", err, p.Spec)
+	}
+
+	if err := a.checkNamespace(p, namespace); err != nil {
+		return ip, p, false, err
 	}
 
-	gateway = p.Gateway()
+	// Dynamic reservations that conflict with static ones would hand out statically reserved addresses, or give a pod
+	// two addresses, so they're dropped
+	dropped := p.DropConflictingReservations()
+
 	ip = net.IPNet{Mask: p.Spec.GetMask()}
+	if request == nil {
+		request = &PodRequest{}
+	}
+	reservation := request.Reservation(ifName, containerID)
+	selected := p.Spec.SelectorReservationFor(namespace, request.Labels)
+	holders := make(map[string]bool)
+
+	for _, requestedIP := range request.IPs {
+		if !p.RangeContains(requestedIP) {
+			continue
+		}
+
+		created, err := a.reserveRequestedIP(ctx, p, holders, namespace, podName, ifName, reservation, requestedIP, selected)
+		if err != nil {
+			return ip, p, false, err
+		}
+		ip.IP = requestedIP
+		return ip, p, created, a.updateIPPool(p)
+	}
+
+	// A dynamic reservation for an address that has since been excluded, or that's on the wrong side of a selector
+	// reservation, is given up
+	if existingIP := p.GetExistingReservation(namespace, podName, ifName); existingIP != nil && (p.Spec.Excluded(*existingIP) || !selectorAllows(p, selected, *existingIP)) {
+		p.FreeDynamicPodReservation(namespace, podName, ifName, "")
+	}
 
 	// * If an IP is already assigned to a pod with a matching name/namespace tuple, that ip is reassigned (any pod that's named the same will get the same IP when relaunched)
-	if existingIP := p.GetExistingReservation(namespace, podName); existingIP != nil {
+	if existingIP := p.GetExistingReservation(namespace, podName, ifName); existingIP != nil {
 		ip.IP = *existingIP
-		return ip, gateway, nil
+		// The reservation now belongs to this sandbox, so a late DEL for an earlier sandbox leaves it alone
+		if p.ClaimDynamicReservation(namespace, podName, ifName, reservation) || dropped {
+			return ip, p, false, a.updateIPPool(p)
+		}
+		return ip, p, false, nil
 	}
-	// * Otherwise an IP is chosen randomly
+	// * Otherwise an IP is chosen using the pool's allocation strategy, from the node's blocks first if the pool is
+	// divided into blocks, or from the selector reservation the pod matches
+	strategy := p.NewBlockStrategy(request.NodeName, p.NewAllocationStrategy(namespace, podName))
+	if selected != nil {
+		strategy = p.NewSelectorReservationStrategy(*selected)
+	}
+	index := p.NewReservationIndex()
 	var allocatedIP *net.IP
+	// quarantinedIP is the free address released longest ago that's still in its reuse cooldown
+	var quarantinedIP net.IP
+	var quarantinedSince time.Time
 	for allocatedIP == nil {
-		candidateIP := p.RandomIP()
-		if existingPodNS, existingPodName, found := p.GetPodForIP(candidateIP); found {
+		candidateIP := strategy.Next()
+		if candidateIP == nil {
+			// * Quarantined addresses are only reused once every other address is taken
+			if quarantinedIP == nil && selected != nil {
+				return ip, p, false, &PoolExhaustedError{Pool: p.Name, Reservation: selected.Name}
+			} else if quarantinedIP == nil {
+				return ip, p, false, &PoolExhaustedError{Pool: p.Name, Capacity: p.Capacity()}
+			}
+			allocatedIP = &quarantinedIP
+			break
+		}
+
+		if !p.HostAddress(candidateIP) || !selectorAllows(p, selected, candidateIP) {
+			continue
+		}
+
+		// Excluded addresses and the gateway are never handed out, even if a dead pod holds a reservation for one
+		if p.Spec.Excluded(candidateIP) || p.Spec.Gateway.Equal(candidateIP) {
+			continue
+		}
+
+		if owner, found := index.Owner(candidateIP); found {
+			// Static reservations are never reclaimed
+			if owner.Static {
+				continue
+			}
+
 			// If the chosen IP is assigned, we check to see if the pod that has claimed it is still running.
-			pod, err := a.Client.GetPod(existingPodNS, existingPodName)
+			dead, err := a.holderDead(ctx, p, holders, owner.Namespace, owner.PodName, owner.IfName)
 			if err != nil {
-				return ip, gateway, err
+				return ip, p, false, err
 			}
 
 			// * If the pod is running a new IP is chosen and the process is repeated until an ip is assigned.
-			if pod != nil {
+			if !dead {
 				continue
 			}
 
-			// * If the pod is no longer running, the IP is reclaimed by us.
+			// * If the pod is no longer running, the IP is reclaimed by us, unless reclaiming it starts its reuse cooldown.
+			p.FreeDynamicPodReservation(owner.Namespace, owner.PodName, owner.IfName, "")
+			if released, quarantined := p.Quarantined(candidateIP, time.Now()); quarantined {
+				if quarantinedIP == nil || released.Before(quarantinedSince) {
+					quarantinedIP, quarantinedSince = candidateIP, released
+				}
+				continue
+			}
+			allocatedIP = &candidateIP
+			break
 		}
 
-		if !p.AlreadyReserved(candidateIP) {
+		if !index.AlreadyReserved(candidateIP) {
+			if released, quarantined := index.Quarantined(candidateIP); quarantined {
+				if quarantinedIP == nil || released.Before(quarantinedSince) {
+					quarantinedIP, quarantinedSince = candidateIP, released
+				}
+				continue
+			}
+
 			// If the chosen IP is available it is marked as belonging to this pod in the pool and assigned.
 			allocatedIP = &candidateIP
 			break
@@ -138,32 +454,224 @@ func (a *KubernetesAllocator) Allocate(namespace, podName string) (ip net.IPNet,
 	ip.IP = *allocatedIP
 
 	if !p.RangeContains(*allocatedIP) {
-		return ip, gateway, fmt.Errorf("somehow allocated ip not in network. %v", allocatedIP)
+		return ip, p, false, fmt.Errorf("somehow allocated ip not in network. %v", allocatedIP)
 	}
 
-	p.Reserve(namespace, podName, ip.IP)
+	reservation.IP = ip.IP
+	p.Reserve(namespace, podName, ifName, reservation)
+	p.ClaimBlock(ip.IP, request.NodeName)
 
-	err = a.Client.UpdateIPPool(p)
-	if err != nil && kubeerrors.IsConflict(err) {
-		// update failed due to stale resourceversion
-		return ip, gateway, ErrUpdateConflict
+	return ip, p, true, a.updateIPPool(p)
+}
+
+// checkNamespace returns a NamespaceNotAllowedError if pods in the namespace may not allocate from the pool.  The
+// namespace is only looked up if its labels are needed.
+func (a *KubernetesAllocator) checkNamespace(p *v1alpha1.IPPool, namespace string) error {
+	if !p.Spec.RestrictsNamespaces() || p.Spec.AllowsNamespace(namespace, nil) {
+		return nil
+	}
+
+	if p.Spec.NamespaceSelector != nil {
+		ns, err := a.Client.GetNamespace(namespace)
+		if err != nil {
+			return fmt.Errorf("unable to get namespace %s: %v", namespace, err)
+		}
+		if ns != nil && p.Spec.AllowsNamespace(namespace, ns.Labels) {
+			return nil
+		}
 	}
 
-	return ip, gateway, err
+	return &NamespaceNotAllowedError{Pool: p.Name, Namespace: namespace}
 }
 
-func (a *KubernetesAllocator) Free(namespace, podName string) error {
-	p, err := a.Client.GetIPPool()
+// selectorAllows returns true if ip may be given to a pod that matched the selector reservation selected: ip must be
+// one of its addresses, or if the pod matched none, ip mustn't be set aside by any selector reservation
+func selectorAllows(p *v1alpha1.IPPool, selected *v1alpha1.SelectorReservation, ip net.IP) bool {
+	if selected != nil {
+		return selected.Contains(ip)
+	}
+	return !p.Spec.SelectorReserved(ip)
+}
+
+// reserveRequestedIP reserves requestedIP for the pod, returning true if it wasn't already the pod's reservation.  The
+// address is reclaimed if it's held by a pod the liveness policy finds dead, but is never taken from a live pod, a
+// static reservation, the gateway, an exclusion or the subnet's network or broadcast address, and must be allowed by
+// the selector reservation the pod matched.  An address another pod released within the pool's reuse cooldown is
+// refused.
+func (a *KubernetesAllocator) reserveRequestedIP(ctx context.Context, p *v1alpha1.IPPool, holders map[string]bool, namespace, podName, ifName string, reservation v1alpha1.IPReservation, requestedIP net.IP, selected *v1alpha1.SelectorReservation) (bool, error) {
+	if p.Spec.Excluded(requestedIP) {
+		return false, fmt.Errorf("%v: %s is excluded from pool %s", ErrRequestedIPUnavailable, requestedIP, p.Name)
+	}
+
+	if !p.HostAddress(requestedIP) {
+		return false, fmt.Errorf("%v: %s is the network or broadcast address of pool %s", ErrRequestedIPUnavailable, requestedIP, p.Name)
+	}
+
+	if !selectorAllows(p, selected, requestedIP) {
+		if selected != nil {
+			return false, fmt.Errorf("%v: %s isn't one of the addresses in selector reservation %s of pool %s", ErrRequestedIPUnavailable, requestedIP, selected.Name, p.Name)
+		}
+		return false, fmt.Errorf("%v: %s is set aside by a selector reservation in pool %s", ErrRequestedIPUnavailable, requestedIP, p.Name)
+	}
+
+	if existingIP := p.GetExistingReservation(namespace, podName, ifName); existingIP != nil {
+		if existingIP.Equal(requestedIP) {
+			p.ClaimDynamicReservation(namespace, podName, ifName, reservation)
+			return false, nil
+		}
+
+		if p.Spec.StaticReservations.GetExistingReservation(namespace, podName, ifName) != nil {
+			return false, fmt.Errorf("%v: %s/%s has a static reservation for %s", ErrRequestedIPUnavailable, namespace, podName, existingIP)
+		}
+	}
+
+	if p.Spec.Gateway.Equal(requestedIP) {
+		return false, fmt.Errorf("%v: %s is the gateway for pool %s", ErrRequestedIPUnavailable, requestedIP, p.Name)
+	}
+
+	reclaimed := false
+	if existingPodNS, existingPodName, existingIfName, found := p.GetPodForIP(requestedIP); found {
+		if p.Spec.StaticReservations.AlreadyReserved(requestedIP) {
+			return false, fmt.Errorf("%v: %s is statically reserved for %s/%s", ErrRequestedIPUnavailable, requestedIP, existingPodNS, existingPodName)
+		}
+
+		dead, err := a.holderDead(ctx, p, holders, existingPodNS, existingPodName, existingIfName)
+		if err != nil {
+			return false, err
+		}
+
+		if !dead {
+			return false, fmt.Errorf("%v: %s is reserved by running pod %s/%s", ErrRequestedIPUnavailable, requestedIP, existingPodNS, existingPodName)
+		}
+
+		// The pod holding the address no longer exists, reclaim it.
+		p.FreeDynamicPodReservation(existingPodNS, existingPodName, existingIfName, "")
+		reclaimed = true
+	}
+
+	if _, quarantined := p.QuarantinedFrom(requestedIP, namespace, podName, time.Now()); quarantined {
+		// Save the reclaim so the address's cooldown is kept
+		if reclaimed {
+			if err := a.updateIPPool(p); err != nil {
+				return false, err
+			}
+		}
+		return false, fmt.Errorf("%v: %s was released by another pod within the reuse cooldown of pool %s", ErrRequestedIPUnavailable, requestedIP, p.Name)
+	}
+
+	reservation.IP = requestedIP
+	p.Reserve(namespace, podName, ifName, reservation)
+	return true, nil
+}
+
+// holderDead returns true if the pod holding the dynamic reservation for its interface is dead according to the
+// allocator's liveness policy.  Verdicts are remembered in holders, so each holder is only looked up once per
+// allocation.  ErrRetryTimeout is returned once ctx is done.
+func (a *KubernetesAllocator) holderDead(ctx context.Context, p *v1alpha1.IPPool, holders map[string]bool, namespace, podName, ifName string) (bool, error) {
+	key := namespace + "/" + v1alpha1.ReservationKey(podName, ifName)
+	if dead, found := holders[key]; found {
+		return dead, nil
+	}
+
+	if ctx.Err() != nil {
+		return false, ErrRetryTimeout
+	}
+
+	pod, err := a.Client.GetPod(namespace, podName)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	reservation := v1alpha1.IPReservation{}
+	if held := p.Status.DynamicReservations.GetReservation(namespace, podName, ifName); held != nil {
+		reservation = *held
 	}
 
-	p.FreeDynamicPodReservation(namespace, podName)
+	liveness := a.Liveness
+	if liveness == nil {
+		liveness = DefaultLivenessPolicy()
+	}
+	reason, err := liveness.Dead(pod, reservation)
+	if err != nil {
+		return false, err
+	}
+	holders[key] = reason != ""
+	return reason != "", nil
+}
 
-	err = a.Client.UpdateIPPool(p)
+// updateIPPool saves the pool, returning ErrUpdateConflict if it was modified since it was retrieved
+func (a *KubernetesAllocator) updateIPPool(p *v1alpha1.IPPool) error {
+	err := a.Client.UpdateIPPool(p)
 	if err != nil && kubeerrors.IsConflict(err) {
 		// update failed due to stale resourceversion
 		return ErrUpdateConflict
 	}
 	return err
 }
+
+// Free releases the reservation for the pod's interface, unless it has since been claimed by a sandbox other than
+// containerID.
+func (a *KubernetesAllocator) Free(namespace, podName, ifName, containerID string) error {
+	p, err := a.Client.GetIPPool()
+	if err != nil {
+		return err
+	}
+
+	if !p.FreeDynamicPodReservation(namespace, podName, ifName, containerID) {
+		return nil
+	}
+
+	return a.updateIPPool(p)
+}
+
+// Check verifies that the address from addrs that falls within the pool is still reserved for this pod and that its
+// netmask and gateway match the pool.
+func (a *KubernetesAllocator) Check(namespace, podName, ifName, containerID string, addrs []Address) error {
+	p, err := a.Client.GetIPPool()
+	if err != nil {
+		return err
+	}
+
+	var addr *Address
+	for i := range addrs {
+		if p.RangeContains(addrs[i].Address.IP) {
+			addr = &addrs[i]
+			break
+		}
+	}
+
+	if addr == nil {
+		return &ReservationCheckError{Err: ErrReservationMismatch, Details: fmt.Sprintf("no address within %s found", p.Spec.AllRanges())}
+	}
+
+	reservedIP := p.GetExistingReservation(namespace, podName, ifName)
+	if reservedIP == nil || !reservedIP.Equal(addr.Address.IP) {
+		if existingPodNS, existingPodName, _, found := p.GetPodForIP(addr.Address.IP); found {
+			return &ReservationCheckError{Err: ErrReservationMoved, Details: fmt.Sprintf("%s is reserved by %s/%s", addr.Address.IP, existingPodNS, existingPodName)}
+		}
+	}
+
+	if reservedIP == nil {
+		return &ReservationCheckError{Err: ErrReservationNotFound, Details: fmt.Sprintf("%s/%s has no reservation in pool %s", namespace, podName, p.Name)}
+	}
+
+	if !reservedIP.Equal(addr.Address.IP) {
+		return &ReservationCheckError{Err: ErrReservationMismatch, Details: fmt.Sprintf("pool reserves %s for %s/%s, attachment has %s", reservedIP, namespace, podName, addr.Address.IP)}
+	}
+
+	if reservation := p.GetReservation(namespace, podName, ifName); !reservation.MatchesContainer(containerID) {
+		return &ReservationCheckError{Err: ErrReservationMoved, Details: fmt.Sprintf("%s is reserved by sandbox %s", addr.Address.IP, reservation.ContainerID)}
+	}
+
+	addrOnes, addrBits := addr.Address.Mask.Size()
+	poolOnes, poolBits := p.Spec.GetMask().Size()
+	if addrOnes != poolOnes || addrBits != poolBits {
+		return &ReservationCheckError{Err: ErrReservationMismatch, Details: fmt.Sprintf("attachment has netmask /%d, pool has /%d", addrOnes, poolOnes)}
+	}
+
+	if !addr.Gateway.Equal(p.Gateway()) {
+		return &ReservationCheckError{Err: ErrReservationMismatch, Details: fmt.Sprintf("attachment has gateway %v, pool has %v", addr.Gateway, p.Gateway())}
+	}
+
+	return nil
+}
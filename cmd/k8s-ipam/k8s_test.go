@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	"github.com/containernetworking/cni/pkg/types"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type FakeKubernetesClient struct {
@@ -20,7 +25,14 @@ func (c *FakeKubernetesClient) UpdateIPPool(*v1alpha1.IPPool) error {
 	return nil
 }
 
+// GetPod returns a running pod for every name, so addresses held in the pool are never reclaimed
 func (c *FakeKubernetesClient) GetPod(namespace, podName string) (*corev1.Pod, error) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: podName}}
+	pod.Status.Phase = corev1.PodRunning
+	return pod, nil
+}
+
+func (c *FakeKubernetesClient) GetNamespace(name string) (*corev1.Namespace, error) {
 	return nil, nil
 }
 
@@ -28,12 +40,12 @@ func TestK8SAllocate(t *testing.T) {
 	a := &KubernetesAllocator{Client: &FakeKubernetesClient{
 		v1alpha1.IPPool{
 			Spec: v1alpha1.IPPoolSpec{
-				Range:       v1alpha1.IPRange{"2001:db8::/65"},
+				Range:       v1alpha1.IPRange("2001:db8::/65"),
 				NetmaskBits: 64,
 				Gateway:     net.ParseIP("2001:db8::1"),
 			},
 		}}}
-	ip, gw, err := a.Allocate("foo", "bar")
+	ip, pool, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", nil)
 	if err != nil {
 		t.Errorf("error allocating address: %v", err)
 	}
@@ -43,7 +55,820 @@ func TestK8SAllocate(t *testing.T) {
 	}
 	t.Logf("Reserved IP %s", ip.String())
 
-	if !gw.Equal(net.ParseIP("2001:db8::1")) {
+	if !pool.Gateway().Equal(net.ParseIP("2001:db8::1")) {
 		t.Errorf("wrong gateway")
 	}
 }
+
+func TestK8SCheck(t *testing.T) {
+	pool := v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("2001:db8::/65"),
+			NetmaskBits: 64,
+			Gateway:     net.ParseIP("2001:db8::1"),
+		},
+	}
+	pool.Reserve("foo", "bar", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("2001:db8::10")})
+	pool.Reserve("foo", "baz", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("2001:db8::20")})
+	a := &KubernetesAllocator{Client: &FakeKubernetesClient{pool}}
+
+	address := func(cidr, gw string) []Address {
+		ip, network, _ := net.ParseCIDR(cidr)
+		network.IP = ip
+		return []Address{{Version: "6", Address: types.IPNet(*network), Gateway: net.ParseIP(gw)}}
+	}
+
+	tests := []struct {
+		name      string
+		podName   string
+		addrs     []Address
+		expectErr error
+	}{
+		{"valid", "bar", address("2001:db8::10/64", "2001:db8::1"), nil},
+		{"wrong mask", "bar", address("2001:db8::10/65", "2001:db8::1"), ErrReservationMismatch},
+		{"wrong gateway", "bar", address("2001:db8::10/64", "2001:db8::2"), ErrReservationMismatch},
+		{"not in pool", "bar", address("2001:db8:0:1::10/64", "2001:db8::1"), ErrReservationMismatch},
+		{"moved", "bar", address("2001:db8::20/64", "2001:db8::1"), ErrReservationMoved},
+		{"gone", "qux", address("2001:db8::30/64", "2001:db8::1"), ErrReservationNotFound},
+	}
+
+	for _, test := range tests {
+		err := a.Check("foo", test.podName, "eth0", "", test.addrs)
+		if test.expectErr == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+
+		checkErr, ok := err.(*ReservationCheckError)
+		if !ok || checkErr.Err != test.expectErr {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectErr, err)
+		}
+	}
+}
+
+type FakePodKubernetesClient struct {
+	FakeKubernetesClient
+	Pods       map[string]*corev1.Pod
+	Namespaces map[string]*corev1.Namespace
+	Nodes      map[string]*corev1.Node
+}
+
+func (c *FakePodKubernetesClient) GetPod(namespace, podName string) (*corev1.Pod, error) {
+	return c.Pods[namespace+"/"+podName], nil
+}
+
+func (c *FakePodKubernetesClient) GetNamespace(name string) (*corev1.Namespace, error) {
+	return c.Namespaces[name], nil
+}
+
+func (c *FakePodKubernetesClient) GetNode(name string) (*corev1.Node, error) {
+	return c.Nodes[name], nil
+}
+
+func TestNewPodRequest(t *testing.T) {
+	pod := &corev1.Pod{}
+	pod.Annotations = map[string]string{
+		IPAnnotation:     "10.2.3.70, 2001:db8::10",
+		IPPoolAnnotation: "pool-v4,pool-v6",
+	}
+
+	request, err := NewPodRequest(pod)
+	if err != nil {
+		t.Fatalf("unable to parse annotations: %v", err)
+	}
+
+	if len(request.IPs) != 2 || !request.IPs[0].Equal(net.ParseIP("10.2.3.70")) || !request.IPs[1].Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("wrong ips parsed: %v", request.IPs)
+	}
+
+	if len(request.IPPoolNames) != 2 || request.IPPoolNames[0] != "pool-v4" || request.IPPoolNames[1] != "pool-v6" {
+		t.Errorf("wrong pools parsed: %v", request.IPPoolNames)
+	}
+
+	pod.Labels = map[string]string{"app": "web"}
+	if request, err := NewPodRequest(pod); err != nil || request.Labels["app"] != "web" {
+		t.Errorf("expected the pod's labels in the request, got %v, %v", request, err)
+	}
+
+	pod.Annotations[IPAnnotation] = "not-an-ip"
+	if _, err := NewPodRequest(pod); err == nil {
+		t.Errorf("expected error parsing invalid ip annotation")
+	}
+
+	if request, err := NewPodRequest(nil); err != nil || len(request.IPs) != 0 || len(request.IPPoolNames) != 0 {
+		t.Errorf("expected empty request for nil pod, got %v, %v", request, err)
+	}
+}
+
+func TestK8SAllocateRequestedIP(t *testing.T) {
+	newClient := func() *FakePodKubernetesClient {
+		pool := v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("2001:db8::/65"),
+				NetmaskBits:        64,
+				Gateway:            net.ParseIP("2001:db8::1"),
+				StaticReservations: v1alpha1.NewIPReservationMap(),
+			},
+		}
+		pool.Spec.StaticReservations.Reserve("foo", "static", "", v1alpha1.IPReservation{IP: net.ParseIP("2001:db8::5")})
+		pool.Reserve("foo", "running", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("2001:db8::20")})
+		pool.Reserve("foo", "gone", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("2001:db8::30")})
+		return &FakePodKubernetesClient{
+			FakeKubernetesClient: FakeKubernetesClient{pool},
+			Pods:                 map[string]*corev1.Pod{"foo/running": &corev1.Pod{}},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		requestedIP string
+		expectErr   bool
+	}{
+		{"available", "2001:db8::10", false},
+		{"reserved by running pod", "2001:db8::20", true},
+		{"reclaimed from deleted pod", "2001:db8::30", false},
+		{"gateway", "2001:db8::1", true},
+		{"static reservation", "2001:db8::5", true},
+		{"network address", "2001:db8::", true},
+	}
+
+	for _, test := range tests {
+		client := newClient()
+		a := &KubernetesAllocator{Client: client}
+		requestedIP := net.ParseIP(test.requestedIP)
+		ip, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", &PodRequest{IPs: []net.IP{requestedIP}})
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.name, ip)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if !ip.IP.Equal(requestedIP) {
+			t.Errorf("%s: got %v, expected %v", test.name, ip.IP, requestedIP)
+		}
+
+		if namespace, podName, _, _ := client.Pool.GetPodForIP(requestedIP); namespace != "foo" || podName != "bar" {
+			t.Errorf("%s: requested ip reserved by %s/%s", test.name, namespace, podName)
+		}
+	}
+
+	// a requested ip outside the pool's range falls back to normal allocation
+	a := &KubernetesAllocator{Client: newClient()}
+	if ip, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", &PodRequest{IPs: []net.IP{net.ParseIP("10.2.3.70")}}); err != nil || ip.IP.To4() != nil {
+		t.Errorf("expected allocation from pool, got %v, %v", ip, err)
+	}
+}
+
+func TestK8SAllocateMultipleInterfaces(t *testing.T) {
+	client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("2001:db8::/65"),
+			NetmaskBits: 64,
+		},
+	}}
+	legacyIP := net.ParseIP("2001:db8::10")
+	client.Pool.Status.DynamicReservations = v1alpha1.NewIPReservationMap()
+	client.Pool.Status.DynamicReservations.Reserve("foo", "bar", "", v1alpha1.IPReservation{IP: legacyIP})
+	a := &KubernetesAllocator{Client: client}
+
+	net1, _, _, err := a.Allocate(context.Background(), "foo", "bar", "net1", "container1", nil)
+	if err != nil {
+		t.Fatalf("error allocating address for net1: %v", err)
+	}
+
+	if !net1.IP.Equal(legacyIP) {
+		t.Errorf("existing reservation not reused for first interface, got %v", net1.IP)
+	}
+
+	if _, found := client.Pool.Status.DynamicReservations["foo"]["bar"]; found {
+		t.Errorf("legacy reservation not migrated to interface")
+	}
+
+	net2, _, _, err := a.Allocate(context.Background(), "foo", "bar", "net2", "container1", nil)
+	if err != nil {
+		t.Fatalf("error allocating address for net2: %v", err)
+	}
+
+	if net2.IP.Equal(net1.IP) {
+		t.Errorf("both interfaces were allocated %v", net1.IP)
+	}
+
+	if err := a.Free("foo", "bar", "net2", "container1"); err != nil {
+		t.Fatalf("error freeing net2: %v", err)
+	}
+
+	if existingIP := client.Pool.GetExistingReservation("foo", "bar", "net1"); existingIP == nil || !existingIP.Equal(net1.IP) {
+		t.Errorf("net1 reservation lost when freeing net2: %v", existingIP)
+	}
+}
+
+func TestK8SFreeSandbox(t *testing.T) {
+	newAllocator := func() (*KubernetesAllocator, *FakeKubernetesClient) {
+		client := &FakeKubernetesClient{v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:       v1alpha1.IPRange("2001:db8::/65"),
+				NetmaskBits: 64,
+			},
+		}}
+		return &KubernetesAllocator{Client: client}, client
+	}
+
+	// StatefulSet pod recreated under the same name: ADD for the new sandbox, then a late DEL for the old one
+	a, client := newAllocator()
+	oldIP, _, _, err := a.Allocate(context.Background(), "foo", "web-0", "eth0", "old-sandbox", nil)
+	if err != nil {
+		t.Fatalf("unable to allocate for old sandbox: %v", err)
+	}
+
+	newIP, _, _, err := a.Allocate(context.Background(), "foo", "web-0", "eth0", "new-sandbox", nil)
+	if err != nil {
+		t.Fatalf("unable to allocate for new sandbox: %v", err)
+	}
+
+	if !newIP.IP.Equal(oldIP.IP) {
+		t.Errorf("new sandbox didn't reuse the pod's address")
+	}
+
+	if err := a.Free("foo", "web-0", "eth0", "old-sandbox"); err != nil {
+		t.Fatalf("unable to free old sandbox: %v", err)
+	}
+
+	if reservation := client.Pool.GetReservation("foo", "web-0", "eth0"); reservation == nil || reservation.ContainerID != "new-sandbox" {
+		t.Errorf("late DEL for old sandbox freed the new sandbox's reservation: %v", reservation)
+	}
+
+	if err := a.Check("foo", "web-0", "eth0", "old-sandbox", []Address{{Address: types.IPNet(oldIP)}}); err == nil {
+		t.Errorf("CHECK succeeded for a sandbox that no longer holds the reservation")
+	}
+
+	if err := a.Free("foo", "web-0", "eth0", "new-sandbox"); err != nil {
+		t.Fatalf("unable to free new sandbox: %v", err)
+	}
+
+	if reservation := client.Pool.GetReservation("foo", "web-0", "eth0"); reservation != nil {
+		t.Errorf("reservation not freed by the sandbox holding it: %v", reservation)
+	}
+
+	// DEL for the old sandbox arrives before the new sandbox's ADD
+	a, client = newAllocator()
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "web-0", "eth0", "old-sandbox", nil); err != nil {
+		t.Fatalf("unable to allocate for old sandbox: %v", err)
+	}
+
+	if err := a.Free("foo", "web-0", "eth0", "old-sandbox"); err != nil {
+		t.Fatalf("unable to free old sandbox: %v", err)
+	}
+
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "web-0", "eth0", "new-sandbox", nil); err != nil {
+		t.Fatalf("unable to allocate for new sandbox: %v", err)
+	}
+
+	if err := a.Free("foo", "web-0", "eth0", "old-sandbox"); err != nil {
+		t.Fatalf("unable to repeat free for old sandbox: %v", err)
+	}
+
+	if reservation := client.Pool.GetReservation("foo", "web-0", "eth0"); reservation == nil || reservation.ContainerID != "new-sandbox" {
+		t.Errorf("repeated DEL for old sandbox freed the new sandbox's reservation: %v", reservation)
+	}
+}
+
+func TestK8SAllocateStrategies(t *testing.T) {
+	tests := []struct {
+		strategy      string
+		lastAllocated net.IP
+		expected      []string
+	}{
+		// the network address and gateway are skipped
+		{v1alpha1.AllocationStrategyLowestFree, nil, []string{"10.2.3.66", "10.2.3.67", "10.2.3.68"}},
+		{v1alpha1.AllocationStrategySequential, net.ParseIP("10.2.3.70"), []string{"10.2.3.71", "10.2.3.72", "10.2.3.73"}},
+		{v1alpha1.AllocationStrategySequential, net.ParseIP("10.2.3.78"), []string{"10.2.3.79", "10.2.3.66", "10.2.3.67"}},
+	}
+
+	for _, test := range tests {
+		client := &FakeKubernetesClient{v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/28"),
+				NetmaskBits:        27,
+				Gateway:            net.ParseIP("10.2.3.65"),
+				AllocationStrategy: test.strategy,
+			},
+			Status: v1alpha1.IPPoolStatus{LastAllocated: test.lastAllocated},
+		}}
+		a := &KubernetesAllocator{Client: client}
+
+		for i, expected := range test.expected {
+			ip, _, _, err := a.Allocate(context.Background(), "foo", fmt.Sprintf("pod-%d", i), "eth0", "container1", nil)
+			if err != nil {
+				t.Fatalf("%s: unable to allocate: %v", test.strategy, err)
+			}
+
+			if !ip.IP.Equal(net.ParseIP(expected)) {
+				t.Errorf("%s after %v: allocation %d got %v, expected %s", test.strategy, test.lastAllocated, i, ip.IP, expected)
+			}
+		}
+	}
+}
+
+func TestK8SAllocateRecordsOwner(t *testing.T) {
+	client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("10.2.3.64/28"),
+			NetmaskBits: 27,
+		},
+	}}
+	a := &KubernetesAllocator{Client: client}
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "foo"
+	pod.Name = "web-0"
+	pod.UID = "uid-1"
+	pod.Spec.NodeName = "node1"
+	request, err := NewPodRequest(pod)
+	if err != nil {
+		t.Fatalf("unable to parse pod request: %v", err)
+	}
+
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "web-0", "eth0", "old-sandbox", request); err != nil {
+		t.Fatalf("unable to allocate: %v", err)
+	}
+
+	first := *client.Pool.GetReservation("foo", "web-0", "eth0")
+	if first.PodUID != "uid-1" || first.NodeName != "node1" || first.ContainerID != "old-sandbox" || first.Interface != "eth0" || first.Created == nil || first.LastSeen == nil {
+		t.Fatalf("reservation doesn't record its owner: %+v", first)
+	}
+
+	// The pod is recreated with the same name on another node
+	pod.UID = "uid-2"
+	pod.Spec.NodeName = "node2"
+	request, _ = NewPodRequest(pod)
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "web-0", "eth0", "new-sandbox", request); err != nil {
+		t.Fatalf("unable to allocate: %v", err)
+	}
+
+	second := client.Pool.GetReservation("foo", "web-0", "eth0")
+	if !second.IP.Equal(first.IP) || !second.Created.Equal(first.Created) {
+		t.Errorf("reservation address or creation time changed: %+v, was %+v", second, first)
+	}
+	if second.PodUID != "uid-2" || second.NodeName != "node2" || second.ContainerID != "new-sandbox" || second.LastSeen.Before(first.LastSeen) {
+		t.Errorf("reservation owner not updated: %+v", second)
+	}
+}
+
+func TestK8SAllocateQuarantine(t *testing.T) {
+	for _, strategy := range []string{v1alpha1.AllocationStrategyRandom, v1alpha1.AllocationStrategySequential, v1alpha1.AllocationStrategyLowestFree} {
+		// .64 is the network address, leaving .65 to .67
+		client := &FakeKubernetesClient{v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/30"),
+				NetmaskBits:        27,
+				AllocationStrategy: strategy,
+				ReuseCooldown:      &metav1.Duration{Duration: time.Hour},
+			},
+		}}
+		a := &KubernetesAllocator{Client: client}
+
+		released := net.ParseIP("10.2.3.65")
+		if _, _, _, err := a.Allocate(context.Background(), "foo", "old", "eth0", "container1", &PodRequest{IPs: []net.IP{released}}); err != nil {
+			t.Fatalf("%s: unable to allocate: %v", strategy, err)
+		}
+		if err := a.Free("foo", "old", "eth0", "container1"); err != nil {
+			t.Fatalf("%s: unable to free: %v", strategy, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			ip, _, _, err := a.Allocate(context.Background(), "foo", fmt.Sprintf("pod-%d", i), "eth0", "container1", nil)
+			if err != nil {
+				t.Fatalf("%s: unable to allocate: %v", strategy, err)
+			}
+			if ip.IP.Equal(released) {
+				t.Errorf("%s: quarantined address reused while others were free", strategy)
+			}
+		}
+
+		// Every other address is taken, so the quarantined address is reused rather than failing
+		ip, _, _, err := a.Allocate(context.Background(), "foo", "pod-2", "eth0", "container1", nil)
+		if err != nil || !ip.IP.Equal(released) {
+			t.Errorf("%s: expected the quarantined address once the pool was otherwise exhausted, got %v, %v", strategy, ip.IP, err)
+		}
+
+		if len(client.Pool.Status.Quarantine) != 0 {
+			t.Errorf("%s: reused address still quarantined: %v", strategy, client.Pool.Status.Quarantine)
+		}
+	}
+}
+
+func TestK8SAllocateReclaimQuarantine(t *testing.T) {
+	// .64 is the network address, leaving .65 to .67, and .65 is held by a pod that's gone
+	newClient := func() *FakePodKubernetesClient {
+		pool := v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/30"),
+				NetmaskBits:        27,
+				AllocationStrategy: v1alpha1.AllocationStrategyLowestFree,
+				ReuseCooldown:      &metav1.Duration{Duration: time.Hour},
+			},
+		}
+		pool.Reserve("foo", "holder", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.65")})
+		return &FakePodKubernetesClient{FakeKubernetesClient: FakeKubernetesClient{pool}, Pods: map[string]*corev1.Pod{}}
+	}
+	reclaimed := net.ParseIP("10.2.3.65")
+
+	// The reclaimed address is quarantined rather than handed straight to another pod
+	client := newClient()
+	a := &KubernetesAllocator{Client: client}
+	ip, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", nil)
+	if err != nil || !ip.IP.Equal(net.ParseIP("10.2.3.66")) {
+		t.Errorf("expected the next free address, got %v, %v", ip.IP, err)
+	}
+	if client.Pool.GetReservation("foo", "holder", "eth0") != nil {
+		t.Errorf("dead pod's reservation not reclaimed")
+	}
+	if _, quarantined := client.Pool.Quarantined(reclaimed, time.Now()); !quarantined {
+		t.Errorf("reclaimed address not quarantined: %v", client.Pool.Status.Quarantine)
+	}
+
+	// Requesting it is refused for other pods, but the pod that released it may have it back
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "baz", "eth0", "container1", &PodRequest{IPs: []net.IP{reclaimed}}); err == nil {
+		t.Errorf("expected a quarantined address to be unavailable on request, got %v", err)
+	}
+	if ip, _, _, err := a.Allocate(context.Background(), "foo", "holder", "eth0", "container2", &PodRequest{IPs: []net.IP{reclaimed}}); err != nil || !ip.IP.Equal(reclaimed) {
+		t.Errorf("expected the releasing pod to get its address back, got %v, %v", ip.IP, err)
+	}
+
+	// A requested address reclaimed from a dead pod is quarantined, and the reclaim is saved
+	client = newClient()
+	a = &KubernetesAllocator{Client: client}
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", &PodRequest{IPs: []net.IP{reclaimed}}); err == nil {
+		t.Errorf("expected a reclaimed address to be unavailable on request, got %v", err)
+	}
+	if client.Pool.GetReservation("foo", "holder", "eth0") != nil {
+		t.Errorf("dead pod's reservation not reclaimed")
+	}
+	if _, quarantined := client.Pool.Quarantined(reclaimed, time.Now()); !quarantined {
+		t.Errorf("reclaimed address not quarantined: %v", client.Pool.Status.Quarantine)
+	}
+}
+
+func TestK8SAllocateDropsConflictingReservations(t *testing.T) {
+	pool := v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:              v1alpha1.IPRange("10.2.3.64/29"),
+			NetmaskBits:        27,
+			AllocationStrategy: v1alpha1.AllocationStrategyLowestFree,
+			StaticReservations: v1alpha1.NewIPReservationMap(),
+		},
+	}
+	// .65 was handed to foo/cache before it was statically reserved for foo/web, which was given .66 dynamically
+	pool.Spec.StaticReservations.Reserve("foo", "web", "", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.65")})
+	pool.Reserve("foo", "cache", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.65")})
+	pool.Reserve("foo", "web", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.66")})
+	client := &FakeKubernetesClient{pool}
+	a := &KubernetesAllocator{Client: client}
+
+	ip, _, _, err := a.Allocate(context.Background(), "foo", "cache", "eth0", "container1", nil)
+	if err != nil || !ip.IP.Equal(net.ParseIP("10.2.3.66")) {
+		t.Errorf("expected the lowest address outside the static reservation, got %v, %v", ip.IP, err)
+	}
+	if err := client.Pool.Validate(); err != nil {
+		t.Errorf("conflicting reservations left in the pool: %v", err)
+	}
+
+	ip, _, _, err = a.Allocate(context.Background(), "foo", "web", "eth0", "container1", nil)
+	if err != nil || !ip.IP.Equal(net.ParseIP("10.2.3.65")) {
+		t.Errorf("expected the static reservation, got %v, %v", ip.IP, err)
+	}
+}
+
+func TestK8SAllocateExclusions(t *testing.T) {
+	// .64 is the network address and .65 to .66 are excluded, leaving .67.  Only the old pod is running.
+	running := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "old"}}
+	running.Status.Phase = corev1.PodRunning
+	client := &FakePodKubernetesClient{
+		FakeKubernetesClient: FakeKubernetesClient{v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/30"),
+				NetmaskBits:        27,
+				AllocationStrategy: v1alpha1.AllocationStrategyLowestFree,
+				Exclusions:         []v1alpha1.IPExclusion{"10.2.3.65-10.2.3.66"},
+			},
+		}},
+		Pods: map[string]*corev1.Pod{"foo/old": running},
+	}
+	a := &KubernetesAllocator{Client: client}
+
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", &PodRequest{IPs: []net.IP{net.ParseIP("10.2.3.66")}}); err == nil {
+		t.Errorf("excluded address allocated on request")
+	}
+
+	// A reservation made before the address was excluded is moved
+	client.Pool.Reserve("foo", "old", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.65")})
+	ip, _, _, err := a.Allocate(context.Background(), "foo", "old", "eth0", "container1", nil)
+	if err != nil || !ip.IP.Equal(net.ParseIP("10.2.3.67")) {
+		t.Errorf("expected the only address outside the exclusions, got %v, %v", ip.IP, err)
+	}
+
+	// An excluded address held by a pod that's no longer running isn't reclaimed
+	client.Pool.Reserve("foo", "ghost", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.65")})
+	if ip, _, _, err := a.Allocate(context.Background(), "foo", "baz", "eth0", "container1", nil); err == nil {
+		t.Errorf("expected the pool to be exhausted, got %v", ip.IP)
+	} else if exhausted, ok := err.(*PoolExhaustedError); !ok || exhausted.Capacity.Int64() != 1 {
+		t.Errorf("expected a PoolExhaustedError with capacity 1, got %v", err)
+	}
+}
+
+func TestK8SAllocateRanges(t *testing.T) {
+	client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Ranges:             []v1alpha1.IPRange{"10.2.3.10-10.2.3.11", "10.2.3.64/31"},
+			NetmaskBits:        24,
+			AllocationStrategy: v1alpha1.AllocationStrategySequential,
+		},
+	}}
+	a := &KubernetesAllocator{Client: client}
+
+	for i, expected := range []string{"10.2.3.10", "10.2.3.11", "10.2.3.64", "10.2.3.65"} {
+		ip, _, _, err := a.Allocate(context.Background(), "foo", fmt.Sprintf("pod-%d", i), "eth0", "container1", nil)
+		if err != nil {
+			t.Fatalf("unable to allocate address %d: %v", i, err)
+		}
+		if !ip.IP.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s, got %s", expected, ip.IP)
+		}
+	}
+
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "extra", "eth0", "container1", nil); err == nil {
+		t.Errorf("expected the pool to be exhausted")
+	} else if exhausted, ok := err.(*PoolExhaustedError); !ok || exhausted.Capacity.Int64() != 4 {
+		t.Errorf("expected a PoolExhaustedError with capacity 4, got %v", err)
+	}
+}
+
+func TestK8SAllocateBlocks(t *testing.T) {
+	client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:              v1alpha1.IPRange("10.2.3.0/27"),
+			NetmaskBits:        24,
+			BlockSize:          30,
+			AllocationStrategy: v1alpha1.AllocationStrategyRandom,
+		},
+	}}
+	a := &KubernetesAllocator{Client: client}
+
+	blocks := make(map[string]map[string]bool)
+	for i := 0; i < 6; i++ {
+		for _, node := range []string{"node-a", "node-b"} {
+			ip, _, _, err := a.Allocate(context.Background(), "foo", fmt.Sprintf("%s-%d", node, i), "eth0", "container1", &PodRequest{NodeName: node})
+			if err != nil {
+				t.Fatalf("unable to allocate address for %s: %v", node, err)
+			}
+
+			owner, found := client.Pool.BlockAffinity(ip.IP)
+			if !found || owner != node {
+				t.Errorf("%s allocated %s from a block belonging to %q", node, ip.IP, owner)
+			}
+			if blocks[node] == nil {
+				blocks[node] = make(map[string]bool)
+			}
+			blocks[node][ip.IP.Mask(net.CIDRMask(30, 32)).String()] = true
+		}
+	}
+
+	// Each node fills one block before claiming a second
+	for node, nodeBlocks := range blocks {
+		if len(nodeBlocks) != 2 {
+			t.Errorf("expected %s to allocate from 2 blocks, got %v", node, nodeBlocks)
+		}
+	}
+	if len(client.Pool.Status.Blocks) != 4 {
+		t.Errorf("expected 4 blocks to be claimed, got %v", client.Pool.Status.Blocks)
+	}
+}
+
+func TestK8SAllocateNamespaces(t *testing.T) {
+	client := &FakePodKubernetesClient{
+		FakeKubernetesClient: FakeKubernetesClient{v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "public"},
+			Spec: v1alpha1.IPPoolSpec{
+				Range:             v1alpha1.IPRange("10.2.3.64/28"),
+				NetmaskBits:       27,
+				AllowedNamespaces: []string{"team-a"},
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}},
+			},
+		}},
+		Namespaces: map[string]*corev1.Namespace{
+			"team-a": &corev1.Namespace{},
+			"team-b": &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"team": "b"}}},
+			"team-c": &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"team": "c"}}},
+		},
+	}
+	a := &KubernetesAllocator{Client: client}
+
+	tests := []struct {
+		namespace string
+		allowed   bool
+	}{
+		{"team-a", true},
+		{"team-b", true},
+		{"team-c", false},
+		{"missing", false},
+	}
+
+	for _, test := range tests {
+		_, _, _, err := a.Allocate(context.Background(), test.namespace, "web", "eth0", "container1", nil)
+		if test.allowed {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.namespace, err)
+			}
+			continue
+		}
+
+		if _, ok := err.(*NamespaceNotAllowedError); !ok {
+			t.Errorf("%s: expected a NamespaceNotAllowedError, got %v", test.namespace, err)
+			continue
+		}
+		if cniErr, ok := retryError("unable to get allocation for pod", err).(*types.Error); !ok || cniErr.Code != ErrCodeNamespaceNotAllowed {
+			t.Errorf("%s: expected CNI error code %d, got %v", test.namespace, ErrCodeNamespaceNotAllowed, cniErr)
+		}
+		if client.Pool.GetReservation(test.namespace, "web", "eth0") != nil {
+			t.Errorf("%s: address reserved for a namespace that isn't allowed", test.namespace)
+		}
+	}
+}
+
+func TestK8SAllocateSelectorReservations(t *testing.T) {
+	client := &FakeKubernetesClient{v1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "public"},
+		Spec: v1alpha1.IPPoolSpec{
+			Range:              v1alpha1.IPRange("10.2.3.64/29"),
+			NetmaskBits:        27,
+			AllocationStrategy: v1alpha1.AllocationStrategyLowestFree,
+			SelectorReservations: []v1alpha1.SelectorReservation{{
+				Name:        "web",
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Addresses:   []v1alpha1.IPRange{"10.2.3.65-10.2.3.66"},
+			}},
+		},
+	}}
+	a := &KubernetesAllocator{Client: client}
+	web := &PodRequest{Labels: map[string]string{"app": "web"}}
+
+	// Pods that don't match are kept out of the reservation's addresses
+	ip, _, _, err := a.Allocate(context.Background(), "foo", "other", "eth0", "container1", &PodRequest{Labels: map[string]string{"app": "db"}})
+	if err != nil || !ip.IP.Equal(net.ParseIP("10.2.3.67")) {
+		t.Errorf("expected the first address outside the reservation, got %v, %v", ip.IP, err)
+	}
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "requested", "eth0", "container1", &PodRequest{IPs: []net.IP{net.ParseIP("10.2.3.65")}}); err == nil {
+		t.Errorf("reserved address allocated on request to a pod that doesn't match")
+	}
+
+	// Matching pods are given the reservation's addresses until they run out
+	for i, expected := range []string{"10.2.3.65", "10.2.3.66"} {
+		ip, _, _, err := a.Allocate(context.Background(), "foo", fmt.Sprintf("web-%d", i), "eth0", "container1", web)
+		if err != nil || !ip.IP.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s, got %v, %v", expected, ip.IP, err)
+		}
+	}
+
+	_, _, _, err = a.Allocate(context.Background(), "foo", "web-2", "eth0", "container1", web)
+	if exhausted, ok := err.(*PoolExhaustedError); !ok || exhausted.Reservation != "web" {
+		t.Errorf("expected the reservation to be exhausted, got %v", err)
+	}
+
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "web-3", "eth0", "container1", &PodRequest{IPs: []net.IP{net.ParseIP("10.2.3.68")}, Labels: web.Labels}); err == nil {
+		t.Errorf("address outside the reservation allocated on request to a matching pod")
+	}
+
+	// A reservation made before the pod matched is moved into the reservation's addresses
+	client.Pool.Spec.SelectorReservations[0].Addresses = append(client.Pool.Spec.SelectorReservations[0].Addresses, "10.2.3.68")
+	client.Pool.Reserve("foo", "moved", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.69")})
+	ip, _, _, err = a.Allocate(context.Background(), "foo", "moved", "eth0", "container1", web)
+	if err != nil || !ip.IP.Equal(net.ParseIP("10.2.3.68")) {
+		t.Errorf("expected the reservation's remaining address, got %v, %v", ip.IP, err)
+	}
+}
+
+func TestK8SAllocateReclaimsDeadPods(t *testing.T) {
+	newClient := func() *FakePodKubernetesClient {
+		pool := v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/29"),
+				NetmaskBits:        27,
+				AllocationStrategy: v1alpha1.AllocationStrategyLowestFree,
+				StaticReservations: v1alpha1.NewIPReservationMap(),
+			},
+		}
+		// .65 is held statically by a pod that's gone, and .66 dynamically by a running pod
+		pool.Spec.StaticReservations.Reserve("foo", "static", "", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.65")})
+		pool.Reserve("foo", "running", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.66"), PodUID: "1234"})
+		pool.Reserve("foo", "holder", "eth0", v1alpha1.IPReservation{IP: net.ParseIP("10.2.3.67"), PodUID: "1234"})
+
+		running := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "1234"}}
+		running.Status.Phase = corev1.PodRunning
+		return &FakePodKubernetesClient{
+			FakeKubernetesClient: FakeKubernetesClient{pool},
+			Pods:                 map[string]*corev1.Pod{"foo/running": running},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		holder    *corev1.Pod
+		liveness  LivenessPolicy
+		reclaimed bool
+	}{
+		{"gone", nil, nil, true},
+		{"running", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "1234"}, Status: corev1.PodStatus{Phase: corev1.PodRunning}}, nil, false},
+		{"succeeded", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "1234"}, Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}, nil, true},
+		{"recreated", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "5678"}, Status: corev1.PodStatus{Phase: corev1.PodRunning}}, nil, true},
+		{"succeeded with terminal phases off", &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "1234"}, Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}, LivenessPolicy{PodUIDRule{}}, false},
+	}
+
+	for _, test := range tests {
+		client := newClient()
+		if test.holder != nil {
+			client.Pods["foo/holder"] = test.holder
+		}
+		a := &KubernetesAllocator{Client: client, Liveness: test.liveness}
+
+		ip, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		expected := net.ParseIP("10.2.3.68")
+		if test.reclaimed {
+			expected = net.ParseIP("10.2.3.67")
+			if client.Pool.GetReservation("foo", "holder", "eth0") != nil {
+				t.Errorf("%s: reclaimed address still reserved by the dead pod", test.name)
+			}
+		}
+		if !ip.IP.Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", test.name, expected, ip.IP)
+		}
+	}
+}
+
+// countingKubernetesClient returns a running pod for every name, counting the lookups of each
+type countingKubernetesClient struct {
+	FakeKubernetesClient
+	lookups map[string]int
+}
+
+func (c *countingKubernetesClient) GetPod(namespace, podName string) (*corev1.Pod, error) {
+	c.lookups[namespace+"/"+podName]++
+	return c.FakeKubernetesClient.GetPod(namespace, podName)
+}
+
+func TestK8SAllocateChecksHoldersOnce(t *testing.T) {
+	newClient := func() *countingKubernetesClient {
+		// Every host address in the range is held by a running pod
+		pool := v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/29"),
+				NetmaskBits:        29,
+				AllocationStrategy: v1alpha1.AllocationStrategyRandom,
+			},
+		}
+		for i := 1; i <= 6; i++ {
+			pool.Reserve("foo", fmt.Sprintf("pod-%d", i), "eth0", v1alpha1.IPReservation{IP: net.IPv4(10, 2, 3, byte(64+i))})
+		}
+		return &countingKubernetesClient{FakeKubernetesClient: FakeKubernetesClient{pool}, lookups: make(map[string]int)}
+	}
+
+	client := newClient()
+	a := &KubernetesAllocator{Client: client}
+	if _, _, _, err := a.Allocate(context.Background(), "foo", "bar", "eth0", "container1", nil); err == nil {
+		t.Errorf("expected the pool to be exhausted")
+	} else if _, ok := err.(*PoolExhaustedError); !ok {
+		t.Errorf("expected a PoolExhaustedError, got %v", err)
+	}
+	if len(client.lookups) != 6 {
+		t.Errorf("expected every holder to be looked up, got %v", client.lookups)
+	}
+	for pod, lookups := range client.lookups {
+		if lookups != 1 {
+			t.Errorf("%s looked up %d times, expected once", pod, lookups)
+		}
+	}
+
+	// Holders aren't looked up once the retry deadline has passed
+	client = newClient()
+	a = &KubernetesAllocator{Client: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := a.Allocate(ctx, "foo", "bar", "eth0", "container1", nil); err != ErrRetryTimeout {
+		t.Errorf("expected ErrRetryTimeout, got %v", err)
+	}
+	if len(client.lookups) != 0 {
+		t.Errorf("expected no holders to be looked up, got %v", client.lookups)
+	}
+}
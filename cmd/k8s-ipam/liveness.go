@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// LivenessConfig is the liveness section of the ipam config, choosing the rules used to decide whether the pod
+// holding an address is dead.  Durations are in the format accepted by time.ParseDuration.
+type LivenessConfig struct {
+	// TerminalPhases treats pods that have Succeeded or Failed as dead, it's on unless set to false
+	TerminalPhases *bool `json:"terminalPhases,omitempty"`
+	// MatchUID treats a pod whose UID differs from the one recorded in the reservation as dead, it's on unless set to
+	// false
+	MatchUID *bool `json:"matchUID,omitempty"`
+	// NodeLostTimeout treats pods on a node that's been deleted for longer than this as dead.  Deleted nodes are
+	// ignored if it's unset.
+	NodeLostTimeout string `json:"nodeLostTimeout,omitempty"`
+	// NodeNotReadyTimeout treats pods on a node that's been not ready for longer than this as dead.  A node that's
+	// only cut off from the api server may still be running its pods, so node readiness is ignored if it's unset.
+	NodeNotReadyTimeout string `json:"nodeNotReadyTimeout,omitempty"`
+}
+
+// LivenessRule decides whether a pod holding a reservation should be treated as dead
+type LivenessRule interface {
+	// Dead returns why pod, which holds reservation, should be treated as dead, or an empty string if it shouldn't
+	Dead(pod *corev1.Pod, reservation v1alpha1.IPReservation) (reason string, err error)
+}
+
+// LivenessPolicy is the set of rules deciding whether the pod holding an address is dead, so the address can be
+// reclaimed.  A pod that no longer exists is always dead.
+type LivenessPolicy []LivenessRule
+
+// DefaultLivenessPolicy returns the policy used when the ipam config doesn't specify one
+func DefaultLivenessPolicy() LivenessPolicy {
+	return LivenessPolicy{TerminalPhaseRule{}, PodUIDRule{}}
+}
+
+// Policy returns the liveness policy described by the config, using defaults for anything left unset.  nodes looks up
+// the nodes pods are on for the node lost rule.
+func (c *LivenessConfig) Policy(nodes NodeRetriever) (LivenessPolicy, error) {
+	if c == nil {
+		return DefaultLivenessPolicy(), nil
+	}
+
+	policy := LivenessPolicy{}
+	if c.TerminalPhases == nil || *c.TerminalPhases {
+		policy = append(policy, TerminalPhaseRule{})
+	}
+	if c.MatchUID == nil || *c.MatchUID {
+		policy = append(policy, PodUIDRule{})
+	}
+
+	if c.NodeLostTimeout != "" {
+		timeout, err := parseLivenessTimeout("nodeLostTimeout", c.NodeLostTimeout)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, &NodeLostRule{Nodes: nodes, Timeout: timeout})
+	}
+	if c.NodeNotReadyTimeout != "" {
+		timeout, err := parseLivenessTimeout("nodeNotReadyTimeout", c.NodeNotReadyTimeout)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, &NodeNotReadyRule{Nodes: nodes, Timeout: timeout})
+	}
+
+	return policy, nil
+}
+
+// parseLivenessTimeout parses the value of the named liveness timeout, which must be positive
+func parseLivenessTimeout(name, value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse liveness %s: %v", name, err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("liveness %s must be positive", name)
+	}
+	return timeout, nil
+}
+
+// Dead returns why pod, which holds reservation, should be treated as dead according to the first rule that applies,
+// or an empty string if it's alive.  A nil pod no longer exists.
+func (p LivenessPolicy) Dead(pod *corev1.Pod, reservation v1alpha1.IPReservation) (string, error) {
+	if pod == nil {
+		return "the pod no longer exists", nil
+	}
+
+	for _, rule := range p {
+		reason, err := rule.Dead(pod, reservation)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+	return "", nil
+}
+
+// TerminalPhaseRule treats pods that have Succeeded or Failed as dead, their containers won't be started again
+type TerminalPhaseRule struct{}
+
+func (TerminalPhaseRule) Dead(pod *corev1.Pod, reservation v1alpha1.IPReservation) (string, error) {
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded, corev1.PodFailed:
+		return fmt.Sprintf("pod %s/%s has %s", pod.Namespace, pod.Name, pod.Status.Phase), nil
+	}
+	return "", nil
+}
+
+// PodUIDRule treats a pod as dead if it isn't the pod the reservation was made for, but one created since with the
+// same name.  Reservations that don't record a UID are never matched against the pod.
+type PodUIDRule struct{}
+
+func (PodUIDRule) Dead(pod *corev1.Pod, reservation v1alpha1.IPReservation) (string, error) {
+	if reservation.PodUID == "" || pod.UID == "" || pod.UID == reservation.PodUID {
+		return "", nil
+	}
+	return fmt.Sprintf("pod %s/%s has UID %s, the reservation was made for %s", pod.Namespace, pod.Name, pod.UID, reservation.PodUID), nil
+}
+
+// NodeLostRule treats pods as dead once the node they're on has been deleted for longer than Timeout
+type NodeLostRule struct {
+	Nodes   NodeRetriever
+	Timeout time.Duration
+	// Now returns the current time, time.Now is used if it's nil
+	Now func() time.Time
+}
+
+func (r *NodeLostRule) Dead(pod *corev1.Pod, reservation v1alpha1.IPReservation) (string, error) {
+	if pod.Spec.NodeName == "" {
+		return "", nil
+	}
+
+	node, err := r.Nodes.GetNode(pod.Spec.NodeName)
+	if err != nil {
+		return "", fmt.Errorf("unable to get node %s: %v", pod.Spec.NodeName, err)
+	}
+	if node != nil {
+		return "", nil
+	}
+
+	since := nodeDeletedSince(pod, reservation)
+	if since.IsZero() || currentTime(r.Now).Sub(since) < r.Timeout {
+		return "", nil
+	}
+	return fmt.Sprintf("node %s of pod %s/%s has been deleted for longer than %v", pod.Spec.NodeName, pod.Namespace, pod.Name, r.Timeout), nil
+}
+
+// NodeNotReadyRule treats pods as dead once the node they're on has been not ready for longer than Timeout
+type NodeNotReadyRule struct {
+	Nodes   NodeRetriever
+	Timeout time.Duration
+	// Now returns the current time, time.Now is used if it's nil
+	Now func() time.Time
+}
+
+func (r *NodeNotReadyRule) Dead(pod *corev1.Pod, reservation v1alpha1.IPReservation) (string, error) {
+	if pod.Spec.NodeName == "" {
+		return "", nil
+	}
+
+	node, err := r.Nodes.GetNode(pod.Spec.NodeName)
+	if err != nil {
+		return "", fmt.Errorf("unable to get node %s: %v", pod.Spec.NodeName, err)
+	}
+	if node == nil {
+		return "", nil
+	}
+
+	// A node that has never reported its condition is still starting
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != corev1.NodeReady || condition.Status == corev1.ConditionTrue || condition.LastTransitionTime.IsZero() {
+			continue
+		}
+		if currentTime(r.Now).Sub(condition.LastTransitionTime.Time) >= r.Timeout {
+			return fmt.Sprintf("node %s of pod %s/%s has been not ready for longer than %v", pod.Spec.NodeName, pod.Namespace, pod.Name, r.Timeout), nil
+		}
+	}
+	return "", nil
+}
+
+// nodeDeletedSince returns when the deleted node pod was on was lost: when pod was deleted, or failing that when the
+// reservation was last seen.  The pod's readiness isn't used, a pod may have stopped being ready long before its node
+// went away.  The returned time is zero if neither is known.
+func nodeDeletedSince(pod *corev1.Pod, reservation v1alpha1.IPReservation) time.Time {
+	if pod.DeletionTimestamp != nil {
+		return pod.DeletionTimestamp.Time
+	}
+	if reservation.LastSeen != nil {
+		return reservation.LastSeen.Time
+	}
+	return time.Time{}
+}
+
+// currentTime returns now(), or time.Now() if now is nil
+func currentTime(now func() time.Time) time.Time {
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type FakeNodeRetriever map[string]*corev1.Node
+
+func (f FakeNodeRetriever) GetNode(name string) (*corev1.Node, error) {
+	return f[name], nil
+}
+
+func TestLivenessConfigPolicy(t *testing.T) {
+	tests := []struct {
+		config string
+		rules  int
+		valid  bool
+	}{
+		{`null`, 2, true},
+		{`{}`, 2, true},
+		{`{"terminalPhases": false}`, 1, true},
+		{`{"terminalPhases": false, "matchUID": false}`, 0, true},
+		{`{"nodeLostTimeout": "5m"}`, 3, true},
+		{`{"nodeLostTimeout": "5 minutes"}`, 0, false},
+		{`{"nodeLostTimeout": "-5m"}`, 0, false},
+		{`{"nodeLostTimeout": "5m", "nodeNotReadyTimeout": "10m"}`, 4, true},
+		{`{"nodeNotReadyTimeout": "0s"}`, 0, false},
+	}
+
+	for _, test := range tests {
+		var config *LivenessConfig
+		if err := json.Unmarshal([]byte(test.config), &config); err != nil {
+			t.Fatalf("%s: unable to parse config: %v", test.config, err)
+		}
+
+		policy, err := config.Policy(FakeNodeRetriever{})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.config, test.valid, err)
+			continue
+		}
+		if test.valid && len(policy) != test.rules {
+			t.Errorf("%s: expected %d rules, got %d", test.config, test.rules, len(policy))
+		}
+	}
+}
+
+func TestLivenessPolicyDead(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	nodeReady := func(status corev1.ConditionStatus, since time.Duration) *corev1.Node {
+		node := &corev1.Node{}
+		node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status, LastTransitionTime: metav1.NewTime(now.Add(-since))}}
+		return node
+	}
+	nodes := FakeNodeRetriever{
+		"ready":        nodeReady(corev1.ConditionTrue, time.Hour),
+		"not-ready":    nodeReady(corev1.ConditionFalse, time.Minute),
+		"long-unready": nodeReady(corev1.ConditionUnknown, time.Hour),
+	}
+	clock := func() time.Time { return now }
+	policy := LivenessPolicy{TerminalPhaseRule{}, PodUIDRule{}, &NodeLostRule{Nodes: nodes, Timeout: 10 * time.Minute, Now: clock}}
+	notReadyPolicy := append(policy, &NodeNotReadyRule{Nodes: nodes, Timeout: 10 * time.Minute, Now: clock})
+
+	newPod := func(phase corev1.PodPhase, uid types.UID, nodeName string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", UID: uid}}
+		pod.Spec.NodeName = nodeName
+		pod.Status.Phase = phase
+		return pod
+	}
+	deletedSince := func(pod *corev1.Pod, since time.Duration) *corev1.Pod {
+		deleted := metav1.NewTime(now.Add(-since))
+		pod.DeletionTimestamp = &deleted
+		return pod
+	}
+	unreadySince := func(pod *corev1.Pod, since time.Duration) *corev1.Pod {
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse, LastTransitionTime: metav1.NewTime(now.Add(-since))}}
+		return pod
+	}
+
+	lastSeen := func(since time.Duration) v1alpha1.IPReservation {
+		seen := metav1.NewTime(now.Add(-since))
+		return v1alpha1.IPReservation{PodUID: "1234", LastSeen: &seen}
+	}
+
+	reservation := v1alpha1.IPReservation{PodUID: "1234"}
+	tests := []struct {
+		name        string
+		policy      LivenessPolicy
+		pod         *corev1.Pod
+		reservation v1alpha1.IPReservation
+		dead        bool
+	}{
+		{"gone", policy, nil, reservation, true},
+		{"running", policy, newPod(corev1.PodRunning, "1234", "ready"), reservation, false},
+		{"pending", policy, newPod(corev1.PodPending, "1234", ""), reservation, false},
+		{"succeeded", policy, newPod(corev1.PodSucceeded, "1234", "ready"), reservation, true},
+		{"failed", policy, newPod(corev1.PodFailed, "1234", "ready"), reservation, true},
+		{"recreated", policy, newPod(corev1.PodRunning, "5678", "ready"), reservation, true},
+		{"node not ready past lost timeout", policy, newPod(corev1.PodRunning, "1234", "long-unready"), reservation, false},
+		{"node briefly not ready", notReadyPolicy, newPod(corev1.PodRunning, "1234", "not-ready"), reservation, false},
+		{"node not ready past timeout", notReadyPolicy, newPod(corev1.PodRunning, "1234", "long-unready"), reservation, true},
+		{"node deleted recently", policy, deletedSince(newPod(corev1.PodRunning, "1234", "deleted"), time.Minute), reservation, false},
+		{"node deleted past timeout", policy, deletedSince(newPod(corev1.PodRunning, "1234", "deleted"), time.Hour), reservation, true},
+		{"node deleted at unknown time", policy, newPod(corev1.PodRunning, "1234", "deleted"), reservation, false},
+		{"node deleted recently, pod long not ready", policy, unreadySince(deletedSince(newPod(corev1.PodRunning, "1234", "deleted"), time.Minute), time.Hour), reservation, false},
+		{"node deleted at unknown time, pod long not ready", policy, unreadySince(newPod(corev1.PodRunning, "1234", "deleted"), time.Hour), reservation, false},
+		{"node deleted, reservation seen recently", policy, newPod(corev1.PodRunning, "1234", "deleted"), lastSeen(time.Minute), false},
+		{"node deleted, reservation seen past timeout", policy, newPod(corev1.PodRunning, "1234", "deleted"), lastSeen(time.Hour), true},
+	}
+
+	for _, test := range tests {
+		reason, err := test.policy.Dead(test.pod, test.reservation)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if dead := reason != ""; dead != test.dead {
+			t.Errorf("%s: expected dead to be %t, got %t (%s)", test.name, test.dead, dead, reason)
+		}
+	}
+
+	// Reservations that don't record a UID aren't matched against the pod
+	if reason, _ := policy.Dead(newPod(corev1.PodRunning, "5678", "ready"), v1alpha1.IPReservation{}); reason != "" {
+		t.Errorf("pod treated as dead for a reservation without a UID: %s", reason)
+	}
+
+	// The default policy leaves node state alone
+	if reason, _ := DefaultLivenessPolicy().Dead(newPod(corev1.PodRunning, "1234", "long-unready"), reservation); reason != "" {
+		t.Errorf("default policy treated a pod on an unready node as dead: %s", reason)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"sort"
 	"strings"
 
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -20,14 +25,43 @@ func parseConfig(stdin []byte) (*CniConf, error) {
 		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
 	}
 
-	if conf.IPAM.GetKubeConfig() == "" {
-		return nil, fmt.Errorf("a kubeconfig is required for this ip allocator.")
+	if conf.IPAM == nil {
+		return nil, fmt.Errorf("an ipam configuration is required for this ip allocator.")
 	}
 
-	if conf.IPAM.GetIPPoolName() == "" {
+	if selector := conf.IPAM.GetIPPoolSelector(); selector != "" {
+		if _, err := labels.Parse(selector); err != nil {
+			return nil, fmt.Errorf("invalid ip pool selector: %v", err)
+		}
+	} else if len(conf.IPAM.GetIPPoolNames()) == 0 {
 		return nil, fmt.Errorf("an ip pool name is required for this ip allocator.")
 	}
 
+	if _, err := conf.IPAM.GetRetryPolicy(); err != nil {
+		return nil, fmt.Errorf("invalid retry configuration: %v", err)
+	}
+
+	if _, err := conf.IPAM.GetLivenessPolicy(nil); err != nil {
+		return nil, fmt.Errorf("invalid liveness configuration: %v", err)
+	}
+
+	if conf.RawPrevResult != nil {
+		resultBytes, err := json.Marshal(conf.RawPrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+		}
+
+		res, err := version.NewResult(conf.CNIVersion, resultBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		}
+
+		conf.PrevResult, err = types100.NewResultFromResult(res)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert prevResult to current version: %v", err)
+		}
+	}
+
 	return conf, nil
 }
 
@@ -54,72 +88,439 @@ func getPodFromArgs(args string) (namespace, podName string, err error) {
 	return namespace, podName, nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+type PodRequestRetriever interface {
+	PodRetriever
+	NamespaceRetriever
+	NodeRetriever
+}
+
+// getPodRequest retrieves the pod and parses the addresses and pools requested in its annotations.  If the pod
+// doesn't name any pools, the defaults from its namespace's annotations are used.
+func getPodRequest(client PodRequestRetriever, namespace, podName string) (*PodRequest, error) {
+	pod, err := client.GetPod(namespace, podName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pod %s/%s: %v", namespace, podName, err)
+	}
+
+	request, err := NewPodRequest(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(request.IPPoolNames) > 0 {
+		return request, nil
+	}
+
+	ns, err := client.GetNamespace(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get namespace %s: %v", namespace, err)
+	}
+	request.IPPoolNames = NamespaceIPPoolNames(ns)
+
+	return request, nil
+}
+
+// selectPoolNames returns the pools requested by the pod or its namespace, falling back to those named in the CNI
+// config in req, or if the config has an ip pool selector, the pool chosen for the pod's node
+func selectPoolNames(nodes NodeRetriever, pools IPPoolListRetriever, req IPAMRequest, request *PodRequest) ([]string, error) {
+	if len(request.IPPoolNames) > 0 {
+		return request.IPPoolNames, nil
+	}
+
+	if req.IPPoolSelector == "" {
+		return req.IPPoolNames, nil
+	}
+
+	poolName, err := selectTopologyPool(nodes, pools, req.IPPoolSelector, request.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	return []string{poolName}, nil
+}
+
+// selectTopologyPool returns the name of the one pool matching selector whose node selector matches the labels on
+// the node nodeName.  It fails if no pool or more than one pool matches.
+func selectTopologyPool(nodes NodeRetriever, pools IPPoolListRetriever, selector, nodeName string) (string, error) {
+	if nodeName == "" {
+		return "", fmt.Errorf("%v: the pod hasn't been scheduled to a node", ErrNoTopologyPool)
+	}
+
+	node, err := nodes.GetNode(nodeName)
+	if err != nil {
+		return "", fmt.Errorf("unable to get node %s: %v", nodeName, err)
+	}
+	if node == nil {
+		return "", fmt.Errorf("%v: node %s not found", ErrNoTopologyPool, nodeName)
+	}
+
+	candidates, err := listIPPools(pools, selector)
+	if err != nil {
+		return "", err
+	}
+
+	matches := make([]string, 0, 1)
+	for _, pool := range candidates {
+		if pool.Spec.MatchesNodeLabels(node.Labels) {
+			matches = append(matches, pool.Name)
+		}
+	}
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%v: none of the pools matching %q select node %s", ErrNoTopologyPool, selector, nodeName)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%v: pools %s all select node %s", ErrAmbiguousTopologyPool, strings.Join(matches, ", "), nodeName)
+	}
+}
+
+// listIPPools returns the pools matching the label selector
+func listIPPools(pools IPPoolListRetriever, selector string) ([]*v1alpha1.IPPool, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip pool selector: %v", err)
+	}
+
+	candidates, err := pools.ListIPPools(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ip pools matching %q: %v", selector, err)
+	}
+	return candidates, nil
+}
+
+// Allocator reserves and frees addresses in a single ip pool.  Allocate reports whether it created the reservation,
+// rather than reusing one the pod already held, and gives up once ctx is done.
+type Allocator interface {
+	Allocate(ctx context.Context, namespace, podName, ifName, containerID string, request *PodRequest) (ip net.IPNet, pool *v1alpha1.IPPool, created bool, err error)
+	Free(namespace, podName, ifName, containerID string) error
+}
+
+// newAllocators returns an allocator for each of the named ip pools, reclaiming addresses according to liveness
+func newAllocators(auth KubeAuth, liveness LivenessPolicy, poolNames []string) []Allocator {
+	allocators := make([]Allocator, 0, len(poolNames))
+	for _, poolName := range poolNames {
+		allocator := &KubernetesAllocator{Liveness: liveness}
+		allocator.Client = &KubeClient{
+			Auth:       auth,
+			IPPoolName: poolName,
+		}
+		allocators = append(allocators, allocator)
+	}
+	return allocators
+}
+
+// retryError returns a CNI error asking the runtime to try again later if err is ErrRetryTimeout, one with
+// ErrCodePoolExhausted for a PoolExhaustedError, or one with ErrCodeNamespaceNotAllowed for a
+// NamespaceNotAllowedError.  Otherwise err is returned with msg prepended.
+func retryError(msg string, err error) error {
+	if err == ErrRetryTimeout {
+		return types.NewError(types.ErrTryAgainLater, msg, err.Error())
+	}
+	switch err.(type) {
+	case *PoolExhaustedError:
+		return types.NewError(ErrCodePoolExhausted, ErrPoolExhausted.Error(), err.Error())
+	case *NamespaceNotAllowedError:
+		return types.NewError(ErrCodeNamespaceNotAllowed, ErrNamespaceNotAllowed.Error(), err.Error())
+	}
+	return fmt.Errorf("%s: %v", msg, err)
+}
+
+// allocate reserves an address for the pod from each allocator in turn, honoring any addresses in request, which may
+// be nil.  Conflicting updates are retried according to retry until ctx is done.  If any allocation fails, the
+// reservations this call created are freed, those the pod already held are kept.
+func allocate(ctx context.Context, retry RetryPolicy, allocators []Allocator, namespace, podName, ifName, containerID string, request *PodRequest) (*IPAMResult, error) {
+	if request == nil {
+		request = &PodRequest{}
+	}
+
+	result := &IPAMResult{}
+	result.CniVersion = types100.ImplementedSpecVersion
+
+	created := make([]Allocator, 0, len(allocators))
+	for _, allocator := range allocators {
+		var ip net.IPNet
+		var pool *v1alpha1.IPPool
+		var isNew bool
+		allocateErr := retry.Do(ctx, func() error {
+			var err error
+			ip, pool, isNew, err = allocator.Allocate(ctx, namespace, podName, ifName, containerID, request)
+			return err
+		})
+		if allocateErr != nil {
+			if freeErr := rollback(retry, created, namespace, podName, ifName, containerID); freeErr != nil {
+				return nil, fmt.Errorf("unable to get allocation for pod: %v, rollback of previous allocations failed: %v", allocateErr, freeErr)
+			}
+			return nil, retryError("unable to get allocation for pod", allocateErr)
+		}
+
+		if isNew {
+			created = append(created, allocator)
+		}
+		result.AddPool(ip, pool)
+	}
+
+	for _, requestedIP := range request.IPs {
+		if !result.Contains(requestedIP) {
+			if freeErr := rollback(retry, created, namespace, podName, ifName, containerID); freeErr != nil {
+				return nil, fmt.Errorf("requested ip %s is not within any ip pool, rollback of allocations failed: %v", requestedIP, freeErr)
+			}
+			return nil, fmt.Errorf("requested ip %s is not within any ip pool", requestedIP)
+		}
+	}
+
+	return result, nil
+}
+
+// rollback frees reservations made by a failed allocation.  It gets a deadline of its own, as the allocation's may
+// already have passed.
+func rollback(retry RetryPolicy, allocators []Allocator, namespace, podName, ifName, containerID string) error {
+	ctx, cancel := retry.Context(context.Background())
+	defer cancel()
+	return free(ctx, retry, allocators, namespace, podName, ifName, containerID)
+}
+
+// free releases the reservation for the pod's interface in sandbox containerID from every allocator, returning the
+// last error encountered.  Conflicting updates are retried according to retry until ctx is done.
+func free(ctx context.Context, retry RetryPolicy, allocators []Allocator, namespace, podName, ifName, containerID string) error {
+	var err error
+	for _, allocator := range allocators {
+		freeErr := retry.Do(ctx, func() error {
+			return allocator.Free(namespace, podName, ifName, containerID)
+		})
+		if freeErr != nil {
+			err = freeErr
+		}
+	}
+	return err
+}
+
+// IPAMRequest identifies the pod interface an ADD or DEL is for.  IPPoolNames are the pools named in the CNI config,
+// IPPoolSelector its selector for pools chosen by node, Liveness its liveness rules and Retry its retry settings.
+type IPAMRequest struct {
+	Namespace      string          `json:"namespace"`
+	PodName        string          `json:"podName"`
+	IfName         string          `json:"ifName"`
+	ContainerID    string          `json:"containerID"`
+	IPPoolNames    []string        `json:"ipPoolNames"`
+	IPPoolSelector string          `json:"ipPoolSelector,omitempty"`
+	Liveness       *LivenessConfig `json:"liveness,omitempty"`
+	Retry          *RetryConfig    `json:"retry,omitempty"`
+}
+
+// AllocatorFactory returns an allocator for each of the named pools, reclaiming addresses according to liveness
+type AllocatorFactory func(poolNames []string, liveness LivenessPolicy) []Allocator
+
+// addPod allocates addresses for the pod interface in req from the pools requested by the pod or its namespace,
+// falling back to those in the CNI config.  newAllocators returns the allocators for the chosen pools.
+func addPod(ctx context.Context, retry RetryPolicy, client PodRequestRetriever, pools IPPoolListRetriever, newAllocators AllocatorFactory, req IPAMRequest) (*IPAMResult, error) {
+	liveness, err := req.Liveness.Policy(client)
+	if err != nil {
+		return nil, fmt.Errorf("invalid liveness configuration: %v", err)
+	}
+
+	request, err := getPodRequest(client, req.Namespace, req.PodName)
+	if err != nil {
+		return nil, err
+	}
+
+	poolNames, err := selectPoolNames(client, pools, req, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return allocate(ctx, retry, newAllocators(poolNames, liveness), req.Namespace, req.PodName, req.IfName, req.ContainerID, request)
+}
+
+// delPod frees the reservations for the pod interface in req
+func delPod(ctx context.Context, retry RetryPolicy, client PodRequestRetriever, pools IPPoolListRetriever, newAllocators AllocatorFactory, req IPAMRequest) error {
+	// The pod may already be gone, so free from the configured pools, every pool the config's selector matches, and
+	// any the pod asked for
+	poolNames := req.IPPoolNames
+	if req.IPPoolSelector != "" {
+		candidates, err := listIPPools(pools, req.IPPoolSelector)
+		if err != nil {
+			return err
+		}
+		for _, pool := range candidates {
+			poolNames = mergePoolNames(poolNames, []string{pool.Name})
+		}
+	}
+	if request, err := getPodRequest(client, req.Namespace, req.PodName); err == nil {
+		poolNames = mergePoolNames(poolNames, request.IPPoolNames)
+	}
+
+	if err := free(ctx, retry, newAllocators(poolNames, nil), req.Namespace, req.PodName, req.IfName, req.ContainerID); err != nil {
+		return retryError("unable to free allocation for pod", err)
+	}
+	return nil
+}
+
+// newRequest parses the CNI config and args for an ADD or DEL
+func newRequest(args *skel.CmdArgs) (*CniConf, IPAMRequest, RetryPolicy, error) {
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
-		return err
+		return nil, IPAMRequest{}, RetryPolicy{}, err
 	}
 
-	// if we have kubeconfig, create client and check for annotation on pod
 	namespace, podName, err := getPodFromArgs(args.Args)
 	if err != nil {
-		return err
+		return nil, IPAMRequest{}, RetryPolicy{}, err
 	}
 
-	allocator := &KubernetesAllocator{}
-	allocator.Client = &KubeClient{
-		KubeConfig: conf.IPAM.GetKubeConfig(),
-		IPPoolName: conf.IPAM.GetIPPoolName(),
+	retry, err := conf.IPAM.GetRetryPolicy()
+	if err != nil {
+		return nil, IPAMRequest{}, RetryPolicy{}, err
 	}
 
-	var ip net.IPNet
-	var gw net.IP
-	var allocateErr error
-	for allocateErr = ErrUpdateConflict; allocateErr == ErrUpdateConflict; {
-		ip, gw, allocateErr = allocator.Allocate(namespace, podName)
+	req := IPAMRequest{
+		Namespace:      namespace,
+		PodName:        podName,
+		IfName:         args.IfName,
+		ContainerID:    args.ContainerID,
+		IPPoolNames:    conf.IPAM.GetIPPoolNames(),
+		IPPoolSelector: conf.IPAM.GetIPPoolSelector(),
+		Liveness:       conf.IPAM.Liveness,
+		Retry:          conf.IPAM.Retry,
 	}
-	if allocateErr != nil {
-		return fmt.Errorf("unable to get allocation for pod: %v", allocateErr)
+	return conf, req, retry, nil
+}
+
+// directAllocators returns a function creating allocators that talk to the kubernetes api directly
+func directAllocators(auth KubeAuth) AllocatorFactory {
+	return func(poolNames []string, liveness LivenessPolicy) []Allocator {
+		return newAllocators(auth, liveness, poolNames)
 	}
+}
 
-	result := &IPAMResult{}
-	result.CniVersion = current.ImplementedSpecVersion
-	result.AddIP(ip, gw)
-	return types.PrintResult(result, current.ImplementedSpecVersion)
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, req, retry, err := newRequest(args)
+	if err != nil {
+		return err
+	}
+
+	// Hand the request to the node's allocation daemon if it's running, otherwise allocate directly
+	daemon := &DaemonClient{Socket: conf.IPAM.GetDaemonSocket(), Timeout: retry.Timeout + DaemonTimeoutMargin}
+	result, err := daemon.Add(req)
+	if err == ErrDaemonUnavailable {
+		ctx, cancel := retry.Context(context.Background())
+		defer cancel()
+
+		// A hung api call mustn't outlast the retry deadline
+		auth := conf.IPAM.GetKubeAuth()
+		auth.Timeout = retry.Timeout
+		client := &KubeClient{Auth: auth}
+		result, err = addPod(ctx, retry, client, client, directAllocators(auth), req)
+	}
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+// mergePoolNames returns the pool names in a followed by any from b that aren't already present
+func mergePoolNames(a, b []string) []string {
+	return appendUnique(append([]string{}, a...), b...)
 }
 
 // cmdDel is called for DELETE requests
 func cmdDel(args *skel.CmdArgs) error {
+	conf, req, retry, err := newRequest(args)
+	if err != nil {
+		return err
+	}
+
+	daemon := &DaemonClient{Socket: conf.IPAM.GetDaemonSocket(), Timeout: retry.Timeout + DaemonTimeoutMargin}
+	err = daemon.Del(req)
+	if err == ErrDaemonUnavailable {
+		ctx, cancel := retry.Context(context.Background())
+		defer cancel()
+
+		auth := conf.IPAM.GetKubeAuth()
+		auth.Timeout = retry.Timeout
+		client := &KubeClient{Auth: auth}
+		err = delPod(ctx, retry, client, client, directAllocators(auth), req)
+	}
+
+	// DEL doesn't return a result in any version of the spec
+	return err
+}
+
+// Error codes from the plugin-specific range defined by the CNI spec.  The ErrCodeReservation* codes are returned by
+// cmdCheck, ErrCodePoolExhausted and ErrCodeNamespaceNotAllowed by cmdAdd.
+const (
+	ErrCodeReservationNotFound uint = 100 + iota
+	ErrCodeReservationMoved
+	ErrCodeReservationMismatch
+	ErrCodePoolExhausted
+	ErrCodeNamespaceNotAllowed
+)
+
+// checkError converts errors returned by KubernetesAllocator.Check into CNI errors
+func checkError(err error) error {
+	checkErr, ok := err.(*ReservationCheckError)
+	if !ok {
+		return types.NewError(types.ErrInternal, "unable to check reservation for pod", err.Error())
+	}
+
+	code := ErrCodeReservationMismatch
+	switch checkErr.Err {
+	case ErrReservationNotFound:
+		code = ErrCodeReservationNotFound
+	case ErrReservationMoved:
+		code = ErrCodeReservationMoved
+	}
+	return types.NewError(code, checkErr.Err.Error(), checkErr.Details)
+}
+
+// cmdCheck is called for CHECK requests
+func cmdCheck(args *skel.CmdArgs) error {
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	// if we have kubeconfig, create client and check for annotation on pod
+	if conf.PrevResult == nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "prevResult is required for CHECK", "")
+	}
+
 	namespace, podName, err := getPodFromArgs(args.Args)
 	if err != nil {
 		return err
 	}
 
-	allocator := &KubernetesAllocator{}
-	allocator.Client = &KubeClient{
-		KubeConfig: conf.IPAM.GetKubeConfig(),
-		IPPoolName: conf.IPAM.GetIPPoolName(),
+	client := &KubeClient{Auth: conf.IPAM.GetKubeAuth()}
+	request, err := getPodRequest(client, namespace, podName)
+	if err != nil {
+		return err
 	}
 
-	for freeErr := ErrUpdateConflict; freeErr == ErrUpdateConflict; {
-		freeErr = allocator.Free(namespace, podName)
-	}
+	req := IPAMRequest{IPPoolNames: conf.IPAM.GetIPPoolNames(), IPPoolSelector: conf.IPAM.GetIPPoolSelector()}
+	poolNames, err := selectPoolNames(client, client, req, request)
 	if err != nil {
-		return fmt.Errorf("unable to get allocation for pod: %v", err)
+		return err
 	}
 
-	result := &IPAMResult{}
-	result.CniVersion = current.ImplementedSpecVersion
-	return types.PrintResult(result, current.ImplementedSpecVersion)
+	for _, poolName := range poolNames {
+		allocator := &KubernetesAllocator{Client: &KubeClient{Auth: conf.IPAM.GetKubeAuth(), IPPoolName: poolName}}
+		if err := allocator.Check(namespace, podName, args.IfName, args.ContainerID, Addresses(conf.PrevResult)); err != nil {
+			return checkError(err)
+		}
+	}
 
+	return nil
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.PluginSupports("", "0.1.0", "0.2.0", version.Current()))
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		if err := runDaemon(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "k8s-ipam daemon: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "Kubernetes IPPool IPAM plugin")
 }
@@ -1,7 +1,21 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	"github.com/containernetworking/cni/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	kubeerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 func TestUnwrapConfig(t *testing.T) {
@@ -46,3 +60,493 @@ func TestParseArgs(t *testing.T) {
 	}
 
 }
+
+func TestParseConfigPrevResult(t *testing.T) {
+	mainConfig := `{
+      "cniVersion": "0.4.0",
+      "name": "testConf",
+      "type": "macvlan",
+      "ipam": {
+        "type": "ipam-wrapper",
+        "kubeConfig": "/path/to/kubeconfig.yml",
+        "ipPoolName": "sample-ippool"
+      },
+      "prevResult": {
+        "cniVersion": "0.4.0",
+        "ips": [
+          {
+            "version": "6",
+            "address": "2001:db8::10/64",
+            "gateway": "2001:db8::1"
+          }
+        ]
+      }
+    }`
+
+	m, err := parseConfig([]byte(mainConfig))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+
+	if m.PrevResult == nil || len(m.PrevResult.IPs) != 1 {
+		t.Fatalf("prevResult not parsed: %v", m.PrevResult)
+	}
+
+	addrs := Addresses(m.PrevResult)
+	if !addrs[0].Address.IP.Equal(net.ParseIP("2001:db8::10")) || !addrs[0].Gateway.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Wrong address parsed from prevResult: %v", addrs[0])
+	}
+}
+
+func TestParseConfigIPPoolNames(t *testing.T) {
+	mainConfig := `{
+      "cniVersion": "1.0.0",
+      "name": "testConf",
+      "type": "macvlan",
+      "ipam": {
+        "type": "ipam-wrapper",
+        "kubeConfig": "/path/to/kubeconfig.yml",
+        "ipPoolNames": ["sample-ippool-v4", "sample-ippool-v6"]
+      }
+    }`
+
+	m, err := parseConfig([]byte(mainConfig))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+
+	if pools := m.IPAM.GetIPPoolNames(); len(pools) != 2 || pools[0] != "sample-ippool-v4" || pools[1] != "sample-ippool-v6" {
+		t.Errorf("Wrong ip pools: %v", pools)
+	}
+}
+
+func TestParseConfigIPPoolSelector(t *testing.T) {
+	config := func(selector string) []byte {
+		return []byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "testConf", "type": "macvlan", "ipam": {"type": "k8s-ipam", "ipPoolSelector": %q}}`, selector))
+	}
+
+	m, err := parseConfig(config("network=storage"))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	if selector := m.IPAM.GetIPPoolSelector(); selector != "network=storage" {
+		t.Errorf("Wrong ip pool selector: %s", selector)
+	}
+
+	if _, err := parseConfig(config("network in (")); err == nil {
+		t.Errorf("expected an invalid selector to be rejected")
+	}
+}
+
+func TestParseConfigLiveness(t *testing.T) {
+	config := func(liveness string) []byte {
+		return []byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "testConf", "type": "macvlan", "ipam": {"type": "k8s-ipam", "ipPoolName": "pool", "liveness": %s}}`, liveness))
+	}
+
+	m, err := parseConfig(config(`{"matchUID": false, "nodeLostTimeout": "10m"}`))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	if policy, err := m.IPAM.GetLivenessPolicy(nil); err != nil || len(policy) != 2 {
+		t.Errorf("expected terminal phase and node lost rules, got %v, %v", policy, err)
+	}
+
+	if _, err := parseConfig(config(`{"nodeLostTimeout": "ten minutes"}`)); err == nil {
+		t.Errorf("expected an invalid node lost timeout to be rejected")
+	}
+}
+
+func TestCheckError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code uint
+	}{
+		{"not found", &ReservationCheckError{Err: ErrReservationNotFound, Details: "foo/bar has no reservation"}, ErrCodeReservationNotFound},
+		{"moved", &ReservationCheckError{Err: ErrReservationMoved, Details: "10.2.3.70 is reserved by foo/baz"}, ErrCodeReservationMoved},
+		{"mismatch", &ReservationCheckError{Err: ErrReservationMismatch, Details: "attachment has netmask /24, pool has /27"}, ErrCodeReservationMismatch},
+		{"other", fmt.Errorf("pool unavailable"), types.ErrInternal},
+	}
+
+	for _, test := range tests {
+		cniErr, ok := checkError(test.err).(*types.Error)
+		if !ok {
+			t.Errorf("%s: expected a CNI error, got %v", test.name, checkError(test.err))
+			continue
+		}
+		if cniErr.Code != test.code {
+			t.Errorf("%s: expected code %d, got %d", test.name, test.code, cniErr.Code)
+		}
+		if checkErr, ok := test.err.(*ReservationCheckError); ok && (cniErr.Msg != checkErr.Err.Error() || cniErr.Details != checkErr.Details) {
+			t.Errorf("%s: wrong message or details: %v", test.name, cniErr)
+		}
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code uint
+	}{
+		{"retry timeout", ErrRetryTimeout, types.ErrTryAgainLater},
+		{"pool exhausted", &PoolExhaustedError{Pool: "samplePool", Capacity: big.NewInt(14)}, ErrCodePoolExhausted},
+		{"namespace not allowed", &NamespaceNotAllowedError{Pool: "samplePool", Namespace: "team-c"}, ErrCodeNamespaceNotAllowed},
+	}
+
+	for _, test := range tests {
+		cniErr, ok := retryError("unable to get allocation for pod", test.err).(*types.Error)
+		if !ok {
+			t.Errorf("%s: expected a CNI error, got %v", test.name, retryError("unable to get allocation for pod", test.err))
+			continue
+		}
+		if cniErr.Code != test.code {
+			t.Errorf("%s: expected code %d, got %d", test.name, test.code, cniErr.Code)
+		}
+	}
+
+	// Other errors are returned with the message prepended
+	err := retryError("unable to get allocation for pod", fmt.Errorf("pool unavailable"))
+	if _, ok := err.(*types.Error); ok || err.Error() != "unable to get allocation for pod: pool unavailable" {
+		t.Errorf("expected the error with the message prepended, got %v", err)
+	}
+}
+
+type FailingKubernetesClient struct {
+	FakeKubernetesClient
+}
+
+func (c *FailingKubernetesClient) GetIPPool() (*v1alpha1.IPPool, error) {
+	return nil, fmt.Errorf("pool unavailable")
+}
+
+func TestAllocateDualStack(t *testing.T) {
+	v4Client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("10.2.3.64/28"),
+			NetmaskBits: 27,
+			Gateway:     net.ParseIP("10.2.3.65"),
+		},
+	}}
+	v6Client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("2001:db8::/65"),
+			NetmaskBits: 64,
+			Gateway:     net.ParseIP("2001:db8::1"),
+		},
+	}}
+
+	allocators := []Allocator{&KubernetesAllocator{Client: v4Client}, &KubernetesAllocator{Client: v6Client}}
+	result, err := allocate(context.Background(), DefaultRetryPolicy(), allocators, "foo", "bar", "eth0", "container1", nil)
+	if err != nil {
+		t.Fatalf("unable to allocate: %v", err)
+	}
+
+	if len(result.IPs) != 2 || result.IPs[0].Version != "4" || result.IPs[1].Version != "6" {
+		t.Errorf("expected one IPv4 and one IPv6 address, got %v", result.IPs)
+	}
+
+	if len(result.Routes) != 2 {
+		t.Errorf("expected a default route for each address family, got %v", result.Routes)
+	}
+
+	if err := free(context.Background(), DefaultRetryPolicy(), allocators, "foo", "bar", "eth0", "container1"); err != nil {
+		t.Errorf("unable to free: %v", err)
+	}
+
+	if v4Client.Pool.GetExistingReservation("foo", "bar", "eth0") != nil || v6Client.Pool.GetExistingReservation("foo", "bar", "eth0") != nil {
+		t.Errorf("reservation not freed from every pool")
+	}
+}
+
+func TestAllocateRollback(t *testing.T) {
+	v4Client := &FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("10.2.3.64/28"),
+			NetmaskBits: 27,
+		},
+	}}
+
+	allocators := []Allocator{&KubernetesAllocator{Client: v4Client}, &KubernetesAllocator{Client: &FailingKubernetesClient{}}}
+	if _, err := allocate(context.Background(), DefaultRetryPolicy(), allocators, "foo", "bar", "eth0", "container1", nil); err == nil {
+		t.Fatalf("expected allocation to fail")
+	}
+
+	if existingIP := v4Client.Pool.GetExistingReservation("foo", "bar", "eth0"); existingIP != nil {
+		t.Errorf("reservation %v not rolled back after failed allocation", existingIP)
+	}
+
+	// A reservation the pod already held isn't lost when a later pool fails
+	sticky := net.ParseIP("10.2.3.70")
+	v4Client.Pool.Reserve("foo", "sticky", "eth0", v1alpha1.IPReservation{IP: sticky, ContainerID: "container0"})
+	if _, err := allocate(context.Background(), DefaultRetryPolicy(), allocators, "foo", "sticky", "eth0", "container1", nil); err == nil {
+		t.Fatalf("expected allocation to fail")
+	}
+
+	if existingIP := v4Client.Pool.GetExistingReservation("foo", "sticky", "eth0"); existingIP == nil || !existingIP.Equal(sticky) {
+		t.Errorf("existing reservation for %s was rolled back, got %v", sticky, existingIP)
+	}
+}
+
+type ConflictingKubernetesClient struct {
+	FakeKubernetesClient
+}
+
+// GetIPPool returns a copy, so rejected updates don't leak into the next attempt
+func (c *ConflictingKubernetesClient) GetIPPool() (*v1alpha1.IPPool, error) {
+	return c.Pool.DeepCopy(), nil
+}
+
+func (c *ConflictingKubernetesClient) UpdateIPPool(*v1alpha1.IPPool) error {
+	return kubeerrors.NewConflict(schema.GroupResource{Group: "k8s.pgc.umn.edu", Resource: "ippools"}, "pool", fmt.Errorf("stale resource version"))
+}
+
+func TestAllocateRetryTimeout(t *testing.T) {
+	client := &ConflictingKubernetesClient{FakeKubernetesClient{v1alpha1.IPPool{
+		Spec: v1alpha1.IPPoolSpec{
+			Range:       v1alpha1.IPRange("10.2.3.64/28"),
+			NetmaskBits: 27,
+		},
+	}}}
+
+	retry := RetryPolicy{
+		Timeout:         50 * time.Millisecond,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		Multiplier:      2,
+	}
+	ctx, cancel := retry.Context(context.Background())
+	defer cancel()
+
+	allocators := []Allocator{&KubernetesAllocator{Client: client}}
+	_, err := allocate(ctx, retry, allocators, "foo", "bar", "eth0", "container1", nil)
+	cniErr, ok := err.(*types.Error)
+	if !ok || cniErr.Code != types.ErrTryAgainLater {
+		t.Errorf("expected a try again later error when conflicts persist, got %v", err)
+	}
+}
+
+func TestAllocatePoolExhausted(t *testing.T) {
+	for _, strategy := range []string{v1alpha1.AllocationStrategyRandom, v1alpha1.AllocationStrategySequential} {
+		// .64 is the network address and .65 the gateway, leaving two addresses
+		client := &FakeKubernetesClient{v1alpha1.IPPool{
+			Spec: v1alpha1.IPPoolSpec{
+				Range:              v1alpha1.IPRange("10.2.3.64/30"),
+				NetmaskBits:        27,
+				Gateway:            net.ParseIP("10.2.3.65"),
+				AllocationStrategy: strategy,
+			},
+		}}
+		allocators := []Allocator{&KubernetesAllocator{Client: client}}
+
+		for _, podName := range []string{"pod-0", "pod-1"} {
+			if _, err := allocate(context.Background(), DefaultRetryPolicy(), allocators, "foo", podName, "eth0", "container1", nil); err != nil {
+				t.Fatalf("%s: unable to allocate for %s: %v", strategy, podName, err)
+			}
+		}
+
+		if _, _, _, err := allocators[0].Allocate(context.Background(), "foo", "pod-2", "eth0", "container1", nil); err == nil {
+			t.Fatalf("%s: expected the pool to be exhausted", strategy)
+		} else if exhausted, ok := err.(*PoolExhaustedError); !ok || exhausted.Capacity.Int64() != 2 {
+			t.Errorf("%s: expected a PoolExhaustedError with capacity 2, got %v", strategy, err)
+		}
+
+		_, err := allocate(context.Background(), DefaultRetryPolicy(), allocators, "foo", "pod-2", "eth0", "container1", nil)
+		cniErr, ok := err.(*types.Error)
+		if !ok || cniErr.Code != ErrCodePoolExhausted {
+			t.Errorf("%s: expected a pool exhausted CNI error, got %v", strategy, err)
+		}
+	}
+}
+
+func TestParseConfigRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    string
+		expected RetryPolicy
+		valid    bool
+	}{
+		{"default", `null`, DefaultRetryPolicy(), true},
+		{"partial", `{"timeout": "5s", "jitter": 0.5}`, RetryPolicy{
+			Timeout:         5 * time.Second,
+			InitialInterval: DefaultRetryInitialInterval,
+			MaxInterval:     DefaultRetryMaxInterval,
+			Multiplier:      DefaultRetryMultiplier,
+			Jitter:          0.5,
+		}, true},
+		{"no jitter", `{"jitter": 0}`, RetryPolicy{
+			Timeout:         DefaultRetryTimeout,
+			InitialInterval: DefaultRetryInitialInterval,
+			MaxInterval:     DefaultRetryMaxInterval,
+			Multiplier:      DefaultRetryMultiplier,
+		}, true},
+		{"full", `{"timeout": "10s", "initialInterval": "10ms", "maxInterval": "1s", "multiplier": 1.5, "jitter": 0.1}`, RetryPolicy{
+			Timeout:         10 * time.Second,
+			InitialInterval: 10 * time.Millisecond,
+			MaxInterval:     time.Second,
+			Multiplier:      1.5,
+			Jitter:          0.1,
+		}, true},
+		{"bad duration", `{"timeout": "soon"}`, RetryPolicy{}, false},
+		{"negative duration", `{"initialInterval": "-1s"}`, RetryPolicy{}, false},
+		{"max below initial", `{"initialInterval": "5s", "maxInterval": "1s"}`, RetryPolicy{}, false},
+		{"shrinking multiplier", `{"multiplier": 0.5}`, RetryPolicy{}, false},
+		{"excessive jitter", `{"jitter": 2}`, RetryPolicy{}, false},
+		{"negative jitter", `{"jitter": -0.1}`, RetryPolicy{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := fmt.Sprintf(`{
+        "cniVersion": "1.0.0",
+        "name": "mynet",
+        "ipam": {
+          "type": "k8s-ipam",
+          "ipPoolName": "sample-ippool",
+          "retry": %s
+        }
+      }`, test.retry)
+
+			conf, err := parseConfig([]byte(config))
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected invalid retry config to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to parse config: %v", err)
+			}
+
+			policy, err := conf.IPAM.GetRetryPolicy()
+			if err != nil {
+				t.Fatalf("unable to get retry policy: %v", err)
+			}
+			if policy != test.expected {
+				t.Errorf("wrong retry policy: got %+v, expected %+v", policy, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetPodRequestPoolPrecedence(t *testing.T) {
+	conf := &CniConf{IPAM: &KubernetesIPAMConfig{IPPoolName: "config-pool"}}
+
+	annotated := func(pools string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Annotations: map[string]string{IPPoolAnnotation: pools}}
+	}
+
+	client := &FakePodKubernetesClient{
+		Pods: map[string]*corev1.Pod{
+			"team-a/plain":     &corev1.Pod{},
+			"team-a/annotated": &corev1.Pod{ObjectMeta: annotated("pod-pool")},
+			"team-b/plain":     &corev1.Pod{},
+		},
+		Namespaces: map[string]*corev1.Namespace{
+			"team-a": &corev1.Namespace{ObjectMeta: annotated("team-a-pool")},
+			"team-b": &corev1.Namespace{},
+		},
+	}
+
+	tests := []struct {
+		namespace string
+		podName   string
+		expected  string
+	}{
+		{"team-a", "plain", "team-a-pool"},
+		{"team-a", "annotated", "pod-pool"},
+		{"team-b", "plain", "config-pool"},
+		{"team-c", "missing", "config-pool"},
+	}
+
+	for _, test := range tests {
+		request, err := getPodRequest(client, test.namespace, test.podName)
+		if err != nil {
+			t.Errorf("%s/%s: unable to get request: %v", test.namespace, test.podName, err)
+			continue
+		}
+
+		req := IPAMRequest{IPPoolNames: conf.IPAM.GetIPPoolNames()}
+		if pools, err := selectPoolNames(client, FakeIPPoolList{}, req, request); err != nil || len(pools) != 1 || pools[0] != test.expected {
+			t.Errorf("%s/%s: expected pool %s, got %v", test.namespace, test.podName, test.expected, pools)
+		}
+	}
+}
+
+// FakeIPPoolList lists pools from a slice
+type FakeIPPoolList []*v1alpha1.IPPool
+
+func (l FakeIPPoolList) ListIPPools(selector labels.Selector) ([]*v1alpha1.IPPool, error) {
+	pools := make([]*v1alpha1.IPPool, 0)
+	for _, pool := range l {
+		if selector.Matches(labels.Set(pool.Labels)) {
+			pools = append(pools, pool)
+		}
+	}
+	return pools, nil
+}
+
+func TestSelectTopologyPool(t *testing.T) {
+	pool := func(name, network string, nodeSelector *metav1.LabelSelector) *v1alpha1.IPPool {
+		return &v1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"network": network}},
+			Spec:       v1alpha1.IPPoolSpec{NodeSelector: nodeSelector},
+		}
+	}
+	rack := func(rack string) *metav1.LabelSelector {
+		return &metav1.LabelSelector{MatchLabels: map[string]string{"rack": rack}}
+	}
+	node := func(rack string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"rack": rack}}}
+	}
+
+	pools := FakeIPPoolList{
+		pool("storage-r1", "storage", rack("r1")),
+		pool("storage-r2", "storage", rack("r2")),
+		pool("storage-r2-extra", "storage", rack("r2")),
+		pool("public-r1", "public", rack("r1")),
+		pool("mgmt", "mgmt", nil),
+	}
+	client := &FakePodKubernetesClient{Nodes: map[string]*corev1.Node{
+		"node-r1": node("r1"),
+		"node-r2": node("r2"),
+		"node-r3": node("r3"),
+	}}
+
+	tests := []struct {
+		selector string
+		nodeName string
+		expected string
+		err      error
+	}{
+		{"network=storage", "node-r1", "storage-r1", nil},
+		{"network=public", "node-r1", "public-r1", nil},
+		{"network=mgmt", "node-r3", "mgmt", nil},
+		{"network=storage", "node-r3", "", ErrNoTopologyPool},
+		{"network=storage", "missing", "", ErrNoTopologyPool},
+		{"network=storage", "", "", ErrNoTopologyPool},
+		{"network=storage", "node-r2", "", ErrAmbiguousTopologyPool},
+	}
+
+	for _, test := range tests {
+		poolName, err := selectTopologyPool(client, pools, test.selector, test.nodeName)
+		if test.err == nil {
+			if err != nil || poolName != test.expected {
+				t.Errorf("%s on %q: expected %s, got %s, %v", test.selector, test.nodeName, test.expected, poolName, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
+			t.Errorf("%s on %q: expected %v, got %s, %v", test.selector, test.nodeName, test.err, poolName, err)
+		}
+	}
+
+	// Pools named by the pod take precedence over the selector
+	req := IPAMRequest{IPPoolSelector: "network=storage"}
+	if poolNames, err := selectPoolNames(client, pools, req, &PodRequest{IPPoolNames: []string{"other"}, NodeName: "node-r2"}); err != nil || len(poolNames) != 1 || poolNames[0] != "other" {
+		t.Errorf("expected the pod's pools, got %v, %v", poolNames, err)
+	}
+	if poolNames, err := selectPoolNames(client, pools, req, &PodRequest{NodeName: "node-r1"}); err != nil || len(poolNames) != 1 || poolNames[0] != "storage-r1" {
+		t.Errorf("expected the pool for the node, got %v, %v", poolNames, err)
+	}
+}
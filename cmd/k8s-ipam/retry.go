@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ErrRetryTimeout is returned when an update keeps conflicting until the retry deadline passes
+var ErrRetryTimeout = errors.New("gave up retrying conflicting ip pool update")
+
+// Defaults for the retry policy, the timeout is kept below the kubelet's own timeout for CNI calls
+const (
+	DefaultRetryTimeout         = 15 * time.Second
+	DefaultRetryInitialInterval = 50 * time.Millisecond
+	DefaultRetryMaxInterval     = 2 * time.Second
+	DefaultRetryMultiplier      = 2.0
+	DefaultRetryJitter          = 0.2
+)
+
+// RetryConfig is the retry section of the ipam config.  Durations are in the format accepted by time.ParseDuration.
+// Jitter is a pointer so it can be set to 0 to turn jitter off.
+type RetryConfig struct {
+	Timeout         string   `json:"timeout"`
+	InitialInterval string   `json:"initialInterval"`
+	MaxInterval     string   `json:"maxInterval"`
+	Multiplier      float64  `json:"multiplier"`
+	Jitter          *float64 `json:"jitter"`
+}
+
+// RetryPolicy controls how conflicting ip pool updates are retried
+type RetryPolicy struct {
+	// Timeout is the total time allowed for an operation, including retries
+	Timeout time.Duration
+	// InitialInterval is the delay before the first retry
+	InitialInterval time.Duration
+	// MaxInterval caps the delay between retries
+	MaxInterval time.Duration
+	// Multiplier is applied to the delay after each retry
+	Multiplier float64
+	// Jitter randomizes each delay by up to this fraction in either direction
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the policy used when the ipam config doesn't specify one
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Timeout:         DefaultRetryTimeout,
+		InitialInterval: DefaultRetryInitialInterval,
+		MaxInterval:     DefaultRetryMaxInterval,
+		Multiplier:      DefaultRetryMultiplier,
+		Jitter:          DefaultRetryJitter,
+	}
+}
+
+// Policy returns the retry policy described by the config, using defaults for anything left unset
+func (c *RetryConfig) Policy() (RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+	if c == nil {
+		return policy, nil
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"timeout", c.Timeout, &policy.Timeout},
+		{"initialInterval", c.InitialInterval, &policy.InitialInterval},
+		{"maxInterval", c.MaxInterval, &policy.MaxInterval},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return policy, fmt.Errorf("unable to parse retry %s: %v", d.name, err)
+		}
+		if duration <= 0 {
+			return policy, fmt.Errorf("retry %s must be positive", d.name)
+		}
+		*d.dest = duration
+	}
+
+	if c.Multiplier != 0 {
+		if c.Multiplier < 1 {
+			return policy, fmt.Errorf("retry multiplier must be at least 1")
+		}
+		policy.Multiplier = c.Multiplier
+	}
+
+	if c.Jitter != nil {
+		if *c.Jitter < 0 || *c.Jitter > 1 {
+			return policy, fmt.Errorf("retry jitter must be between 0 and 1")
+		}
+		policy.Jitter = *c.Jitter
+	}
+
+	if policy.MaxInterval < policy.InitialInterval {
+		return policy, fmt.Errorf("retry maxInterval must not be less than initialInterval")
+	}
+
+	return policy, nil
+}
+
+// Context returns a context that expires when the policy's timeout has passed
+func (p RetryPolicy) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, p.Timeout)
+}
+
+// delay returns the jittered delay to wait before the next attempt and the un-jittered interval for the attempt
+// after that
+func (p RetryPolicy) delay(interval time.Duration) (time.Duration, time.Duration) {
+	jittered := float64(interval) * (1 + p.Jitter*(2*rand.Float64()-1))
+
+	next := time.Duration(float64(interval) * p.Multiplier)
+	if next > p.MaxInterval {
+		next = p.MaxInterval
+	}
+	return time.Duration(jittered), next
+}
+
+// Do calls op until it returns something other than ErrUpdateConflict, backing off between attempts.
+// ErrRetryTimeout is returned if ctx is done before op stops conflicting.
+func (p RetryPolicy) Do(ctx context.Context, op func() error) error {
+	interval := p.InitialInterval
+	for {
+		if err := op(); err != ErrUpdateConflict {
+			return err
+		}
+
+		var wait time.Duration
+		wait, interval = p.delay(interval)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrRetryTimeout
+		case <-timer.C:
+		}
+	}
+}
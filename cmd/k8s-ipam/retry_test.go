@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{
+		Timeout:         time.Second,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     4 * time.Millisecond,
+		Multiplier:      2,
+		Jitter:          0.5,
+	}
+
+	errFailed := fmt.Errorf("failed")
+	tests := []struct {
+		name     string
+		results  []error
+		expected error
+		attempts int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"conflicts then success", []error{ErrUpdateConflict, ErrUpdateConflict, nil}, nil, 3},
+		{"failure isn't retried", []error{errFailed, nil}, errFailed, 1},
+		{"conflict then failure", []error{ErrUpdateConflict, errFailed}, errFailed, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := policy.Context(context.Background())
+			defer cancel()
+
+			attempts := 0
+			err := policy.Do(ctx, func() error {
+				err := test.results[attempts]
+				attempts++
+				return err
+			})
+
+			if err != test.expected {
+				t.Errorf("got error %v, expected %v", err, test.expected)
+			}
+
+			if attempts != test.attempts {
+				t.Errorf("got %d attempts, expected %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoTimeout(t *testing.T) {
+	policy := RetryPolicy{
+		Timeout:         20 * time.Millisecond,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     2 * time.Millisecond,
+		Multiplier:      2,
+	}
+
+	ctx, cancel := policy.Context(context.Background())
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := policy.Do(ctx, func() error {
+		attempts++
+		return ErrUpdateConflict
+	})
+
+	if err != ErrRetryTimeout {
+		t.Errorf("expected ErrRetryTimeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries continued long after the deadline: %v", elapsed)
+	}
+
+	// without backoff this would be many thousands of attempts
+	if attempts > 25 {
+		t.Errorf("too many attempts before the deadline, backoff not applied: %d", attempts)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     35 * time.Millisecond,
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+
+	interval := policy.InitialInterval
+	expectedIntervals := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 35 * time.Millisecond, 35 * time.Millisecond}
+	for i, expected := range expectedIntervals {
+		if interval != expected {
+			t.Errorf("attempt %d: got interval %v, expected %v", i, interval, expected)
+		}
+
+		var wait time.Duration
+		wait, interval = policy.delay(interval)
+		if wait < time.Duration(float64(expected)*0.8) || wait > time.Duration(float64(expected)*1.2) {
+			t.Errorf("attempt %d: jittered delay %v outside of 20%% of %v", i, wait, expected)
+		}
+	}
+}
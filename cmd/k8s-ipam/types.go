@@ -3,34 +3,93 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 )
 
 type CniConf struct {
-	Name       string                `json:"name"`
-	CNIVersion string                `json:"cniVersion"`
-	IPAM       *KubernetesIPAMConfig `json:"ipam"`
+	Name          string                 `json:"name"`
+	CNIVersion    string                 `json:"cniVersion"`
+	IPAM          *KubernetesIPAMConfig  `json:"ipam"`
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+	PrevResult    *types100.Result       `json:"-"`
 }
 
 type KubernetesIPAMConfig struct {
-	Name       string
-	Type       string `json:"type"`
-	KubeConfig string `json:"kubeConfig"`
-	IPPoolName string `json:"ipPoolName"`
+	Name                    string
+	Type                    string          `json:"type"`
+	KubeConfig              string          `json:"kubeConfig"`
+	KubeAPIServer           string          `json:"kubeApiServer"`
+	ServiceAccountTokenFile string          `json:"serviceAccountTokenFile"`
+	ServiceAccountCAFile    string          `json:"serviceAccountCAFile"`
+	IPPoolName              string          `json:"ipPoolName"`
+	IPPoolNames             []string        `json:"ipPoolNames"`
+	IPPoolSelector          string          `json:"ipPoolSelector"`
+	Retry                   *RetryConfig    `json:"retry,omitempty"`
+	Liveness                *LivenessConfig `json:"liveness,omitempty"`
+	DaemonSocket            string          `json:"daemonSocket"`
 }
 
 func (c KubernetesIPAMConfig) GetKubeConfig() string {
 	return c.KubeConfig
 }
 
+// GetKubeAuth returns the settings used to authenticate to the kubernetes api
+func (c KubernetesIPAMConfig) GetKubeAuth() KubeAuth {
+	return KubeAuth{
+		KubeConfig: c.KubeConfig,
+		APIServer:  c.KubeAPIServer,
+		TokenFile:  c.ServiceAccountTokenFile,
+		CAFile:     c.ServiceAccountCAFile,
+	}
+}
+
 func (c KubernetesIPAMConfig) GetIPPoolName() string {
 	return c.IPPoolName
 }
 
+// GetIPPoolNames returns the names of all pools to allocate from.  ipPoolNames takes precedence over ipPoolName.
+func (c KubernetesIPAMConfig) GetIPPoolNames() []string {
+	if len(c.IPPoolNames) > 0 {
+		return c.IPPoolNames
+	}
+
+	if c.IPPoolName != "" {
+		return []string{c.IPPoolName}
+	}
+	return nil
+}
+
+// GetIPPoolSelector returns the label selector for the pools one is chosen from by the pod's node.  It takes
+// precedence over the pool names.
+func (c KubernetesIPAMConfig) GetIPPoolSelector() string {
+	return c.IPPoolSelector
+}
+
+// GetDaemonSocket returns the path to the allocation daemon's socket
+func (c KubernetesIPAMConfig) GetDaemonSocket() string {
+	if c.DaemonSocket != "" {
+		return c.DaemonSocket
+	}
+	return DefaultDaemonSocket
+}
+
+// GetRetryPolicy returns the policy for retrying conflicting ip pool updates
+func (c KubernetesIPAMConfig) GetRetryPolicy() (RetryPolicy, error) {
+	return c.Retry.Policy()
+}
+
+// GetLivenessPolicy returns the policy deciding whether the pod holding an address is dead, looking up nodes with
+// nodes
+func (c KubernetesIPAMConfig) GetLivenessPolicy(nodes NodeRetriever) (LivenessPolicy, error) {
+	return c.Liveness.Policy(nodes)
+}
+
 type Address struct {
 	Version   string      `json:"version"`
 	Interface *uint       `json:"interface,omitempty"`
@@ -38,14 +97,80 @@ type Address struct {
 	Gateway   net.IP      `json:"gateway,omitempty"`
 }
 
+// Addresses returns the addresses from a CNI result in the form used by IPAMResult
+func Addresses(result *types100.Result) []Address {
+	addrs := make([]Address, 0, len(result.IPs))
+	for _, ipc := range result.IPs {
+		addr := Address{
+			Version: "4",
+			Address: types.IPNet(ipc.Address),
+			Gateway: ipc.Gateway,
+		}
+		if ipc.Address.IP.To4() == nil {
+			addr.Version = "6"
+		}
+		if ipc.Interface != nil && *ipc.Interface >= 0 {
+			iface := uint(*ipc.Interface)
+			addr.Interface = &iface
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
 type IPAMResult struct {
-	CniVersion string        `json:"cniVersion"`
-	IPs        []Address     `json:"ips"`
-	Routes     []types.Route `json:"routes"`
-	DNS        types.DNS     `json:"dns"`
+	CniVersion string                `json:"cniVersion"`
+	Interfaces []*types100.Interface `json:"interfaces,omitempty"`
+	IPs        []Address             `json:"ips"`
+	Routes     []types.Route         `json:"routes"`
+	DNS        types.DNS             `json:"dns"`
+}
+
+// NewIPAMResult converts a result of any supported CNI version to an IPAMResult
+func NewIPAMResult(result types.Result) (*IPAMResult, error) {
+	r, err := types100.NewResultFromResult(result)
+	if err != nil {
+		return nil, err
+	}
+
+	ipamResult := &IPAMResult{
+		CniVersion: result.Version(),
+		Interfaces: r.Interfaces,
+		IPs:        Addresses(r),
+		DNS:        r.DNS,
+	}
+	for _, route := range r.Routes {
+		ipamResult.Routes = append(ipamResult.Routes, *route)
+	}
+	return ipamResult, nil
 }
 
 func (r *IPAMResult) AddIP(ip net.IPNet, gw net.IP) {
+	r.addAddress(ip, gw)
+	if gw != nil {
+		r.addRoute(defaultRoute(ip), gw)
+	}
+}
+
+// AddPool adds an address allocated from pool along with the pool's routes and DNS settings.  The default route
+// through the pool's gateway is added unless the pool disables it.
+func (r *IPAMResult) AddPool(ip net.IPNet, pool *v1alpha1.IPPool) {
+	if pool.Spec.DisableDefaultRoute {
+		r.addAddress(ip, pool.Gateway())
+	} else {
+		r.AddIP(ip, pool.Gateway())
+	}
+
+	for _, route := range pool.Spec.Routes {
+		if destination := route.Destination.AsNet(); destination != nil {
+			r.addRoute(*destination, pool.RouteGateway(route))
+		}
+	}
+
+	r.addDNS(pool.Spec.DNS)
+}
+
+func (r *IPAMResult) addAddress(ip net.IPNet, gw net.IP) {
 	addr := Address{}
 	addr.Version = "4"
 
@@ -54,44 +179,126 @@ func (r *IPAMResult) AddIP(ip net.IPNet, gw net.IP) {
 	}
 
 	addr.Address = types.IPNet(ip)
-	if gw != nil {
-		addr.Gateway = gw
-		destination := net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
-		if addr.Version == "4" {
-			destination = net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	addr.Gateway = gw
+
+	r.IPs = append(r.IPs, addr)
+}
+
+// defaultRoute returns the default route destination for ip's address family
+func defaultRoute(ip net.IPNet) net.IPNet {
+	if ip.IP.To4() != nil {
+		return net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	}
+	return net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+// addRoute adds a route to destination via gw, unless the result already has one
+func (r *IPAMResult) addRoute(destination net.IPNet, gw net.IP) {
+	for _, route := range r.Routes {
+		if route.Dst.String() == destination.String() && route.GW.Equal(gw) {
+			return
 		}
-		route := types.Route{
-			Dst: destination,
-			GW:  addr.Gateway,
+	}
+
+	if r.Routes == nil {
+		r.Routes = make([]types.Route, 0, 1)
+	}
+	r.Routes = append(r.Routes, types.Route{Dst: destination, GW: gw})
+}
+
+// addDNS merges the pool's DNS settings into the result.  The first domain set wins, other settings are appended
+// without duplicates.
+func (r *IPAMResult) addDNS(dns v1alpha1.DNS) {
+	if r.DNS.Domain == "" {
+		r.DNS.Domain = dns.Domain
+	}
+	r.DNS.Nameservers = appendUnique(r.DNS.Nameservers, dns.Nameservers...)
+	r.DNS.Search = appendUnique(r.DNS.Search, dns.Search...)
+	r.DNS.Options = appendUnique(r.DNS.Options, dns.Options...)
+}
+
+// appendUnique appends each of values to list that isn't already present
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
 		}
-		if r.Routes == nil {
-			r.Routes = make([]types.Route, 0, 1)
+		if !found {
+			list = append(list, value)
 		}
-		r.Routes = append(r.Routes, route)
 	}
+	return list
+}
 
-	r.IPs = append(r.IPs, addr)
+// Contains returns true if ip is one of the addresses in the result
+func (r *IPAMResult) Contains(ip net.IP) bool {
+	for _, addr := range r.IPs {
+		if addr.Address.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r IPAMResult) Version() string {
 	return r.CniVersion
 }
 
+// GetAsVersion returns the result as version.  0.3.x and 0.4.0 results are returned as an IPAMResult, all others are
+// converted by way of the CNI library's result types.
 func (r IPAMResult) GetAsVersion(version string) (types.Result, error) {
 	switch version {
-	case "0.3.0", current.ImplementedSpecVersion:
+	case "0.3.0", "0.3.1", "0.4.0":
 		r.CniVersion = version
 		return r, nil
 	}
-	return nil, fmt.Errorf("cannot convert version 0.3.x to %q", version)
+
+	result, err := r.asResult100().GetAsVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert version %s to %q: %v", r.CniVersion, version, err)
+	}
+	return result, nil
+}
+
+// asResult100 returns the result as a CNI spec 1.x result
+func (r IPAMResult) asResult100() *types100.Result {
+	result := &types100.Result{
+		CNIVersion: types100.ImplementedSpecVersion,
+		Interfaces: r.Interfaces,
+		DNS:        r.DNS,
+	}
+
+	for _, addr := range r.IPs {
+		ipc := &types100.IPConfig{
+			Address: net.IPNet(addr.Address),
+			Gateway: addr.Gateway,
+		}
+		if addr.Interface != nil {
+			ipc.Interface = types100.Int(int(*addr.Interface))
+		}
+		result.IPs = append(result.IPs, ipc)
+	}
+
+	for i := range r.Routes {
+		result.Routes = append(result.Routes, &r.Routes[i])
+	}
+	return result
 }
 
 func (r IPAMResult) Print() error {
+	return r.PrintTo(os.Stdout)
+}
+
+func (r IPAMResult) PrintTo(writer io.Writer) error {
 	data, err := json.MarshalIndent(r, "", "    ")
 	if err != nil {
 		return err
 	}
-	_, err = os.Stdout.Write(data)
+	_, err = writer.Write(data)
 	return err
 }
 
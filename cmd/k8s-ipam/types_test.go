@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"net"
+	"reflect"
 	"testing"
+
+	"github.com/PolarGeospatialCenter/k8s-ipam/pkg/api/k8s.pgc.umn.edu/v1alpha1"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
 )
 
 func TestIpamResult(t *testing.T) {
@@ -13,3 +21,168 @@ func TestIpamResult(t *testing.T) {
 	result.AddIP(*network, net.ParseIP("2001:db8::1"))
 	result.Print()
 }
+
+func TestIpamResultAddPool(t *testing.T) {
+	ipv4IP, ipv4Net, _ := net.ParseCIDR("10.2.3.70/27")
+	ipv4Net.IP = ipv4IP
+	ipv6IP, ipv6Net, _ := net.ParseCIDR("2001:db8::10/64")
+	ipv6Net.IP = ipv6IP
+
+	v4Pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		Gateway:             net.ParseIP("10.2.3.65"),
+		DisableDefaultRoute: true,
+		Routes: []v1alpha1.Route{
+			{Destination: "10.10.0.0/16"},
+			{Destination: "10.20.0.0/16", Gateway: net.ParseIP("10.2.3.66")},
+		},
+		DNS: v1alpha1.DNS{Nameservers: []string{"10.2.3.2"}, Domain: "example.com", Search: []string{"example.com"}},
+	}}
+	v6Pool := &v1alpha1.IPPool{Spec: v1alpha1.IPPoolSpec{
+		Gateway: net.ParseIP("2001:db8::1"),
+		DNS:     v1alpha1.DNS{Nameservers: []string{"2001:db8::2"}, Domain: "other.example.com", Search: []string{"example.com"}, Options: []string{"ndots:2"}},
+	}}
+
+	result := &IPAMResult{}
+	result.AddPool(*ipv4Net, v4Pool)
+	result.AddPool(*ipv6Net, v6Pool)
+
+	if len(result.IPs) != 2 || !result.IPs[0].Gateway.Equal(net.ParseIP("10.2.3.65")) {
+		t.Errorf("wrong addresses in result: %v", result.IPs)
+	}
+
+	expectedRoutes := []string{
+		"10.10.0.0/16 via 10.2.3.65",
+		"10.20.0.0/16 via 10.2.3.66",
+		"::/0 via 2001:db8::1",
+	}
+	if len(result.Routes) != len(expectedRoutes) {
+		t.Fatalf("expected %d routes, got %v", len(expectedRoutes), result.Routes)
+	}
+	for i, route := range result.Routes {
+		if got := fmt.Sprintf("%s via %s", route.Dst.String(), route.GW); got != expectedRoutes[i] {
+			t.Errorf("route %d: got %s, expected %s", i, got, expectedRoutes[i])
+		}
+	}
+
+	expectedDNS := types.DNS{
+		Nameservers: []string{"10.2.3.2", "2001:db8::2"},
+		Domain:      "example.com",
+		Search:      []string{"example.com"},
+		Options:     []string{"ndots:2"},
+	}
+	if !reflect.DeepEqual(result.DNS, expectedDNS) {
+		t.Errorf("wrong dns in result: got %v, expected %v", result.DNS, expectedDNS)
+	}
+}
+
+func TestIpamResultConversion(t *testing.T) {
+	ipv4IP, ipv4Net, _ := net.ParseCIDR("10.2.3.70/27")
+	ipv4Net.IP = ipv4IP
+	ipv6IP, ipv6Net, _ := net.ParseCIDR("2001:db8::10/64")
+	ipv6Net.IP = ipv6IP
+
+	original := &IPAMResult{CniVersion: "1.1.0"}
+	original.AddIP(*ipv4Net, net.ParseIP("10.2.3.65"))
+	original.AddIP(*ipv6Net, net.ParseIP("2001:db8::1"))
+	iface := uint(0)
+	for i := range original.IPs {
+		original.IPs[i].Interface = &iface
+	}
+	original.DNS = types.DNS{Nameservers: []string{"10.2.3.2"}}
+
+	tests := []struct {
+		version          string
+		keepsInterface   bool
+		hasAddressFamily bool
+		fields           []string
+	}{
+		{"0.1.0", false, false, []string{"ip4", "ip6", "dns"}},
+		{"0.2.0", false, false, []string{"ip4", "ip6", "dns"}},
+		{"0.3.0", true, true, []string{"ips", "routes", "dns"}},
+		{"0.3.1", true, true, []string{"ips", "routes", "dns"}},
+		{"0.4.0", true, true, []string{"ips", "routes", "dns"}},
+		{"1.0.0", true, false, []string{"ips", "routes", "dns"}},
+		{"1.1.0", true, false, []string{"ips", "routes", "dns"}},
+	}
+
+	for _, test := range tests {
+		converted, err := original.GetAsVersion(test.version)
+		if err != nil {
+			t.Errorf("%s: unable to convert result: %v", test.version, err)
+			continue
+		}
+
+		if converted.Version() != test.version {
+			t.Errorf("%s: converted result has version %s", test.version, converted.Version())
+		}
+
+		buf := &bytes.Buffer{}
+		if err := converted.PrintTo(buf); err != nil {
+			t.Errorf("%s: unable to print result: %v", test.version, err)
+			continue
+		}
+
+		raw := map[string]interface{}{}
+		if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+			t.Errorf("%s: unable to parse printed result: %v", test.version, err)
+			continue
+		}
+
+		for _, field := range test.fields {
+			if _, ok := raw[field]; !ok {
+				t.Errorf("%s: field %s missing from result: %s", test.version, field, buf.String())
+			}
+		}
+
+		if ips, ok := raw["ips"].([]interface{}); ok {
+			for _, ip := range ips {
+				if _, found := ip.(map[string]interface{})["version"]; found != test.hasAddressFamily {
+					t.Errorf("%s: expected version field present to be %t: %v", test.version, test.hasAddressFamily, ip)
+				}
+			}
+		}
+
+		parsed, err := version.NewResult(test.version, buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: unable to parse printed result: %v", test.version, err)
+			continue
+		}
+
+		roundTrip, err := NewIPAMResult(parsed)
+		if err != nil {
+			t.Errorf("%s: unable to convert back to IPAMResult: %v", test.version, err)
+			continue
+		}
+
+		if roundTrip.CniVersion != test.version {
+			t.Errorf("%s: round trip result has version %s", test.version, roundTrip.CniVersion)
+		}
+
+		if len(roundTrip.IPs) != len(original.IPs) {
+			t.Errorf("%s: expected %d addresses, got %d", test.version, len(original.IPs), len(roundTrip.IPs))
+			continue
+		}
+
+		for i, addr := range roundTrip.IPs {
+			expected := original.IPs[i]
+			if addr.Version != expected.Version || (*net.IPNet)(&addr.Address).String() != (*net.IPNet)(&expected.Address).String() || !addr.Gateway.Equal(expected.Gateway) {
+				t.Errorf("%s: address %d doesn't match after round trip: %+v, expected %+v", test.version, i, addr, expected)
+			}
+
+			if test.keepsInterface && (addr.Interface == nil || *addr.Interface != iface) {
+				t.Errorf("%s: interface index lost for address %d", test.version, i)
+			}
+		}
+
+		if len(roundTrip.DNS.Nameservers) != 1 || roundTrip.DNS.Nameservers[0] != "10.2.3.2" {
+			t.Errorf("%s: dns lost in round trip: %v", test.version, roundTrip.DNS)
+		}
+	}
+}
+
+func TestIpamResultConversionUnsupported(t *testing.T) {
+	result := &IPAMResult{CniVersion: "1.1.0"}
+	if _, err := result.GetAsVersion("9.9.9"); err == nil {
+		t.Errorf("expected error converting to unsupported version")
+	}
+}
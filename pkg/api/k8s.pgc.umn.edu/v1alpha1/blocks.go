@@ -0,0 +1,241 @@
+package v1alpha1
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// BlockAffinity records that a block of the pool's addresses belongs to a node
+type BlockAffinity struct {
+	CIDR     IPRange     `json:"cidr"`
+	NodeName string      `json:"nodeName"`
+	Claimed  metav1.Time `json:"claimed"`
+}
+
+// blockFor returns the block containing ip, or nil if the pool isn't divided into blocks
+func (s IPPoolSpec) blockFor(ip net.IP) *net.IPNet {
+	bits := s.AllRanges().IPSizeBits()
+	if s.BlockSize <= 0 || bits == 0 {
+		return nil
+	}
+
+	mask := net.CIDRMask(s.BlockSize, bits)
+	network := normalizeIP(ip, make(net.IP, bits/8))
+	if network == nil {
+		return nil
+	}
+	return &net.IPNet{IP: network.Mask(mask), Mask: mask}
+}
+
+// validateBlockSize returns an error if the blocks would be larger than the pool's subnet or smaller than one address
+func (s IPPoolSpec) validateBlockSize(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if s.BlockSize == 0 {
+		return allErrs
+	}
+
+	if bits := s.AllRanges().IPSizeBits(); s.BlockSize < s.NetmaskBits || s.BlockSize > bits {
+		allErrs = append(allErrs, field.Invalid(path, s.BlockSize, fmt.Sprintf("block size must be between the netmask (%d) and %d bits", s.NetmaskBits, bits)))
+	}
+	return allErrs
+}
+
+// BlockAffinity returns the node the block containing ip belongs to.  found is false if the block hasn't been claimed.
+func (p *IPPool) BlockAffinity(ip net.IP) (nodeName string, found bool) {
+	block := p.Spec.blockFor(ip)
+	if block == nil {
+		return "", false
+	}
+
+	for _, affinity := range p.Status.Blocks {
+		if affinity.CIDR == IPRange(block.String()) {
+			return affinity.NodeName, true
+		}
+	}
+	return "", false
+}
+
+// ClaimBlock gives the node affinity for the block containing ip, unless the block already belongs to a node.
+// Returns true if the block was claimed.
+func (p *IPPool) ClaimBlock(ip net.IP, nodeName string) bool {
+	block := p.Spec.blockFor(ip)
+	if block == nil || nodeName == "" {
+		return false
+	}
+
+	if _, found := p.BlockAffinity(ip); found {
+		return false
+	}
+
+	p.Status.Blocks = append(p.Status.Blocks, BlockAffinity{CIDR: IPRange(block.String()), NodeName: nodeName, Claimed: metav1.Now()})
+	return true
+}
+
+// ReleaseBlock removes the affinity for the block if it still belongs to the same node, so any node may claim it.
+// Returns true if the affinity was removed.
+func (p *IPPool) ReleaseBlock(release BlockAffinity) bool {
+	for i, affinity := range p.Status.Blocks {
+		if affinity.CIDR == release.CIDR && affinity.NodeName == release.NodeName {
+			p.Status.Blocks = append(p.Status.Blocks[:i], p.Status.Blocks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// NewBlockStrategy returns a strategy that tries every address in the node's blocks, then every address in blocks
+// no node has claimed.  If the pool lets nodes borrow blocks, it then falls back to the candidates from fallback,
+// which include other nodes' blocks.  fallback is returned unchanged if the pool isn't divided into blocks.
+func (p *IPPool) NewBlockStrategy(nodeName string, fallback AllocationStrategy) AllocationStrategy {
+	if p.Spec.BlockSize <= 0 || nodeName == "" {
+		return fallback
+	}
+
+	ranges := p.Spec.AllRanges()
+	claimed := make(map[IPRange]bool)
+	own := make(IPRangeList, 0)
+	for _, affinity := range p.Status.Blocks {
+		claimed[affinity.CIDR] = true
+		if affinity.NodeName == nodeName {
+			own = append(own, ranges.intersect(affinity.CIDR.AsNet())...)
+		}
+	}
+
+	strategy := chainStrategy{
+		newScanStrategy(own, big.NewInt(0)),
+		&unclaimedBlockStrategy{pool: p, ranges: ranges, claimed: claimed, seen: make(map[IPRange]bool)},
+	}
+	if p.Spec.BorrowBlocks {
+		strategy = append(strategy, fallback)
+	}
+	return &strategy
+}
+
+// chainStrategy returns the candidates of each strategy in turn
+type chainStrategy []AllocationStrategy
+
+func (s *chainStrategy) Next() net.IP {
+	for len(*s) > 0 {
+		if ip := (*s)[0].Next(); ip != nil {
+			return ip
+		}
+		*s = (*s)[1:]
+	}
+	return nil
+}
+
+// unclaimedBlockStrategy returns every address in each block no node has claimed, in order, one block at a time
+type unclaimedBlockStrategy struct {
+	pool    *IPPool
+	ranges  IPRangeList
+	claimed map[IPRange]bool
+	seen    map[IPRange]bool
+	// current is the index of the range blocks are being taken from, and next an address in the next block to consider
+	current int
+	next    net.IP
+	scan    *scanStrategy
+}
+
+func (s *unclaimedBlockStrategy) Next() net.IP {
+	for {
+		if s.scan != nil {
+			if ip := s.scan.Next(); ip != nil {
+				return ip
+			}
+			s.scan = nil
+		}
+
+		block := s.nextBlock()
+		if block == nil {
+			return nil
+		}
+		s.scan = newScanStrategy(s.ranges.intersect(block), big.NewInt(0))
+	}
+}
+
+// nextBlock returns the next block overlapping the ranges that hasn't been claimed or already returned
+func (s *unclaimedBlockStrategy) nextBlock() *net.IPNet {
+	for s.current < len(s.ranges) {
+		start, end := s.ranges[s.current].Bounds()
+		if s.next == nil {
+			s.next = start
+		}
+
+		if start == nil || !ipInRange(s.next, start, end) {
+			s.current++
+			s.next = nil
+			continue
+		}
+
+		block := s.pool.Spec.blockFor(s.next)
+		last := lastAddress(block)
+		if s.next = addressAfter(last); s.next == nil {
+			// the block ends at the top of the address space
+			s.current++
+		}
+
+		key := IPRange(block.String())
+		if s.claimed[key] || s.seen[key] {
+			continue
+		}
+		s.seen[key] = true
+		return block
+	}
+	return nil
+}
+
+// intersect returns the parts of the ranges within network
+func (l IPRangeList) intersect(network *net.IPNet) IPRangeList {
+	if network == nil {
+		return make(IPRangeList, 0)
+	}
+	return l.intersectBounds(network.IP, lastAddress(network))
+}
+
+// intersectBounds returns the parts of the ranges between first and last inclusive, which must be the same length
+func (l IPRangeList) intersectBounds(first, last net.IP) IPRangeList {
+	intersection := make(IPRangeList, 0)
+	for _, r := range l {
+		start, end := r.Bounds()
+		if start == nil || len(start) != len(first) {
+			continue
+		}
+		if bytes.Compare(start, first) < 0 {
+			start = first
+		}
+		if bytes.Compare(end, last) > 0 {
+			end = last
+		}
+		if bytes.Compare(start, end) <= 0 {
+			intersection = append(intersection, IPRange(fmt.Sprintf("%s-%s", start, end)))
+		}
+	}
+	return intersection
+}
+
+// lastAddress returns the last address in network
+func lastAddress(network *net.IPNet) net.IP {
+	last := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+	return last
+}
+
+// addressAfter returns the address following ip, or nil if ip is the last address in its family
+func addressAfter(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
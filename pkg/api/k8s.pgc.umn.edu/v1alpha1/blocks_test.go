@@ -0,0 +1,121 @@
+package v1alpha1
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBlockStrategy(t *testing.T) {
+	p := &IPPool{}
+	p.Spec.Range = IPRange("10.2.3.2-10.2.3.17")
+	p.Spec.NetmaskBits = 24
+	p.Spec.BlockSize = 30
+	p.Spec.AllocationStrategy = AllocationStrategyLowestFree
+	p.Status.Blocks = []BlockAffinity{
+		{CIDR: "10.2.3.8/30", NodeName: "node-a"},
+		{CIDR: "10.2.3.0/30", NodeName: "node-b"},
+	}
+
+	strategy := p.NewBlockStrategy("node-a", p.NewAllocationStrategy("foo", "bar"))
+	expected := []string{
+		// the node's own block
+		"10.2.3.8", "10.2.3.9", "10.2.3.10", "10.2.3.11",
+		// unclaimed blocks, in order
+		"10.2.3.4", "10.2.3.5", "10.2.3.6", "10.2.3.7",
+		"10.2.3.12", "10.2.3.13", "10.2.3.14", "10.2.3.15",
+		"10.2.3.16", "10.2.3.17",
+	}
+	for i, address := range expected {
+		if ip := strategy.Next(); !ip.Equal(net.ParseIP(address)) {
+			t.Errorf("expected candidate %d to be %s, got %s", i, address, ip)
+		}
+	}
+	if ip := strategy.Next(); ip != nil {
+		t.Errorf("expected other nodes' blocks to be left alone, got %s", ip)
+	}
+
+	// Once the node's own and the unclaimed blocks are tried, other nodes' blocks may be borrowed
+	p.Spec.BorrowBlocks = true
+	strategy = p.NewBlockStrategy("node-a", p.NewAllocationStrategy("foo", "bar"))
+	for range expected {
+		strategy.Next()
+	}
+	if ip := strategy.Next(); !ip.Equal(net.ParseIP("10.2.3.2")) {
+		t.Errorf("expected to borrow 10.2.3.2 from node-b, got %s", ip)
+	}
+
+	if _, ok := p.NewBlockStrategy("", p.NewAllocationStrategy("foo", "bar")).(*scanStrategy); !ok {
+		t.Errorf("expected the pool strategy for pods without a node")
+	}
+}
+
+func TestIPPoolClaimBlock(t *testing.T) {
+	p := &IPPool{}
+	p.Spec.Range = IPRange("2001:db8::/64")
+	p.Spec.NetmaskBits = 64
+	p.Spec.BlockSize = 120
+
+	if !p.ClaimBlock(net.ParseIP("2001:db8::1:23"), "node-a") {
+		t.Fatalf("unable to claim unclaimed block")
+	}
+	if p.ClaimBlock(net.ParseIP("2001:db8::1:ff"), "node-b") {
+		t.Errorf("claimed a block that belongs to another node")
+	}
+	if nodeName, found := p.BlockAffinity(net.ParseIP("2001:db8::1:00")); !found || nodeName != "node-a" {
+		t.Errorf("expected block to belong to node-a, got %s %t", nodeName, found)
+	}
+	if len(p.Status.Blocks) != 1 || p.Status.Blocks[0].CIDR != "2001:db8::1:0/120" {
+		t.Errorf("unexpected blocks recorded: %v", p.Status.Blocks)
+	}
+
+	p.Spec.BlockSize = 0
+	if p.ClaimBlock(net.ParseIP("2001:db8::2:1"), "node-a") {
+		t.Errorf("claimed a block in a pool that isn't divided into blocks")
+	}
+}
+
+func TestIPPoolReleaseBlock(t *testing.T) {
+	p := &IPPool{}
+	p.Status.Blocks = []BlockAffinity{
+		{CIDR: "10.2.3.8/30", NodeName: "node-a"},
+		{CIDR: "10.2.3.0/30", NodeName: "node-b"},
+	}
+
+	if p.ReleaseBlock(BlockAffinity{CIDR: "10.2.3.8/30", NodeName: "node-b"}) {
+		t.Errorf("released a block belonging to another node")
+	}
+	if !p.ReleaseBlock(BlockAffinity{CIDR: "10.2.3.8/30", NodeName: "node-a"}) {
+		t.Errorf("block not released")
+	}
+	if len(p.Status.Blocks) != 1 || p.Status.Blocks[0].NodeName != "node-b" {
+		t.Errorf("expected only node-b's block to be left, got %v", p.Status.Blocks)
+	}
+}
+
+func TestIPPoolSpecValidateBlockSize(t *testing.T) {
+	for _, test := range []struct {
+		blockSize int
+		valid     bool
+	}{
+		{0, true},
+		{26, true},
+		{24, true},
+		{32, true},
+		{23, false},
+		{33, false},
+	} {
+		spec := IPPoolSpec{Range: "10.2.3.0/24", NetmaskBits: 24, BlockSize: test.blockSize}
+		if err := spec.Validate(); (err == nil) != test.valid {
+			t.Errorf("block size %d: expected valid to be %t, got %v", test.blockSize, test.valid, err)
+		}
+	}
+}
+
+func TestAddressAfter(t *testing.T) {
+	if next := addressAfter(net.ParseIP("10.2.3.255").To4()); !next.Equal(net.ParseIP("10.2.4.0")) {
+		t.Errorf("expected 10.2.4.0, got %s", next)
+	}
+	if next := addressAfter(net.ParseIP("255.255.255.255").To4()); next != nil {
+		t.Errorf("expected no address after the last IPv4 address, got %s", next)
+	}
+}
@@ -0,0 +1,117 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// IPExclusion is an address, a CIDR or an inclusive start-end range of addresses that are never allocated
+type IPExclusion string
+
+// Range returns the first and last addresses in the exclusion
+func (e IPExclusion) Range() (start, end net.IP, err error) {
+	start, end, err = parseAddressRange(string(e))
+	if err != nil {
+		return nil, nil, fmt.Errorf("exclusion %v", err)
+	}
+	return start, end, nil
+}
+
+// Contains returns true if ip is within the exclusion.  Invalid exclusions contain nothing.
+func (e IPExclusion) Contains(ip net.IP) bool {
+	start, end, err := e.Range()
+	if err != nil {
+		return false
+	}
+	return ipInRange(ip, start, end)
+}
+
+// Excluded returns true if ip is within any of the spec's exclusions
+func (s IPPoolSpec) Excluded(ip net.IP) bool {
+	for _, exclusion := range s.Exclusions {
+		if exclusion.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateExclusions returns errors for exclusions that can't be parsed or aren't in the range's address family
+func (s IPPoolSpec) validateExclusions(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	rangeIsIPv4 := s.AllRanges().IPSizeBits() == 32
+	for i, exclusion := range s.Exclusions {
+		start, _, err := exclusion.Range()
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Index(i), string(exclusion), err.Error()))
+		} else if (start.To4() != nil) != rangeIsIPv4 {
+			allErrs = append(allErrs, field.Invalid(path.Index(i), string(exclusion), "isn't in the same address family as the range"))
+		}
+	}
+	return allErrs
+}
+
+// offsetInterval is an inclusive interval of offsets into a range
+type offsetInterval struct {
+	start, end *big.Int
+}
+
+// size returns the number of offsets in the interval
+func (i offsetInterval) size() *big.Int {
+	size := new(big.Int).Sub(i.end, i.start)
+	return size.Add(size, big.NewInt(1))
+}
+
+// exclusionIntervals returns the parts of the pool's exclusions within its ranges as sorted, non-overlapping intervals
+// of offsets
+func (p *IPPool) exclusionIntervals() []offsetInterval {
+	intervals := make([]offsetInterval, 0, len(p.Spec.Exclusions))
+	base := big.NewInt(0)
+	for _, r := range p.Spec.AllRanges() {
+		rangeStart, _ := r.Bounds()
+		size := r.Size()
+		last := new(big.Int).Sub(size, big.NewInt(1))
+
+		for _, exclusion := range p.Spec.Exclusions {
+			start, end, err := exclusion.Range()
+			if err != nil || (start.To4() == nil) != (rangeStart.To4() == nil) {
+				continue
+			}
+
+			interval := offsetInterval{start: r.Offset(start), end: r.Offset(end)}
+			if interval.end.Sign() < 0 || interval.start.Cmp(last) > 0 {
+				continue
+			}
+			if interval.start.Sign() < 0 {
+				interval.start = big.NewInt(0)
+			}
+			if interval.end.Cmp(last) > 0 {
+				interval.end = new(big.Int).Set(last)
+			}
+			interval.start.Add(interval.start, base)
+			interval.end.Add(interval.end, base)
+			intervals = append(intervals, interval)
+		}
+		base.Add(base, size)
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Cmp(intervals[j].start) < 0
+	})
+
+	merged := make([]offsetInterval, 0, len(intervals))
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && interval.start.Cmp(new(big.Int).Add(merged[n-1].end, big.NewInt(1))) <= 0 {
+			if interval.end.Cmp(merged[n-1].end) > 0 {
+				merged[n-1].end = interval.end
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
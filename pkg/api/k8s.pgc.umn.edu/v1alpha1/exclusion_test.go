@@ -0,0 +1,110 @@
+package v1alpha1
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+func TestIPExclusionContains(t *testing.T) {
+	tests := []struct {
+		exclusion IPExclusion
+		ip        string
+		contains  bool
+	}{
+		{"10.2.3.5", "10.2.3.5", true},
+		{"10.2.3.5", "10.2.3.6", false},
+		{"10.2.3.8/29", "10.2.3.15", true},
+		{"10.2.3.8/29", "10.2.3.16", false},
+		{"10.2.3.10-10.2.3.20", "10.2.3.10", true},
+		{"10.2.3.10-10.2.3.20", "10.2.3.20", true},
+		{"10.2.3.10-10.2.3.20", "10.2.3.21", false},
+		{"2001:db8::10 - 2001:db8::1f", "2001:db8::1a", true},
+		{"2001:db8::/124", "2001:db8::10", false},
+		{"not an address", "10.2.3.5", false},
+	}
+
+	for _, test := range tests {
+		if contains := test.exclusion.Contains(net.ParseIP(test.ip)); contains != test.contains {
+			t.Errorf("%s contains %s: got %t, expected %t", test.exclusion, test.ip, contains, test.contains)
+		}
+	}
+}
+
+func TestIPExclusionRangeErrors(t *testing.T) {
+	for _, exclusion := range []IPExclusion{"10.2.3", "10.2.3.0/33", "10.2.3.20-10.2.3.10", "10.2.3.1-2001:db8::1", "10.2.3.1-"} {
+		if _, _, err := exclusion.Range(); err == nil {
+			t.Errorf("%s: expected an error", exclusion)
+		}
+	}
+}
+
+func TestIPPoolCapacityExclusions(t *testing.T) {
+	tests := []struct {
+		name       string
+		exclusions []IPExclusion
+		capacity   int64
+	}{
+		{"none", nil, 13},
+		{"address", []IPExclusion{"10.2.3.70"}, 12},
+		// the gateway and broadcast address aren't counted twice
+		{"overlapping", []IPExclusion{"10.2.3.64/29", "10.2.3.70-10.2.3.73", "10.2.3.79", "10.2.3.65"}, 5},
+		{"partly outside the range", []IPExclusion{"10.2.3.60-10.2.3.66"}, 12},
+		{"outside the range", []IPExclusion{"10.2.4.0/24", "2001:db8::/64"}, 13},
+	}
+
+	for _, test := range tests {
+		p := &IPPool{}
+		p.Spec.Range = IPRange("10.2.3.64/28")
+		p.Spec.NetmaskBits = 28
+		p.Spec.Gateway = net.ParseIP("10.2.3.65")
+		p.Spec.Exclusions = test.exclusions
+
+		if capacity := p.Capacity(); capacity.Cmp(big.NewInt(test.capacity)) != 0 {
+			t.Errorf("%s: got capacity %v, expected %d", test.name, capacity, test.capacity)
+		}
+	}
+}
+
+func TestIPPoolExclusionsReserved(t *testing.T) {
+	p := testPool(AllocationStrategyRandom)
+	p.Spec.Exclusions = []IPExclusion{"10.2.3.66"}
+
+	excluded := net.ParseIP("10.2.3.66")
+	if !p.AlreadyReserved(excluded) || !p.NewReservationIndex().AlreadyReserved(excluded) {
+		t.Errorf("excluded address not reported as reserved")
+	}
+
+	free := net.ParseIP("10.2.3.67")
+	if p.AlreadyReserved(free) || p.NewReservationIndex().AlreadyReserved(free) {
+		t.Errorf("address outside the exclusions reported as reserved")
+	}
+}
+
+func TestIPPoolSpecValidateExclusions(t *testing.T) {
+	tests := []struct {
+		name       string
+		exclusions []IPExclusion
+		static     string
+		valid      bool
+	}{
+		{"valid", []IPExclusion{"10.2.3.66", "10.2.3.70-10.2.3.72", "10.2.3.76/30"}, "10.2.3.68", true},
+		{"unparseable", []IPExclusion{"10.2.3.300"}, "", false},
+		{"wrong family", []IPExclusion{"2001:db8::1"}, "", false},
+		{"static reservation excluded", []IPExclusion{"10.2.3.70-10.2.3.72"}, "10.2.3.71", false},
+	}
+
+	for _, test := range tests {
+		p := testPool(AllocationStrategyRandom)
+		p.Spec.Range = IPRange("10.2.3.64/28")
+		p.Spec.Exclusions = test.exclusions
+		if test.static != "" {
+			p.Spec.StaticReservations = NewIPReservationMap()
+			p.Spec.StaticReservations.Reserve("foo", "web", "", IPReservation{IP: net.ParseIP(test.static)})
+		}
+
+		if err := p.Spec.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package v1alpha1
+
+import (
+	"math/big"
+	"net"
+	"time"
+)
+
+// maxBitmapHostBits is the largest pool, in host bits, that a ReservationIndex keeps a bitmap for.  Ranges totalling
+// 2^20 addresses need a 128KiB bitmap.
+const maxBitmapHostBits = 20
+
+// ReservationOwner identifies the pod interface holding a reservation
+type ReservationOwner struct {
+	Namespace string
+	PodName   string
+	IfName    string
+	Static    bool
+}
+
+// ReservationIndex answers reservation lookups for a pool without scanning every reservation.  It's a snapshot of the
+// pool when it was built.
+type ReservationIndex struct {
+	// ranges holds the first and last address of each of the pool's ranges
+	ranges  [][2]net.IP
+	gateway net.IP
+	owners  map[string]ReservationOwner
+	// reserved has a bit set for each reserved offset in the ranges, including the gateway.  It's nil for large ranges.
+	reserved []uint64
+	// released holds when each quarantined address was released
+	released map[string]time.Time
+	// exclusions holds the first and last address of each valid exclusion
+	exclusions [][2]net.IP
+}
+
+// NewReservationIndex indexes the pool's static and dynamic reservations.  Static reservations take precedence over
+// dynamic reservations for the same address, as they do in GetPodForIP.
+func (p *IPPool) NewReservationIndex() *ReservationIndex {
+	index := &ReservationIndex{
+		gateway: p.Spec.Gateway,
+		owners:  make(map[string]ReservationOwner),
+	}
+
+	ranges := p.Spec.AllRanges()
+	for _, r := range ranges {
+		if start, end := r.Bounds(); start != nil {
+			index.ranges = append(index.ranges, [2]net.IP{start, end})
+		}
+	}
+
+	if size := ranges.Size(); size.Cmp(big.NewInt(1<<maxBitmapHostBits)) <= 0 {
+		index.reserved = make([]uint64, (size.Uint64()+63)/64)
+	}
+
+	index.released = make(map[string]time.Time)
+	now := time.Now()
+	for _, entry := range p.Status.Quarantine {
+		if released, quarantined := p.Quarantined(entry.IP, now); quarantined {
+			index.released[indexKey(entry.IP)] = released
+		}
+	}
+
+	for _, exclusion := range p.Spec.Exclusions {
+		if start, end, err := exclusion.Range(); err == nil {
+			index.exclusions = append(index.exclusions, [2]net.IP{start, end})
+		}
+	}
+
+	index.add(p.Status.DynamicReservations, false)
+	index.add(p.Spec.StaticReservations, true)
+	if p.Spec.Gateway != nil && index.contains(p.Spec.Gateway) {
+		index.mark(p.Spec.Gateway)
+	}
+	return index
+}
+
+func (i *ReservationIndex) add(m IPReservationMap, static bool) {
+	for namespace, nsMap := range m {
+		for key, reservation := range nsMap {
+			podName, ifName := ParseReservationKey(key)
+			i.reserve(ReservationOwner{Namespace: namespace, PodName: podName, IfName: ifName, Static: static}, reservation.IP)
+		}
+	}
+}
+
+func (i *ReservationIndex) reserve(owner ReservationOwner, ip net.IP) {
+	if ip == nil || !i.contains(ip) {
+		return
+	}
+	i.owners[indexKey(ip)] = owner
+	i.mark(ip)
+}
+
+func (i *ReservationIndex) mark(ip net.IP) {
+	if i.reserved == nil {
+		return
+	}
+	offset := i.offset(ip)
+	i.reserved[offset/64] |= 1 << (offset % 64)
+}
+
+// contains returns true if ip is within any of the pool's ranges
+func (i *ReservationIndex) contains(ip net.IP) bool {
+	for _, r := range i.ranges {
+		if ipInRange(ip, r[0], r[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// offset returns the position of ip from the start of the first range, counting through each range in turn.  Only
+// valid for pools small enough for a bitmap.
+func (i *ReservationIndex) offset(ip net.IP) uint64 {
+	var base uint64
+	for _, r := range i.ranges {
+		if ipInRange(ip, r[0], r[1]) {
+			return base + low64(ip) - low64(r[0])
+		}
+		base += low64(r[1]) - low64(r[0]) + 1
+	}
+	return base
+}
+
+// GetPodForIP returns the owner of the reservation for ip, with the same results as IPPool.GetPodForIP
+func (i *ReservationIndex) GetPodForIP(ip net.IP) (namespace, podName, ifName string, found bool) {
+	owner, found := i.Owner(ip)
+	return owner.Namespace, owner.PodName, owner.IfName, found
+}
+
+// Owner returns the owner of the reservation for ip, including whether the reservation is static
+func (i *ReservationIndex) Owner(ip net.IP) (ReservationOwner, bool) {
+	if i.gateway.Equal(ip) {
+		return ReservationOwner{}, false
+	}
+
+	owner, found := i.owners[indexKey(ip)]
+	return owner, found
+}
+
+// AlreadyReserved returns true if ip is the gateway, excluded or reserved by any pod, with the same results as
+// IPPool.AlreadyReserved
+func (i *ReservationIndex) AlreadyReserved(ip net.IP) bool {
+	if !i.contains(ip) {
+		return false
+	}
+
+	for _, exclusion := range i.exclusions {
+		if ipInRange(ip, exclusion[0], exclusion[1]) {
+			return true
+		}
+	}
+
+	if i.reserved != nil {
+		offset := i.offset(ip)
+		return i.reserved[offset/64]&(1<<(offset%64)) != 0
+	}
+
+	if i.gateway.Equal(ip) {
+		return true
+	}
+	_, found := i.owners[indexKey(ip)]
+	return found
+}
+
+// Quarantined returns true, along with when it was released, if ip was within the pool's reuse cooldown when the
+// index was built
+func (i *ReservationIndex) Quarantined(ip net.IP) (released time.Time, quarantined bool) {
+	released, quarantined = i.released[indexKey(ip)]
+	return released, quarantined
+}
+
+// indexKey returns the same key for the IPv4 and IPv6 forms of an address
+func indexKey(ip net.IP) string {
+	return string(ip.To16())
+}
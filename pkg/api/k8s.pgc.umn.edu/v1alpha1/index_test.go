@@ -0,0 +1,112 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+)
+
+// indexTestPool returns a pool with count dynamic reservations following the network address
+func indexTestPool(r IPRange, netmaskBits int, count int) *IPPool {
+	p := &IPPool{}
+	p.Spec.Range = r
+	p.Spec.NetmaskBits = netmaskBits
+	for i := 0; i < count; i++ {
+		ip := r.AddressAt(big.NewInt(int64(i + 1)))
+		p.Reserve(fmt.Sprintf("ns-%d", i%10), fmt.Sprintf("pod-%d", i), "eth0", IPReservation{IP: ip})
+	}
+	return p
+}
+
+func TestReservationIndex(t *testing.T) {
+	for _, test := range []struct {
+		r           IPRange
+		netmaskBits int
+	}{
+		{"10.2.3.0/24", 24},
+		{"2001:db8::/64", 64},
+	} {
+		p := indexTestPool(test.r, test.netmaskBits, 100)
+		p.Spec.Gateway = test.r.AddressAt(big.NewInt(1))
+		p.Spec.StaticReservations = NewIPReservationMap()
+		p.Spec.StaticReservations.Reserve("static", "web", "", IPReservation{IP: test.r.AddressAt(big.NewInt(200))})
+		// a static reservation for an address also held dynamically takes precedence
+		p.Spec.StaticReservations.Reserve("static", "db", "", IPReservation{IP: test.r.AddressAt(big.NewInt(50))})
+		// a dynamic reservation for the gateway isn't reported
+		p.Reserve("foo", "gateway", "eth0", IPReservation{IP: p.Spec.Gateway})
+		p.Reserve("foo", "outside", "eth0", IPReservation{IP: net.ParseIP("192.168.0.1")})
+
+		index := p.NewReservationIndex()
+		for offset := int64(0); offset < 256; offset++ {
+			ip := test.r.AddressAt(big.NewInt(offset))
+
+			ns, podName, ifName, found := p.GetPodForIP(ip)
+			indexNS, indexPodName, indexIfName, indexFound := index.GetPodForIP(ip)
+			if ns != indexNS || podName != indexPodName || ifName != indexIfName || found != indexFound {
+				t.Errorf("%s: index returned %s/%s/%s %t for %s, expected %s/%s/%s %t", test.r, indexNS, indexPodName, indexIfName, indexFound, ip, ns, podName, ifName, found)
+			}
+
+			if owner, _ := index.Owner(ip); owner.Static != (found && p.Spec.StaticReservations.AlreadyReserved(ip)) {
+				t.Errorf("%s: index returned %t for %s being statically reserved", test.r, owner.Static, ip)
+			}
+
+			if reserved := p.AlreadyReserved(ip); index.AlreadyReserved(ip) != reserved {
+				t.Errorf("%s: index returned %t for %s being reserved, expected %t", test.r, !reserved, ip, reserved)
+			}
+		}
+
+		outside := net.ParseIP("192.168.0.1")
+		if _, _, _, found := index.GetPodForIP(outside); found || index.AlreadyReserved(outside) {
+			t.Errorf("%s: reservation outside the range was indexed", test.r)
+		}
+	}
+}
+
+func BenchmarkGetPodForIP(b *testing.B) {
+	for _, count := range []int{10000, 50000} {
+		p := indexTestPool("10.2.0.0/16", 16, count)
+		free := p.Spec.Range.AddressAt(big.NewInt(int64(count + 1)))
+
+		b.Run(fmt.Sprintf("pool/%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p.GetPodForIP(free)
+			}
+		})
+
+		b.Run(fmt.Sprintf("index/%d", count), func(b *testing.B) {
+			index := p.NewReservationIndex()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				index.GetPodForIP(free)
+			}
+		})
+	}
+}
+
+// BenchmarkLowestFree finds the first free address after count reservations, probing each reserved address on the way
+func BenchmarkLowestFree(b *testing.B) {
+	for _, count := range []int{10000, 50000} {
+		p := indexTestPool("10.2.0.0/16", 16, count)
+		p.Spec.AllocationStrategy = AllocationStrategyLowestFree
+
+		if count <= 10000 {
+			b.Run(fmt.Sprintf("pool/%d", count), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					strategy := p.NewAllocationStrategy("foo", "bar")
+					for ip := strategy.Next(); p.AlreadyReserved(ip) || !p.HostAddress(ip); ip = strategy.Next() {
+					}
+				}
+			})
+		}
+
+		b.Run(fmt.Sprintf("index/%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				strategy := p.NewAllocationStrategy("foo", "bar")
+				index := p.NewReservationIndex()
+				for ip := strategy.Next(); index.AlreadyReserved(ip) || !p.HostAddress(ip); ip = strategy.Next() {
+				}
+			}
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package v1alpha1
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/big"
+	"math/bits"
 	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/azenk/iputils"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -30,25 +36,86 @@ type IPPool struct {
 }
 
 type IPPoolSpec struct {
-	Range              IPRange          `json:"range"`
+	Range IPRange `json:"range,omitempty"`
+	// Ranges are allocated from along with Range.  They must not overlap, and all must be on the subnet given by
+	// NetmaskBits.
+	Ranges             []IPRange        `json:"ranges,omitempty"`
 	NetmaskBits        int              `json:"netmaskBits"`
 	Gateway            net.IP           `json:"gateway"`
 	StaticReservations IPReservationMap `json:"staticReservations"`
+	// Exclusions are addresses within the range that are never allocated, such as routers and virtual IPs
+	Exclusions []IPExclusion `json:"exclusions,omitempty"`
+	// Routes are added to the result for every address allocated from this pool
+	Routes []Route `json:"routes,omitempty"`
+	// DisableDefaultRoute suppresses the default route through Gateway
+	DisableDefaultRoute bool `json:"disableDefaultRoute,omitempty"`
+	DNS                 DNS  `json:"dns,omitempty"`
+	// AllocationStrategy is one of the AllocationStrategy* values, random is used if it's empty
+	AllocationStrategy string `json:"allocationStrategy,omitempty"`
+	// ReuseCooldown is how long a freed address is quarantined before it's allocated again, unless the pool is
+	// otherwise exhausted.  Addresses are reused immediately if it's unset.
+	ReuseCooldown *metav1.Duration `json:"reuseCooldown,omitempty"`
+	// BlockSize is the prefix length of the blocks the pool is divided into, such as 26 for IPv4 or 120 for IPv6.
+	// A node claims a block the first time it allocates from it, and allocates from its own blocks before claiming
+	// another.  The pool isn't divided into blocks if it's zero.
+	BlockSize int `json:"blockSize,omitempty"`
+	// BorrowBlocks lets a node allocate from blocks claimed by other nodes once its own blocks are full and every
+	// block is claimed.  Otherwise allocation fails once there are no free addresses in blocks the node may use.
+	BorrowBlocks bool `json:"borrowBlocks,omitempty"`
+	// NodeSelector limits the nodes the pool is chosen for when the plugin selects a pool by node topology.  The pool
+	// matches every node if it's unset.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	// AllowedNamespaces and NamespaceSelector limit the namespaces whose pods may allocate from the pool.  A namespace
+	// is allowed if it's listed or its labels match the selector.  Every namespace is allowed if neither is set.
+	AllowedNamespaces []string              `json:"allowedNamespaces,omitempty"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// SelectorReservations set addresses aside for the pods matching a label selector, such as a Deployment's pods
+	SelectorReservations []SelectorReservation `json:"selectorReservations,omitempty"`
+}
+
+// Route is a route to Destination via Gateway.  The pool's gateway is used if Gateway is empty.
+type Route struct {
+	Destination IPRange `json:"dst"`
+	Gateway     net.IP  `json:"gw,omitempty"`
+}
+
+// DNS is the resolver configuration for pods with an address from the pool
+type DNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
 }
 
 type IPPoolStatus struct {
 	DynamicReservations IPReservationMap
+	// LastAllocated is the address most recently reserved, where the sequential strategy continues from
+	LastAllocated net.IP `json:"lastAllocated,omitempty"`
+	// Quarantine holds addresses freed within the pool's reuse cooldown
+	Quarantine []QuarantinedAddress `json:"quarantine,omitempty"`
+	// Blocks holds the node each claimed block belongs to
+	Blocks []BlockAffinity `json:"blocks,omitempty"`
+}
+
+// QuarantinedAddress is a freed address, when it was released and the pod that released it
+type QuarantinedAddress struct {
+	IP        net.IP      `json:"ip"`
+	Released  metav1.Time `json:"released"`
+	Namespace string      `json:"namespace,omitempty"`
+	PodName   string      `json:"podName,omitempty"`
 }
 
 // GetMask returns the netmask for ips allocated in this range
 func (s *IPPoolSpec) GetMask() net.IPMask {
-	bits := s.Range.IPSizeBits()
+	bits := s.AllRanges().IPSizeBits()
 	return net.CIDRMask(s.NetmaskBits, bits)
 }
 
+// IPRange is a CIDR, or an inclusive start-end range of addresses such as 10.2.3.10-10.2.3.50
 type IPRange string
 
-// AsNet returns the range as a net.IPNet struct.  *Any parse errors are silently ignored.*
+// AsNet returns the range as a net.IPNet struct.  *Any parse errors are silently ignored.*  Returns nil for start-end
+// ranges.
 func (r IPRange) AsNet() *net.IPNet {
 	_, network, _ := net.ParseCIDR(string(r))
 	return network
@@ -56,188 +123,614 @@ func (r IPRange) AsNet() *net.IPNet {
 
 // IPSizeBits returns the number of bits required for IPs in this range
 func (r IPRange) IPSizeBits() int {
-	_, bits := r.AsNet().Mask.Size()
-	return bits
+	start, _ := r.Bounds()
+	return len(start) * 8
 }
 
-// RangeMaskBits returns the number of bits in the pre-allocated portion of this IPRange
+// RangeMaskBits returns the number of leading bits shared by every address in this IPRange
 func (r IPRange) RangeMaskBits() int {
-	ones, _ := r.AsNet().Mask.Size()
-	return ones
+	start, end := r.Bounds()
+	for i := range start {
+		if diff := start[i] ^ end[i]; diff != 0 {
+			return i*8 + bits.LeadingZeros8(diff)
+		}
+	}
+	return len(start) * 8
 }
 
 // Validate Returns nil if IPRange can be parsed
 func (r IPRange) Validate() error {
-	_, _, err := net.ParseCIDR(string(r))
+	_, _, err := parseAddressRange(string(r))
 	return err
 }
 
-// RangeContains returns true if ip is within the range allocated from this pool
+// RangeContains returns true if ip is within any of the ranges allocated from this pool
 func (p IPPool) RangeContains(ip net.IP) bool {
-	return p.Spec.Range.AsNet().Contains(ip)
+	return p.Spec.AllRanges().Contains(ip)
 }
 
-// GetExistingReservation checks if a reservation for this pod exists, if so return the IP
-func (p *IPPool) GetExistingReservation(namespace, podName string) *net.IP {
+// GetExistingReservation checks if a reservation for this pod's interface exists, if so return the IP
+func (p *IPPool) GetExistingReservation(namespace, podName, ifName string) *net.IP {
+	if reservation := p.GetReservation(namespace, podName, ifName); reservation != nil {
+		return &reservation.IP
+	}
+	return nil
+}
+
+// GetReservation returns the static or dynamic reservation for this pod's interface, or nil if there isn't one
+func (p *IPPool) GetReservation(namespace, podName, ifName string) *IPReservation {
 	if p.Spec.StaticReservations != nil {
-		if staticIP := p.Spec.StaticReservations.GetExistingReservation(namespace, podName); staticIP != nil {
-			return staticIP
+		if reservation := p.Spec.StaticReservations.GetReservation(namespace, podName, ifName); reservation != nil {
+			return reservation
 		}
 	}
 
 	if p.Status.DynamicReservations == nil {
 		return nil
 	}
-	return p.Status.DynamicReservations.GetExistingReservation(namespace, podName)
+	return p.Status.DynamicReservations.GetReservation(namespace, podName, ifName)
 }
 
-func (p *IPPool) RandomIP() net.IP {
-	rand.Seed(time.Now().UnixNano())
-	allocationRange := p.Spec.Range.AsNet()
-	ones, bits := allocationRange.Mask.Size()
-	hostBits := bits - ones
+// ClaimDynamicReservation records the owner of claim on the existing dynamic reservation for this pod's interface.
+// Returns true if the pool was modified.
+func (p *IPPool) ClaimDynamicReservation(namespace, podName, ifName string, claim IPReservation) bool {
+	if p.Status.DynamicReservations == nil {
+		return false
+	}
+	return p.Status.DynamicReservations.ClaimReservation(namespace, podName, ifName, claim)
+}
 
-	randomBits := rand.Uint64()
-	randIp, _ := iputils.SetBits(allocationRange.IP, randomBits, uint(ones), uint(hostBits))
-	return randIp
+// RandomIP returns a random address from the pool's ranges
+func (p *IPPool) RandomIP() net.IP {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ranges := p.Spec.AllRanges()
+	return ranges.AddressAt(new(big.Int).Rand(random, ranges.Size()))
 }
 
 func (p *IPPool) Gateway() net.IP {
 	return p.Spec.Gateway
 }
 
-// AlreadyReserved checks the pool to see if the IP is reserved by any pod.  Returns false if IP is not contained in the pool.
+// RouteGateway returns the gateway for a route, falling back to the pool's gateway
+func (p *IPPool) RouteGateway(route Route) net.IP {
+	if route.Gateway != nil {
+		return route.Gateway
+	}
+	return p.Gateway()
+}
+
+// HostAddress returns false for the network address of the pool's subnet, and the broadcast address of IPv4 subnets.
+// These can't be assigned to a pod.
+func (p *IPPool) HostAddress(ip net.IP) bool {
+	for _, address := range p.nonHostAddresses() {
+		if address.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// nonHostAddresses returns the network address of the pool's subnet, and the broadcast address of IPv4 subnets.  IPv4
+// subnets of /31 and longer have no such addresses.
+func (p *IPPool) nonHostAddresses() []net.IP {
+	bits := p.Spec.AllRanges().IPSizeBits()
+	if bits == 32 && p.Spec.NetmaskBits >= 31 {
+		return nil
+	}
+
+	subnet := p.Spec.subnet()
+	network := subnet.IP
+	if bits != 32 {
+		return []net.IP{network}
+	}
+
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^subnet.Mask[i]
+	}
+	return []net.IP{network, broadcast}
+}
+
+// Capacity returns the number of addresses in the ranges that can be allocated dynamically: every host address, less
+// the gateway, static reservations and exclusions.
+func (p *IPPool) Capacity() *big.Int {
+	capacity := p.Spec.AllRanges().Size()
+	for _, interval := range p.exclusionIntervals() {
+		capacity.Sub(capacity, interval.size())
+	}
+	return capacity.Sub(capacity, big.NewInt(int64(len(p.unallocatable()))))
+}
+
+// Available returns the number of addresses in the range that can be allocated dynamically and aren't reserved
+func (p *IPPool) Available() *big.Int {
+	unallocatable := p.unallocatable()
+	reserved := make(map[string]bool)
+	for _, nsMap := range p.Status.DynamicReservations {
+		for _, reservation := range nsMap {
+			ip := reservation.IP.String()
+			if p.RangeContains(reservation.IP) && !unallocatable[ip] && !p.Spec.Excluded(reservation.IP) {
+				reserved[ip] = true
+			}
+		}
+	}
+
+	available := p.Capacity()
+	return available.Sub(available, big.NewInt(int64(len(reserved))))
+}
+
+// unallocatable returns the addresses in the range outside its exclusions that are never allocated dynamically, keyed
+// by their string form
+func (p *IPPool) unallocatable() map[string]bool {
+	addresses := make(map[string]bool)
+	add := func(ip net.IP) {
+		if ip != nil && p.RangeContains(ip) && !p.Spec.Excluded(ip) {
+			addresses[ip.String()] = true
+		}
+	}
+
+	for _, ip := range p.nonHostAddresses() {
+		add(ip)
+	}
+	add(p.Spec.Gateway)
+	for _, nsMap := range p.Spec.StaticReservations {
+		for _, reservation := range nsMap {
+			add(reservation.IP)
+		}
+	}
+	return addresses
+}
+
+// AlreadyReserved checks the pool to see if the IP is the gateway, excluded or reserved by any pod.  Returns false if
+// IP is not contained in the pool.
 func (p *IPPool) AlreadyReserved(ip net.IP) bool {
 	if !p.RangeContains(ip) {
 		return false
 	}
 
-	if p.Spec.Gateway.Equal(ip) {
+	if p.Spec.Gateway.Equal(ip) || p.Spec.Excluded(ip) {
 		return true
 	}
 
-	_, _, reserved := p.GetPodForIP(ip)
+	_, _, _, reserved := p.GetPodForIP(ip)
 
 	return reserved
 }
 
-// GetPodForIP returns the namespace and pod name for the pod associated with a reservation.  found is set to false if no pod is found.
-func (p *IPPool) GetPodForIP(ip net.IP) (namespace, podName string, found bool) {
+// GetPodForIP returns the namespace, pod name and interface for the pod associated with a reservation.  ifName is empty
+// for reservations that aren't tied to an interface.  found is set to false if no pod is found.
+func (p *IPPool) GetPodForIP(ip net.IP) (namespace, podName, ifName string, found bool) {
 	if !p.RangeContains(ip) {
-		return "", "", false
+		return "", "", "", false
 	}
 
 	if p.Spec.Gateway.Equal(ip) {
-		return "", "", false
+		return "", "", "", false
 	}
 
 	if p.Spec.StaticReservations != nil {
-		namespace, podName, found := p.Spec.StaticReservations.GetPodForIP(ip)
+		namespace, podName, ifName, found := p.Spec.StaticReservations.GetPodForIP(ip)
 		if found {
-			return namespace, podName, true
+			return namespace, podName, ifName, true
 		}
 	}
 
 	if p.Status.DynamicReservations != nil {
-		namespace, podName, found := p.Status.DynamicReservations.GetPodForIP(ip)
+		namespace, podName, ifName, found := p.Status.DynamicReservations.GetPodForIP(ip)
 		if found {
-			return namespace, podName, true
+			return namespace, podName, ifName, true
 		}
 	}
 
-	return "", "", false
+	return "", "", "", false
 }
 
-func (p *IPPool) Reserve(namespace, podName string, ip net.IP) {
+func (p *IPPool) Reserve(namespace, podName, ifName string, reservation IPReservation) {
 	if p.Status.DynamicReservations == nil {
 		p.Status.DynamicReservations = NewIPReservationMap()
 	}
-	p.Status.DynamicReservations.Reserve(namespace, podName, ip)
+	p.Status.DynamicReservations.Reserve(namespace, podName, ifName, reservation)
+	p.Status.LastAllocated = reservation.IP
+	p.unquarantine(reservation.IP)
 }
 
-// FreeDynamicPodReservation removes any existing dynamic reservations for a given pod
-func (p *IPPool) FreeDynamicPodReservation(namespace, podName string) {
+// FreeDynamicPodReservation removes the dynamic reservation for a given pod's interface if it belongs to containerID.
+// An empty containerID frees the reservation regardless of its sandbox.  Freed addresses are quarantined if the pool
+// has a reuse cooldown.  Returns true if a reservation was freed.
+func (p *IPPool) FreeDynamicPodReservation(namespace, podName, ifName, containerID string) bool {
 	if p.Status.DynamicReservations == nil {
-		return
+		return false
 	}
 
-	p.Status.DynamicReservations.FreePodReservation(namespace, podName)
+	freed := p.Status.DynamicReservations.freePodReservation(namespace, podName, ifName, containerID)
+	now := metav1.Now()
+	for _, reservation := range freed {
+		p.quarantine(QuarantinedAddress{IP: reservation.IP, Released: now, Namespace: namespace, PodName: podName})
+	}
+	return len(freed) > 0
 }
 
-// Validate returns nil if there are no obvious errors in IP Pool configuration
+// Validate returns nil if there are no obvious errors in IP Pool configuration, otherwise an aggregate of every error
+// found, each naming the field at fault
 func (s IPPoolSpec) Validate() error {
-	// Range is valid
-	if err := s.Range.Validate(); err != nil {
-		return fmt.Errorf("IP range is invalid (%v), please check your syntax: %v", s.Range, err)
+	return s.ValidateFields(field.NewPath("spec")).ToAggregate()
+}
+
+// ValidateFields returns every error found in the spec, with field paths relative to path
+func (s IPPoolSpec) ValidateFields(path *field.Path) field.ErrorList {
+	// Ranges are valid, don't overlap and are within the netmask.  The checks on addresses below rely on them.
+	allErrs := s.validateRanges(path)
+	if len(allErrs) == 0 {
+		allErrs = append(allErrs, s.validateGatewayAndRoutes(path)...)
+		allErrs = append(allErrs, s.validateBlockSize(path.Child("blockSize"))...)
+		allErrs = append(allErrs, s.validateExclusions(path.Child("exclusions"))...)
+		allErrs = append(allErrs, s.validateSelectorReservations(path.Child("selectorReservations"))...)
+		allErrs = append(allErrs, s.validateStaticReservations(path.Child("staticReservations"))...)
 	}
 
-	// NetmaskBits are valid and less than or equal to Range Bits
-	if s.NetmaskBits < 0 || s.NetmaskBits > s.Range.IPSizeBits() {
-		return fmt.Errorf("specified netmask is invalid")
+	if err := ValidateAllocationStrategy(s.AllocationStrategy); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("allocationStrategy"), s.AllocationStrategy, err.Error()))
 	}
 
-	if s.NetmaskBits > s.Range.RangeMaskBits() {
-		return fmt.Errorf("specified netmask doesn't completely contain the Range.  Please adjust.")
+	if s.ReuseCooldown != nil && s.ReuseCooldown.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("reuseCooldown"), s.ReuseCooldown.Duration.String(), "reuse cooldown must not be negative"))
 	}
 
-	// Gateway must be within specified network
-	containingNetwork := net.IPNet{
-		IP:   s.Range.AsNet().IP,
-		Mask: net.CIDRMask(s.NetmaskBits, s.Range.IPSizeBits()),
+	allErrs = append(allErrs, s.validateSelectors(path)...)
+
+	for i, nameserver := range s.DNS.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("dns", "nameservers").Index(i), nameserver, "nameserver is not a valid ip address"))
+		}
 	}
+
+	return allErrs
+}
+
+// validateGatewayAndRoutes returns errors if the gateway, or a route's gateway, isn't on the pool's subnet, or a
+// route's destination is invalid
+func (s IPPoolSpec) validateGatewayAndRoutes(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	// Gateway must be within specified network
+	containingNetwork := s.subnet()
 	if s.Gateway != nil && !containingNetwork.Contains(s.Gateway) {
-		return fmt.Errorf("Gateway must be on the subnet that includes this range.")
+		allErrs = append(allErrs, field.Invalid(path.Child("gateway"), s.Gateway.String(), "gateway must be on the subnet that includes this range"))
 	}
 
-	return nil
+	for i, route := range s.Routes {
+		routePath := path.Child("routes").Index(i)
+		if _, _, err := net.ParseCIDR(string(route.Destination)); err != nil {
+			allErrs = append(allErrs, field.Invalid(routePath.Child("dst"), string(route.Destination), err.Error()))
+		} else if route.Destination.IPSizeBits() != s.AllRanges().IPSizeBits() {
+			allErrs = append(allErrs, field.Invalid(routePath.Child("dst"), string(route.Destination), "isn't in the same address family as the range"))
+		}
+
+		if route.Gateway != nil && !containingNetwork.Contains(route.Gateway) {
+			allErrs = append(allErrs, field.Invalid(routePath.Child("gw"), route.Gateway.String(), "route gateway must be on the subnet that includes this range"))
+		}
+	}
+	return allErrs
 }
 
-type IPReservationMap map[string]map[string]net.IP
+// validateStaticReservations returns errors for static reservations outside the pool's ranges, on the gateway,
+// excluded or sharing an address with another static reservation, and for namespaces that may not hold them
+func (s IPPoolSpec) validateStaticReservations(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	ranges := s.AllRanges()
+	holders := make(map[string]string)
+	s.StaticReservations.each(func(namespace, key string, reservation IPReservation) {
+		reservationPath := path.Key(namespace).Key(key)
+		ip := reservation.IP.String()
+		switch {
+		case reservation.IP == nil:
+			allErrs = append(allErrs, field.Required(reservationPath, "an address is required"))
+			return
+		case !ranges.Contains(reservation.IP):
+			allErrs = append(allErrs, field.Invalid(reservationPath, ip, "isn't within the pool's ranges"))
+		case s.Gateway.Equal(reservation.IP):
+			allErrs = append(allErrs, field.Invalid(reservationPath, ip, "is the pool's gateway"))
+		case s.Excluded(reservation.IP):
+			allErrs = append(allErrs, field.Invalid(reservationPath, ip, "is excluded"))
+		}
+
+		if holder, found := holders[ip]; found {
+			allErrs = append(allErrs, field.Invalid(reservationPath, ip, fmt.Sprintf("is also statically reserved for %s", holder)))
+		} else {
+			holders[ip] = namespace + "/" + key
+		}
+	})
+
+	// Namespace labels aren't known here, so namespaces the selector might allow are accepted
+	if s.NamespaceSelector == nil {
+		for _, namespace := range s.StaticReservations.namespaces() {
+			if !s.AllowsNamespace(namespace, nil) {
+				allErrs = append(allErrs, field.Forbidden(path.Key(namespace), "namespace isn't one of the pool's allowed namespaces"))
+			}
+		}
+	}
+	return allErrs
+}
+
+// Validate returns nil if there are no obvious errors in the pool's spec and none of its dynamic reservations
+// conflict with its static reservations, otherwise an aggregate of every error found
+func (p *IPPool) Validate() error {
+	allErrs := p.Spec.ValidateFields(field.NewPath("spec"))
+	allErrs = append(allErrs, p.validateDynamicReservations(field.NewPath("status", "DynamicReservations"))...)
+	return allErrs.ToAggregate()
+}
+
+// validateDynamicReservations returns errors for dynamic reservations of an address statically reserved for another
+// pod, and for pods holding a dynamic reservation as well as a static one
+func (p *IPPool) validateDynamicReservations(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	p.Status.DynamicReservations.each(func(namespace, key string, reservation IPReservation) {
+		for _, conflict := range p.staticConflicts(namespace, key, reservation) {
+			allErrs = append(allErrs, field.Invalid(path.Key(namespace).Key(key), reservation.IP.String(), conflict))
+		}
+	})
+	return allErrs
+}
+
+// DropConflictingReservations removes the dynamic reservations that conflict with static ones, left over from before
+// the static reservation was added.  The addresses aren't quarantined, they're still in use by the static
+// reservations.  Returns true if any were removed.
+func (p *IPPool) DropConflictingReservations() bool {
+	dropped := false
+	p.Status.DynamicReservations.each(func(namespace, key string, reservation IPReservation) {
+		if len(p.staticConflicts(namespace, key, reservation)) == 0 {
+			return
+		}
+		delete(p.Status.DynamicReservations[namespace], key)
+		if len(p.Status.DynamicReservations[namespace]) == 0 {
+			delete(p.Status.DynamicReservations, namespace)
+		}
+		dropped = true
+	})
+	return dropped
+}
+
+// staticConflicts returns how the dynamic reservation stored under key conflicts with the static reservations: the
+// pod also has a static reservation, or the address is statically reserved for another pod
+func (p *IPPool) staticConflicts(namespace, key string, reservation IPReservation) []string {
+	conflicts := make([]string, 0)
+	podName, ifName := ParseReservationKey(key)
+	if static := p.Spec.StaticReservations.GetReservation(namespace, podName, ifName); static != nil {
+		conflicts = append(conflicts, fmt.Sprintf("pod also has a static reservation for %s", static.IP))
+	}
+
+	if staticNS, staticPod, staticIf, found := p.Spec.StaticReservations.GetPodForIP(reservation.IP); found && (staticNS != namespace || staticPod != podName) {
+		conflicts = append(conflicts, fmt.Sprintf("is statically reserved for %s/%s", staticNS, ReservationKey(staticPod, staticIf)))
+	}
+	return conflicts
+}
+
+// IPReservation is an address reserved for a pod's interface along with the pod, node and sandbox it was reserved for.
+type IPReservation struct {
+	IP          net.IP       `json:"ip"`
+	PodUID      types.UID    `json:"podUID,omitempty"`
+	NodeName    string       `json:"nodeName,omitempty"`
+	ContainerID string       `json:"containerID,omitempty"`
+	Interface   string       `json:"interface,omitempty"`
+	Created     *metav1.Time `json:"created,omitempty"`
+	// LastSeen is the last time the reservation was allocated or claimed by a sandbox
+	LastSeen *metav1.Time `json:"lastSeen,omitempty"`
+}
+
+// MatchesContainer returns true if the reservation belongs to containerID.  Reservations that don't record a sandbox,
+// and an empty containerID, match any sandbox.
+func (r IPReservation) MatchesContainer(containerID string) bool {
+	return r.ContainerID == "" || containerID == "" || r.ContainerID == containerID
+}
+
+// claim records the pod, node, sandbox and interface of owner on the reservation, along with its last seen time.  The
+// address and creation time are kept.  Returns true if the reservation changed.
+func (r *IPReservation) claim(owner IPReservation) bool {
+	changed := r.PodUID != owner.PodUID || r.NodeName != owner.NodeName || r.ContainerID != owner.ContainerID ||
+		r.Interface != owner.Interface || !r.LastSeen.Equal(owner.LastSeen)
+	r.PodUID = owner.PodUID
+	r.NodeName = owner.NodeName
+	r.ContainerID = owner.ContainerID
+	r.Interface = owner.Interface
+	r.LastSeen = owner.LastSeen
+	return changed
+}
+
+// MarshalJSON writes reservations holding nothing but an address as a bare IP, the format used by static reservations
+// and by pools created before reservations recorded their owner.
+func (r IPReservation) MarshalJSON() ([]byte, error) {
+	if r.PodUID == "" && r.NodeName == "" && r.ContainerID == "" && r.Interface == "" && r.Created == nil && r.LastSeen == nil {
+		return json.Marshal(r.IP)
+	}
+
+	type reservation IPReservation
+	return json.Marshal(reservation(r))
+}
+
+// UnmarshalJSON accepts either a reservation object or a bare IP.
+func (r *IPReservation) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*r = IPReservation{}
+		return json.Unmarshal(data, &r.IP)
+	}
+
+	type reservation IPReservation
+	return json.Unmarshal(data, (*reservation)(r))
+}
+
+// IPReservationMap holds reservations by namespace, then by the key returned by ReservationKey.
+type IPReservationMap map[string]map[string]IPReservation
 
 func NewIPReservationMap() IPReservationMap {
-	return make(map[string]map[string]net.IP)
+	return make(map[string]map[string]IPReservation)
 }
 
-func (m IPReservationMap) GetExistingReservation(namespace, podName string) *net.IP {
+// ReservationKey returns the key for a pod's reservation on an interface.  Reservations made before interfaces were
+// tracked, and those with no interface, are keyed by the pod name alone.
+func ReservationKey(podName, ifName string) string {
+	if ifName == "" {
+		return podName
+	}
+	return podName + "/" + ifName
+}
+
+// ParseReservationKey splits a key returned by ReservationKey into the pod and interface names
+func ParseReservationKey(key string) (podName, ifName string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// GetExistingReservation returns the IP reserved for the pod's interface.  A reservation keyed by the pod name alone
+// is returned if there isn't one for the interface.
+func (m IPReservationMap) GetExistingReservation(namespace, podName, ifName string) *net.IP {
+	if reservation := m.GetReservation(namespace, podName, ifName); reservation != nil {
+		return &reservation.IP
+	}
+	return nil
+}
+
+// GetReservation returns the reservation for the pod's interface.  A reservation keyed by the pod name alone is
+// returned if there isn't one for the interface.
+func (m IPReservationMap) GetReservation(namespace, podName, ifName string) *IPReservation {
 	if namespaceMap, nsFound := m[namespace]; nsFound {
-		if podIp, podFound := namespaceMap[podName]; podFound {
-			return &podIp
+		if reservation, podFound := namespaceMap[ReservationKey(podName, ifName)]; podFound {
+			return &reservation
+		}
+
+		if reservation, podFound := namespaceMap[podName]; podFound {
+			return &reservation
 		}
 	}
 	return nil
 }
 
-func (m IPReservationMap) GetPodForIP(ip net.IP) (namespace, podName string, found bool) {
+func (m IPReservationMap) GetPodForIP(ip net.IP) (namespace, podName, ifName string, found bool) {
 	for namespace, nsMap := range m {
-		for podName, podIp := range nsMap {
-			if podIp.Equal(ip) {
-				return namespace, podName, true
+		for key, reservation := range nsMap {
+			if reservation.IP.Equal(ip) {
+				podName, ifName := ParseReservationKey(key)
+				return namespace, podName, ifName, true
 			}
 		}
 	}
-	return "", "", false
+	return "", "", "", false
+}
+
+// namespaces returns the namespaces holding reservations, sorted
+func (m IPReservationMap) namespaces() []string {
+	namespaces := make([]string, 0, len(m))
+	for namespace := range m {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
 }
 
-func (m IPReservationMap) Reserve(namespace, podName string, ip net.IP) {
+// each calls fn for every reservation, sorted by namespace then key
+func (m IPReservationMap) each(fn func(namespace, key string, reservation IPReservation)) {
+	for _, namespace := range m.namespaces() {
+		keys := make([]string, 0, len(m[namespace]))
+		for key := range m[namespace] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fn(namespace, key, m[namespace][key])
+		}
+	}
+}
+
+// Reserve records the reservation for the pod's interface, replacing any reservation keyed by the pod name alone.
+func (m IPReservationMap) Reserve(namespace, podName, ifName string, reservation IPReservation) {
 	if _, ok := m[namespace]; !ok {
-		m[namespace] = make(map[string]net.IP, 0)
+		m[namespace] = make(map[string]IPReservation, 0)
+	}
+	if ifName != "" {
+		delete(m[namespace], podName)
 	}
-	m[namespace][podName] = ip
+	m[namespace][ReservationKey(podName, ifName)] = reservation
+}
+
+// ClaimReservation records the owner of claim, as described by IPReservation.claim, on the pod interface's existing
+// reservation.  A reservation keyed by the pod name alone is moved to the key for the interface.  Returns true if the
+// map was modified.
+func (m IPReservationMap) ClaimReservation(namespace, podName, ifName string, claim IPReservation) bool {
+	namespaceMap, nsFound := m[namespace]
+	if !nsFound {
+		return false
+	}
+
+	key := ReservationKey(podName, ifName)
+	if reservation, found := namespaceMap[key]; found {
+		if !reservation.claim(claim) {
+			return false
+		}
+		namespaceMap[key] = reservation
+		return true
+	}
+
+	if reservation, found := namespaceMap[podName]; found {
+		reservation.claim(claim)
+		m.Reserve(namespace, podName, ifName, reservation)
+		return true
+	}
+
+	return false
 }
 
 func (m IPReservationMap) AlreadyReserved(ip net.IP) bool {
-	_, _, found := m.GetPodForIP(ip)
+	_, _, _, found := m.GetPodForIP(ip)
 	return found
 }
 
-func (m IPReservationMap) FreePodReservation(namespace, podName string) {
-	if _, nsFound := m[namespace]; nsFound {
-		if _, podFound := m[namespace][podName]; podFound {
-			delete(m[namespace], podName)
-		}
+// FreePodReservation removes the reservation for the pod's interface, provided it belongs to containerID.  If the
+// interface has no reservation of its own, the reservation keyed by the pod name alone is removed instead, if it
+// belongs to the interface.  Returns true if a reservation was removed.
+func (m IPReservationMap) FreePodReservation(namespace, podName, ifName, containerID string) bool {
+	return len(m.freePodReservation(namespace, podName, ifName, containerID)) > 0
+}
+
+// freePodReservation frees reservations as FreePodReservation does, returning those removed
+func (m IPReservationMap) freePodReservation(namespace, podName, ifName, containerID string) []IPReservation {
+	freed := make([]IPReservation, 0)
+	namespaceMap, nsFound := m[namespace]
+	if !nsFound {
+		return freed
+	}
+
+	key := ReservationKey(podName, ifName)
+	reservation, found := namespaceMap[key]
+	if !found {
+		key = podName
+		reservation, found = namespaceMap[key]
+		found = found && m.ownsLegacyReservation(namespace, podName, ifName, reservation)
+	}
+
+	if found && reservation.MatchesContainer(containerID) {
+		delete(namespaceMap, key)
+		freed = append(freed, reservation)
+	}
+
+	if len(namespaceMap) == 0 {
+		delete(m, namespace)
+	}
+	return freed
+}
+
+// ownsLegacyReservation returns true if the pod's reservation keyed by its name alone belongs to ifName: it records
+// ifName as its interface, or records no interface and the pod holds no reservations keyed by interface, which would
+// show the legacy reservation belongs to another of its interfaces.
+func (m IPReservationMap) ownsLegacyReservation(namespace, podName, ifName string, reservation IPReservation) bool {
+	if reservation.Interface != "" {
+		return reservation.Interface == ifName
+	}
 
-		if len(m[namespace]) == 0 {
-			delete(m, namespace)
+	for key := range m[namespace] {
+		if keyPod, keyIf := ParseReservationKey(key); keyPod == podName && keyIf != "" {
+			return false
 		}
 	}
+	return true
 }
@@ -1,11 +1,16 @@
 package v1alpha1
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
@@ -50,6 +55,161 @@ func TestIPPoolParse(t *testing.T) {
 
 }
 
+func TestIPPoolParseRoutes(t *testing.T) {
+	poolString := "apiVersion: k8s.pgc.umn.edu/v1alpha1\nkind: IPPool\nmetadata:\n  name: samplePool\nspec:\n  range: 10.2.3.64/28\n  netmaskBits: 27\n  gateway: 10.2.3.65\n  disableDefaultRoute: true\n  routes:\n  - dst: 10.10.0.0/16\n  - dst: 10.20.0.0/16\n    gw: 10.2.3.66\n  dns:\n    nameservers: [\"10.2.3.2\"]\n    search: [\"example.com\"]\n    options: [\"ndots:2\"]"
+	pool := &IPPool{}
+	if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(poolString), 65536).Decode(pool); err != nil {
+		t.Fatalf("Error parsing yaml: %v", err)
+	}
+
+	if err := pool.Spec.Validate(); err != nil {
+		t.Errorf("Error validating parsed yaml: %v", err)
+	}
+
+	if !pool.Spec.DisableDefaultRoute {
+		t.Errorf("default route not disabled")
+	}
+
+	if len(pool.Spec.Routes) != 2 || pool.Spec.Routes[0].Destination != "10.10.0.0/16" {
+		t.Fatalf("Wrong routes parsed: %v", pool.Spec.Routes)
+	}
+
+	if gw := pool.RouteGateway(pool.Spec.Routes[0]); !gw.Equal(net.ParseIP("10.2.3.65")) {
+		t.Errorf("route without a gateway should use the pool gateway, got %v", gw)
+	}
+
+	if gw := pool.RouteGateway(pool.Spec.Routes[1]); !gw.Equal(net.ParseIP("10.2.3.66")) {
+		t.Errorf("route gateway not used, got %v", gw)
+	}
+
+	if !reflect.DeepEqual(pool.Spec.DNS, DNS{Nameservers: []string{"10.2.3.2"}, Search: []string{"example.com"}, Options: []string{"ndots:2"}}) {
+		t.Errorf("Wrong dns parsed: %v", pool.Spec.DNS)
+	}
+}
+
+func TestIPPoolSpecValidateRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  IPPoolSpec
+		valid bool
+	}{
+		{"valid", IPPoolSpec{Routes: []Route{{Destination: "10.10.0.0/16", Gateway: net.ParseIP("10.2.3.66")}}, DNS: DNS{Nameservers: []string{"10.2.3.2"}}}, true},
+		{"invalid destination", IPPoolSpec{Routes: []Route{{Destination: "10.10.0.0"}}}, false},
+		{"wrong family", IPPoolSpec{Routes: []Route{{Destination: "2001:db8::/64"}}}, false},
+		{"gateway off subnet", IPPoolSpec{Routes: []Route{{Destination: "10.10.0.0/16", Gateway: net.ParseIP("10.2.4.1")}}}, false},
+		{"invalid nameserver", IPPoolSpec{DNS: DNS{Nameservers: []string{"ns1.example.com"}}}, false},
+	}
+
+	for _, test := range tests {
+		test.spec.Range = IPRange("10.2.3.64/28")
+		test.spec.NetmaskBits = 27
+		err := test.spec.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected spec to be invalid", test.name)
+		}
+	}
+}
+
+func TestIPPoolSpecValidateStaticReservations(t *testing.T) {
+	tests := []struct {
+		name     string
+		reserved map[string]string
+		expected []string
+	}{
+		{"valid", map[string]string{"web": "10.2.3.70", "db/net1": "10.2.3.71"}, nil},
+		{"outside range", map[string]string{"web": "10.2.3.90"}, []string{"spec.staticReservations[foo][web]"}},
+		{"gateway", map[string]string{"web": "10.2.3.65"}, []string{"spec.staticReservations[foo][web]"}},
+		{"excluded", map[string]string{"web": "10.2.3.66"}, []string{"spec.staticReservations[foo][web]"}},
+		{"duplicate", map[string]string{"web": "10.2.3.70", "db": "10.2.3.70"}, []string{"spec.staticReservations[foo][web]"}},
+		{"several", map[string]string{"web": "10.2.3.90", "db": "10.2.3.65"}, []string{"spec.staticReservations[foo][db]", "spec.staticReservations[foo][web]"}},
+	}
+
+	for _, test := range tests {
+		spec := IPPoolSpec{Range: "10.2.3.64/28", NetmaskBits: 27, Gateway: net.ParseIP("10.2.3.65"), Exclusions: []IPExclusion{"10.2.3.66"}}
+		spec.StaticReservations = NewIPReservationMap()
+		for key, ip := range test.reserved {
+			podName, ifName := ParseReservationKey(key)
+			spec.StaticReservations.Reserve("foo", podName, ifName, IPReservation{IP: net.ParseIP(ip)})
+		}
+
+		errs := spec.ValidateFields(field.NewPath("spec"))
+		fields := make([]string, 0, len(errs))
+		for _, err := range errs {
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, append([]string{}, test.expected...)) {
+			t.Errorf("%s: expected errors for %v, got %v", test.name, test.expected, errs)
+		}
+		if (spec.Validate() == nil) != (len(test.expected) == 0) {
+			t.Errorf("%s: Validate disagrees with ValidateFields: %v", test.name, spec.Validate())
+		}
+	}
+}
+
+func TestIPPoolSpecValidateAggregatesErrors(t *testing.T) {
+	spec := IPPoolSpec{
+		Range:              "10.2.3.64/28",
+		NetmaskBits:        27,
+		Gateway:            net.ParseIP("10.2.4.1"),
+		AllocationStrategy: "roundRobin",
+		DNS:                DNS{Nameservers: []string{"10.2.3.2", "dns.example.com"}},
+	}
+
+	errs := spec.ValidateFields(field.NewPath("spec"))
+	expected := []string{"spec.gateway", "spec.allocationStrategy", "spec.dns.nameservers[1]"}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Field != expected[i] {
+			t.Errorf("expected error %d to be for %s, got %v", i, expected[i], err)
+		}
+	}
+
+	// Range errors are reported by field too, and hold back the checks that depend on the ranges
+	spec = IPPoolSpec{Range: "10.2.3.64/28", Ranges: []IPRange{"10.2.3.70-10.2.3", "10.2.3.80/28"}, NetmaskBits: 27, Gateway: net.ParseIP("10.2.4.1")}
+	errs = spec.ValidateFields(field.NewPath("spec"))
+	if len(errs) != 1 || errs[0].Field != "spec.ranges[0]" {
+		t.Errorf("expected a single error for spec.ranges[0], got %v", errs)
+	}
+}
+
+func TestIPPoolValidateDynamicReservations(t *testing.T) {
+	p := &IPPool{Spec: IPPoolSpec{Range: "10.2.3.64/28", NetmaskBits: 27}}
+	p.Spec.StaticReservations = NewIPReservationMap()
+	p.Spec.StaticReservations.Reserve("foo", "web", "", IPReservation{IP: net.ParseIP("10.2.3.70")})
+	p.Reserve("foo", "db", "eth0", IPReservation{IP: net.ParseIP("10.2.3.71")})
+	if err := p.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p.Reserve("bar", "cache", "eth0", IPReservation{IP: net.ParseIP("10.2.3.70")})
+	p.Reserve("foo", "web", "eth1", IPReservation{IP: net.ParseIP("10.2.3.72")})
+	errs := p.validateDynamicReservations(field.NewPath("status", "DynamicReservations"))
+	if len(errs) != 2 || errs[0].Field != "status.DynamicReservations[bar][cache/eth0]" || errs[1].Field != "status.DynamicReservations[foo][web/eth1]" {
+		t.Errorf("expected conflicts for bar/cache and foo/web, got %v", errs)
+	}
+	if err := p.Validate(); err == nil {
+		t.Errorf("expected dynamic reservations conflicting with static ones to be invalid")
+	}
+
+	if !p.DropConflictingReservations() {
+		t.Errorf("conflicting dynamic reservations not dropped")
+	}
+	if err := p.Validate(); err != nil {
+		t.Errorf("unexpected error after dropping conflicts: %v", err)
+	}
+	if p.GetReservation("foo", "db", "eth0") == nil || p.Status.DynamicReservations["bar"] != nil {
+		t.Errorf("expected only the conflicting reservations to be dropped, got %v", p.Status.DynamicReservations)
+	}
+	if len(p.Status.Quarantine) != 0 || p.DropConflictingReservations() {
+		t.Errorf("expected dropped reservations to be removed once without quarantine, got %v", p.Status.Quarantine)
+	}
+}
+
 func TestIPReservationMap(t *testing.T) {
 	m := IPReservationMap{}
 	ip := net.ParseIP("10.0.0.1")
@@ -57,51 +217,310 @@ func TestIPReservationMap(t *testing.T) {
 		t.Errorf("Empty map claims IP is reserved")
 	}
 
-	m.Reserve("foo", "bar", ip)
+	m.Reserve("foo", "bar", "eth0", IPReservation{IP: ip})
 
 	if !m.AlreadyReserved(ip) {
 		t.Errorf("Map claims reserved IP is available")
 	}
 
-	existingIP := m.GetExistingReservation("foo", "bar")
+	existingIP := m.GetExistingReservation("foo", "bar", "eth0")
 
 	if existingIP == nil || !existingIP.Equal(ip) {
 		t.Errorf("Wrong or no ip returned for existing reservation")
 	}
 
-	m.FreePodReservation("foo", "bar")
+	m.FreePodReservation("foo", "bar", "eth0", "")
 
 	if m.AlreadyReserved(ip) {
 		t.Errorf("Empty map claims IP is reserved")
 	}
 
-	if existingIP := m.GetExistingReservation("foo", "bar"); existingIP != nil {
+	if existingIP := m.GetExistingReservation("foo", "bar", "eth0"); existingIP != nil {
 		t.Errorf("IP found for pod after Free was called")
 	}
 
 }
 
+func TestIPReservationMapInterfaces(t *testing.T) {
+	m := IPReservationMap{}
+	eth0IP := net.ParseIP("10.0.0.1")
+	net1IP := net.ParseIP("10.0.0.2")
+
+	m.Reserve("foo", "bar", "eth0", IPReservation{IP: eth0IP})
+	m.Reserve("foo", "bar", "net1", IPReservation{IP: net1IP})
+
+	if existingIP := m.GetExistingReservation("foo", "bar", "eth0"); existingIP == nil || !existingIP.Equal(eth0IP) {
+		t.Errorf("Wrong or no ip returned for eth0: %v", existingIP)
+	}
+
+	if existingIP := m.GetExistingReservation("foo", "bar", "net1"); existingIP == nil || !existingIP.Equal(net1IP) {
+		t.Errorf("Wrong or no ip returned for net1: %v", existingIP)
+	}
+
+	if namespace, podName, ifName, found := m.GetPodForIP(net1IP); !found || namespace != "foo" || podName != "bar" || ifName != "net1" {
+		t.Errorf("Wrong pod returned for net1 ip: %s/%s %s", namespace, podName, ifName)
+	}
+
+	m.FreePodReservation("foo", "bar", "net1", "")
+
+	if m.AlreadyReserved(net1IP) {
+		t.Errorf("net1 ip still reserved after free")
+	}
+
+	if !m.AlreadyReserved(eth0IP) {
+		t.Errorf("eth0 ip freed along with net1")
+	}
+}
+
+func TestIPReservationMapClaimLegacyReservation(t *testing.T) {
+	m := IPReservationMap{}
+	legacyIP := net.ParseIP("10.0.0.1")
+	m.Reserve("foo", "bar", "", IPReservation{IP: legacyIP})
+
+	if existingIP := m.GetExistingReservation("foo", "bar", "net1"); existingIP == nil || !existingIP.Equal(legacyIP) {
+		t.Errorf("Legacy reservation not found for interface: %v", existingIP)
+	}
+
+	if !m.ClaimReservation("foo", "bar", "net1", IPReservation{ContainerID: "container1"}) {
+		t.Fatalf("Legacy reservation not migrated")
+	}
+
+	if _, found := m["foo"]["bar"]; found {
+		t.Errorf("Legacy key still present after migration")
+	}
+
+	if existingIP := m.GetExistingReservation("foo", "bar", "net1"); existingIP == nil || !existingIP.Equal(legacyIP) {
+		t.Errorf("Migrated reservation not found for interface: %v", existingIP)
+	}
+
+	if existingIP := m.GetExistingReservation("foo", "bar", "net2"); existingIP != nil {
+		t.Errorf("Migrated reservation returned for another interface: %v", existingIP)
+	}
+
+	if m.ClaimReservation("foo", "bar", "net1", IPReservation{ContainerID: "container1"}) {
+		t.Errorf("Reservation migrated twice")
+	}
+}
+
+func TestIPReservationMapFreeLegacyReservation(t *testing.T) {
+	legacyIP := net.ParseIP("10.0.0.1")
+	net1IP := net.ParseIP("10.0.0.2")
+	tests := []struct {
+		name         string
+		reservations map[string]IPReservation
+		ifName       string
+		freed        []string
+	}{
+		{"legacy only", map[string]IPReservation{"bar": {IP: legacyIP}}, "eth0", []string{"bar"}},
+		{"interface has its own", map[string]IPReservation{"bar": {IP: legacyIP}, "bar/net1": {IP: net1IP}}, "net1", []string{"bar/net1"}},
+		{"another interface has its own", map[string]IPReservation{"bar": {IP: legacyIP}, "bar/net1": {IP: net1IP}}, "net2", nil},
+		{"recorded interface", map[string]IPReservation{"bar": {IP: legacyIP, Interface: "eth0"}}, "eth0", []string{"bar"}},
+		{"other recorded interface", map[string]IPReservation{"bar": {IP: legacyIP, Interface: "eth0"}}, "net1", nil},
+		{"other pod", map[string]IPReservation{"bar": {IP: legacyIP}, "baz/net1": {IP: net1IP}}, "eth0", []string{"bar"}},
+	}
+
+	for _, test := range tests {
+		m := IPReservationMap{"foo": test.reservations}
+		before := make(map[string]bool, len(test.reservations))
+		for key := range test.reservations {
+			before[key] = true
+		}
+
+		m.FreePodReservation("foo", "bar", test.ifName, "")
+
+		freed := make([]string, 0)
+		for key := range before {
+			if _, found := m["foo"][key]; !found {
+				freed = append(freed, key)
+			}
+		}
+		if len(freed) != len(test.freed) || (len(freed) > 0 && freed[0] != test.freed[0]) {
+			t.Errorf("%s: expected %v to be freed, got %v", test.name, test.freed, freed)
+		}
+	}
+}
+
+func TestIPReservationMapContainers(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+
+	tests := []struct {
+		name     string
+		events   []string
+		reserved bool
+		owner    string
+	}{
+		// the new sandbox's ADD claims the reservation, so the old sandbox's late DEL leaves it alone
+		{"late del for old sandbox", []string{"add:old", "add:new", "del:old"}, true, "new"},
+		{"del before new sandbox", []string{"add:old", "del:old", "add:new"}, true, "new"},
+		{"del of current sandbox", []string{"add:old", "add:new", "del:old", "del:new"}, false, ""},
+		{"repeated del", []string{"add:old", "del:old", "del:old"}, false, ""},
+		{"del without sandbox", []string{"add:old", "del:"}, false, ""},
+		{"del for unknown sandbox", []string{"add:old", "del:other"}, true, "old"},
+	}
+
+	for _, test := range tests {
+		m := IPReservationMap{}
+		for _, event := range test.events {
+			parts := strings.SplitN(event, ":", 2)
+			switch parts[0] {
+			case "add":
+				if !m.ClaimReservation("foo", "bar", "eth0", IPReservation{ContainerID: parts[1]}) {
+					m.Reserve("foo", "bar", "eth0", IPReservation{IP: ip, ContainerID: parts[1]})
+				}
+			case "del":
+				m.FreePodReservation("foo", "bar", "eth0", parts[1])
+			}
+		}
+
+		reservation := m.GetReservation("foo", "bar", "eth0")
+		if (reservation != nil) != test.reserved {
+			t.Errorf("%s: expected reserved to be %t, got %v", test.name, test.reserved, reservation)
+			continue
+		}
+
+		if reservation != nil && reservation.ContainerID != test.owner {
+			t.Errorf("%s: expected reservation to belong to %s, got %s", test.name, test.owner, reservation.ContainerID)
+		}
+	}
+}
+
+func TestIPReservationMapJSON(t *testing.T) {
+	legacy := `{"foo": {"bar": "10.0.0.1", "baz/net1": {"ip": "10.0.0.2", "containerID": "abc"}}}`
+	m := IPReservationMap{}
+	if err := json.Unmarshal([]byte(legacy), &m); err != nil {
+		t.Fatalf("unable to parse reservations: %v", err)
+	}
+
+	if reservation := m.GetReservation("foo", "bar", ""); reservation == nil || !reservation.IP.Equal(net.ParseIP("10.0.0.1")) || reservation.ContainerID != "" {
+		t.Errorf("bare ip reservation parsed incorrectly: %v", reservation)
+	}
+
+	if reservation := m.GetReservation("foo", "baz", "net1"); reservation == nil || !reservation.IP.Equal(net.ParseIP("10.0.0.2")) || reservation.ContainerID != "abc" {
+		t.Errorf("reservation object parsed incorrectly: %v", reservation)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("unable to serialize reservations: %v", err)
+	}
+
+	roundTrip := IPReservationMap{}
+	if err := json.Unmarshal(data, &roundTrip); err != nil {
+		t.Fatalf("unable to parse serialized reservations: %v", err)
+	}
+
+	if !reflect.DeepEqual(m, roundTrip) {
+		t.Errorf("reservations changed in round trip: %v != %v", m, roundTrip)
+	}
+
+	if !strings.Contains(string(data), `"bar":"10.0.0.1"`) {
+		t.Errorf("reservation without a sandbox not written as a bare ip: %s", data)
+	}
+}
+
+func TestIPReservationRecordJSON(t *testing.T) {
+	created := metav1.NewTime(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	lastSeen := metav1.NewTime(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC))
+	m := IPReservationMap{}
+	m.Reserve("foo", "bar", "eth0", IPReservation{
+		IP:          net.ParseIP("10.0.0.1"),
+		PodUID:      "6f9a4c2e-7d1b-4e8a-9c3f-2b5d8e1a0c7f",
+		NodeName:    "node1",
+		ContainerID: "abc",
+		Interface:   "eth0",
+		Created:     &created,
+		LastSeen:    &lastSeen,
+	})
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("unable to serialize reservations: %v", err)
+	}
+
+	roundTrip := IPReservationMap{}
+	if err := json.Unmarshal(data, &roundTrip); err != nil {
+		t.Fatalf("unable to parse serialized reservations: %v", err)
+	}
+
+	// times are parsed in the local time zone, so they're compared separately
+	expected := m["foo"]["bar/eth0"]
+	parsed := roundTrip["foo"]["bar/eth0"]
+	if !parsed.Created.Equal(expected.Created) || !parsed.LastSeen.Equal(expected.LastSeen) {
+		t.Errorf("reservation times changed in round trip: %v != %v", expected, parsed)
+	}
+
+	expected.Created, expected.LastSeen, parsed.Created, parsed.LastSeen = nil, nil, nil, nil
+	if !reflect.DeepEqual(expected, parsed) {
+		t.Errorf("reservation record changed in round trip: %v != %v", expected, parsed)
+	}
+}
+
+func TestIPPoolLegacyReservationsJSON(t *testing.T) {
+	legacy := `{
+		"metadata": {"name": "pool"},
+		"spec": {"range": "10.0.0.0/24", "netmaskBits": 24, "gateway": "10.0.0.254", "staticReservations": {"foo": {"web": "10.0.0.10"}}},
+		"status": {"DynamicReservations": {"foo": {"bar": "10.0.0.1", "baz": "10.0.0.2"}}}
+	}`
+
+	p := &IPPool{}
+	if err := json.Unmarshal([]byte(legacy), p); err != nil {
+		t.Fatalf("unable to parse pool with legacy reservations: %v", err)
+	}
+
+	for podName, ip := range map[string]string{"web": "10.0.0.10", "bar": "10.0.0.1", "baz": "10.0.0.2"} {
+		if existingIP := p.GetExistingReservation("foo", podName, "eth0"); existingIP == nil || !existingIP.Equal(net.ParseIP(ip)) {
+			t.Errorf("%s: expected legacy reservation for %s, got %v", podName, ip, existingIP)
+		}
+	}
+}
+
+func TestIPReservationMapClaimOwner(t *testing.T) {
+	created := metav1.NewTime(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	lastSeen := metav1.NewTime(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC))
+	ip := net.ParseIP("10.0.0.1")
+
+	m := IPReservationMap{}
+	m.Reserve("foo", "bar", "eth0", IPReservation{IP: ip, PodUID: "old-uid", NodeName: "node1", ContainerID: "old", Created: &created, LastSeen: &created})
+
+	claim := IPReservation{IP: net.ParseIP("10.0.0.99"), PodUID: "new-uid", NodeName: "node2", ContainerID: "new", Interface: "eth0", Created: &lastSeen, LastSeen: &lastSeen}
+	if !m.ClaimReservation("foo", "bar", "eth0", claim) {
+		t.Fatalf("reservation not claimed")
+	}
+
+	reservation := m.GetReservation("foo", "bar", "eth0")
+	if !reservation.IP.Equal(ip) || !reservation.Created.Equal(&created) {
+		t.Errorf("claim changed the address or creation time: %v", reservation)
+	}
+	if reservation.PodUID != "new-uid" || reservation.NodeName != "node2" || reservation.ContainerID != "new" || reservation.Interface != "eth0" || !reservation.LastSeen.Equal(&lastSeen) {
+		t.Errorf("claim didn't record the new owner: %v", reservation)
+	}
+
+	if m.ClaimReservation("foo", "bar", "eth0", claim) {
+		t.Errorf("repeated claim modified the reservation")
+	}
+}
+
 func TestIPPoolGetExistingReservation(t *testing.T) {
 	p := IPPool{}
 	p.Spec.Range = IPRange("2001:db8::/65")
 	p.Spec.NetmaskBits = 64
 
-	if existingIP := p.GetExistingReservation("foo", "bar"); existingIP != nil {
+	if existingIP := p.GetExistingReservation("foo", "bar", "eth0"); existingIP != nil {
 		t.Errorf("IP returned for unreserved address: %v", existingIP)
 	}
 
 	podIP := net.ParseIP("2001:db8::ff32")
-	p.Reserve("foo", "bar", podIP)
+	p.Reserve("foo", "bar", "eth0", IPReservation{IP: podIP})
 
-	if existingIP := p.GetExistingReservation("foo", "bar"); existingIP == nil || !existingIP.Equal(podIP) {
+	if existingIP := p.GetExistingReservation("foo", "bar", "eth0"); existingIP == nil || !existingIP.Equal(podIP) {
 		t.Errorf("Wrong or no IP returned for reserved address: %v", existingIP)
 	}
 
 	p.Spec.StaticReservations = NewIPReservationMap()
 	staticPodIP := net.ParseIP("2001:db8::ff32")
-	p.Spec.StaticReservations.Reserve("foo", "baz", staticPodIP)
+	p.Spec.StaticReservations.Reserve("foo", "baz", "", IPReservation{IP: staticPodIP})
 
-	if existingIP := p.GetExistingReservation("foo", "baz"); existingIP == nil || !existingIP.Equal(podIP) {
+	if existingIP := p.GetExistingReservation("foo", "baz", "eth0"); existingIP == nil || !existingIP.Equal(podIP) {
 		t.Errorf("Failed to get or got wrong ip for existing reservation for static pod IP: %v", existingIP)
 	}
 }
@@ -112,17 +531,17 @@ func TestIPPoolFreePodReservation(t *testing.T) {
 	p.Spec.NetmaskBits = 64
 
 	// Try freeing with no reservations
-	p.FreeDynamicPodReservation("foo", "bar")
+	p.FreeDynamicPodReservation("foo", "bar", "eth0", "")
 
 	p.Status.DynamicReservations = NewIPReservationMap()
 	dynamicPodIP := net.ParseIP("2001:db8::234")
-	p.Reserve("foo", "bar", dynamicPodIP)
+	p.Reserve("foo", "bar", "eth0", IPReservation{IP: dynamicPodIP})
 
 	if !p.AlreadyReserved(dynamicPodIP) {
 		t.Errorf("Pool claims dynamically reserved address is available")
 	}
 
-	p.FreeDynamicPodReservation("foo", "bar")
+	p.FreeDynamicPodReservation("foo", "bar", "eth0", "")
 
 	if p.AlreadyReserved(dynamicPodIP) {
 		t.Errorf("Freed reservation still claims to be reserved")
@@ -155,7 +574,7 @@ func TestIPPoolAlreadyReserved(t *testing.T) {
 	staticPodIP := net.ParseIP("2001:db8::ff32")
 
 	staticReservations := NewIPReservationMap()
-	staticReservations.Reserve("foo", "bar", staticPodIP)
+	staticReservations.Reserve("foo", "bar", "", IPReservation{IP: staticPodIP})
 
 	p := IPPool{}
 	p.Spec.Range = IPRange("2001:db8::/65")
@@ -178,7 +597,7 @@ func TestIPPoolAlreadyReserved(t *testing.T) {
 
 	p.Status.DynamicReservations = NewIPReservationMap()
 	dynamicPodIP := net.ParseIP("2001:db8::234")
-	p.Status.DynamicReservations.Reserve("baz", "pod1", dynamicPodIP)
+	p.Status.DynamicReservations.Reserve("baz", "pod1", "eth0", IPReservation{IP: dynamicPodIP})
 
 	if !p.AlreadyReserved(dynamicPodIP) {
 		t.Errorf("Pool claims dynamically reserved address is available")
@@ -225,6 +644,6 @@ func BenchmarkIPPoolAlreadyReserved(b *testing.B) {
 		for p.AlreadyReserved(randomIP) {
 			randomIP = p.RandomIP()
 		}
-		p.Reserve(fmt.Sprintf("namespace%d", n%namespaceCount), fmt.Sprintf("pod%d", n), randomIP)
+		p.Reserve(fmt.Sprintf("namespace%d", n%namespaceCount), fmt.Sprintf("pod%d", n), "eth0", IPReservation{IP: randomIP})
 	}
 }
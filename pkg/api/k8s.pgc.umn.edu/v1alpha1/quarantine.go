@@ -0,0 +1,78 @@
+package v1alpha1
+
+import (
+	"net"
+	"time"
+)
+
+// reuseCooldown returns the pool's reuse cooldown, zero if it's unset
+func (p *IPPool) reuseCooldown() time.Duration {
+	if p.Spec.ReuseCooldown == nil {
+		return 0
+	}
+	return p.Spec.ReuseCooldown.Duration
+}
+
+// Quarantined returns true, along with when it was released, if ip was freed within the pool's reuse cooldown of now
+func (p *IPPool) Quarantined(ip net.IP, now time.Time) (released time.Time, quarantined bool) {
+	if entry := p.quarantineEntry(ip, now); entry != nil {
+		return entry.Released.Time, true
+	}
+	return time.Time{}, false
+}
+
+// QuarantinedFrom returns true, along with when it was released, if ip was freed within the pool's reuse cooldown of
+// now by a pod other than namespace/podName.  A pod may have back an address it released itself.
+func (p *IPPool) QuarantinedFrom(ip net.IP, namespace, podName string, now time.Time) (released time.Time, quarantined bool) {
+	entry := p.quarantineEntry(ip, now)
+	if entry == nil || (entry.Namespace == namespace && entry.PodName == podName) {
+		return time.Time{}, false
+	}
+	return entry.Released.Time, true
+}
+
+// quarantineEntry returns the quarantine entry for ip if it's still within the reuse cooldown at now
+func (p *IPPool) quarantineEntry(ip net.IP, now time.Time) *QuarantinedAddress {
+	cooldown := p.reuseCooldown()
+	if cooldown <= 0 {
+		return nil
+	}
+
+	for i, entry := range p.Status.Quarantine {
+		if entry.IP.Equal(ip) && now.Sub(entry.Released.Time) < cooldown {
+			return &p.Status.Quarantine[i]
+		}
+	}
+	return nil
+}
+
+// quarantine records the released address, dropping entries whose cooldown has expired.  The quarantine is cleared if
+// the pool has no reuse cooldown.
+func (p *IPPool) quarantine(released QuarantinedAddress) {
+	cooldown := p.reuseCooldown()
+	if cooldown <= 0 {
+		p.Status.Quarantine = nil
+		return
+	}
+
+	quarantine := make([]QuarantinedAddress, 0, len(p.Status.Quarantine)+1)
+	for _, entry := range p.Status.Quarantine {
+		if !entry.IP.Equal(released.IP) && released.Released.Sub(entry.Released.Time) < cooldown {
+			quarantine = append(quarantine, entry)
+		}
+	}
+	p.Status.Quarantine = append(quarantine, released)
+}
+
+// unquarantine removes ip from the quarantine, once it's been allocated again
+func (p *IPPool) unquarantine(ip net.IP) {
+	for i, entry := range p.Status.Quarantine {
+		if entry.IP.Equal(ip) {
+			p.Status.Quarantine = append(p.Status.Quarantine[:i], p.Status.Quarantine[i+1:]...)
+			if len(p.Status.Quarantine) == 0 {
+				p.Status.Quarantine = nil
+			}
+			return
+		}
+	}
+}
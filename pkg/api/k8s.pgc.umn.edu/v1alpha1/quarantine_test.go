@@ -0,0 +1,76 @@
+package v1alpha1
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIPPoolQuarantine(t *testing.T) {
+	ip := net.ParseIP("10.2.3.66")
+	p := testPool(AllocationStrategyRandom)
+	p.Spec.ReuseCooldown = &metav1.Duration{Duration: time.Minute}
+
+	p.Reserve("foo", "bar", "eth0", IPReservation{IP: ip})
+	if !p.FreeDynamicPodReservation("foo", "bar", "eth0", "") {
+		t.Fatalf("reservation not freed")
+	}
+
+	now := time.Now()
+	if _, quarantined := p.Quarantined(ip, now); !quarantined {
+		t.Errorf("freed address not quarantined")
+	}
+	if _, quarantined := p.Quarantined(ip, now.Add(2*time.Minute)); quarantined {
+		t.Errorf("address still quarantined after the cooldown")
+	}
+	if _, quarantined := p.NewReservationIndex().Quarantined(ip); !quarantined {
+		t.Errorf("freed address not quarantined in the index")
+	}
+
+	// The pod that released the address isn't kept from it
+	if _, quarantined := p.QuarantinedFrom(ip, "foo", "baz", now); !quarantined {
+		t.Errorf("freed address not quarantined from another pod")
+	}
+	if _, quarantined := p.QuarantinedFrom(ip, "foo", "bar", now); quarantined {
+		t.Errorf("freed address quarantined from the pod that released it")
+	}
+
+	// Expired entries are dropped when another address is quarantined
+	p.Status.Quarantine[0].Released = metav1.NewTime(now.Add(-2 * time.Minute))
+	p.Reserve("foo", "baz", "eth0", IPReservation{IP: net.ParseIP("10.2.3.67")})
+	p.FreeDynamicPodReservation("foo", "baz", "eth0", "")
+	if len(p.Status.Quarantine) != 1 || !p.Status.Quarantine[0].IP.Equal(net.ParseIP("10.2.3.67")) {
+		t.Errorf("expected only the latest address to be quarantined, got %v", p.Status.Quarantine)
+	}
+
+	// Allocating an address takes it out of quarantine
+	p.Reserve("foo", "qux", "eth0", IPReservation{IP: net.ParseIP("10.2.3.67")})
+	if len(p.Status.Quarantine) != 0 {
+		t.Errorf("allocated address still quarantined: %v", p.Status.Quarantine)
+	}
+}
+
+func TestIPPoolQuarantineWithoutCooldown(t *testing.T) {
+	p := testPool(AllocationStrategyRandom)
+	p.Reserve("foo", "bar", "eth0", IPReservation{IP: net.ParseIP("10.2.3.66")})
+	p.FreeDynamicPodReservation("foo", "bar", "eth0", "")
+
+	if len(p.Status.Quarantine) != 0 {
+		t.Errorf("address quarantined without a reuse cooldown: %v", p.Status.Quarantine)
+	}
+}
+
+func TestIPPoolSpecValidateReuseCooldown(t *testing.T) {
+	p := testPool(AllocationStrategyRandom)
+	p.Spec.ReuseCooldown = &metav1.Duration{Duration: 30 * time.Second}
+	if err := p.Spec.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p.Spec.ReuseCooldown.Duration = -time.Second
+	if err := p.Spec.Validate(); err == nil {
+		t.Errorf("expected a negative reuse cooldown to be rejected")
+	}
+}
@@ -0,0 +1,213 @@
+package v1alpha1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// parseAddressRange returns the first and last addresses of value, which is an address, a CIDR or an inclusive
+// start-end range.  IPv4 addresses are returned in their 4 byte form.
+func parseAddressRange(value string) (start, end net.IP, err error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.Contains(value, "-"):
+		parts := strings.SplitN(value, "-", 2)
+		start, end = net.ParseIP(strings.TrimSpace(parts[0])), net.ParseIP(strings.TrimSpace(parts[1]))
+		if start == nil || end == nil {
+			return nil, nil, fmt.Errorf("%s isn't a valid range of addresses", value)
+		}
+		if (start.To4() == nil) != (end.To4() == nil) {
+			return nil, nil, fmt.Errorf("%s mixes address families", value)
+		}
+		if bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, nil, fmt.Errorf("%s ends before it starts", value)
+		}
+	case strings.Contains(value, "/"):
+		_, network, parseErr := net.ParseCIDR(value)
+		if parseErr != nil {
+			return nil, nil, fmt.Errorf("%s isn't a valid cidr: %v", value, parseErr)
+		}
+		start = network.IP
+		end = make(net.IP, len(network.IP))
+		for i := range network.IP {
+			end[i] = network.IP[i] | ^network.Mask[i]
+		}
+	default:
+		start = net.ParseIP(value)
+		if start == nil {
+			return nil, nil, fmt.Errorf("%s isn't a valid address", value)
+		}
+		end = start
+	}
+
+	if start4 := start.To4(); start4 != nil {
+		return start4, end.To4(), nil
+	}
+	return start.To16(), end.To16(), nil
+}
+
+// Bounds returns the first and last addresses in the range.  *Any parse errors are silently ignored.*
+func (r IPRange) Bounds() (start, end net.IP) {
+	start, end, _ = parseAddressRange(string(r))
+	return start, end
+}
+
+// Contains returns true if ip is within the range
+func (r IPRange) Contains(ip net.IP) bool {
+	start, end := r.Bounds()
+	return start != nil && ipInRange(ip, start, end)
+}
+
+// ipInRange returns true if ip is between start and end inclusive
+func ipInRange(ip, start, end net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && bytes.Compare(ip, start.To16()) >= 0 && bytes.Compare(ip, end.To16()) <= 0
+}
+
+// IPRangeList is a list of ranges treated as a single range.  Offsets run through each range in turn.
+type IPRangeList []IPRange
+
+// AllRanges returns every range addresses are allocated from, Range followed by Ranges
+func (s IPPoolSpec) AllRanges() IPRangeList {
+	ranges := make(IPRangeList, 0, len(s.Ranges)+1)
+	if s.Range != "" {
+		ranges = append(ranges, s.Range)
+	}
+	return append(ranges, s.Ranges...)
+}
+
+func (l IPRangeList) String() string {
+	ranges := make([]string, len(l))
+	for i, r := range l {
+		ranges[i] = string(r)
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// IPSizeBits returns the number of bits required for IPs in the first range, zero if the list is empty
+func (l IPRangeList) IPSizeBits() int {
+	if len(l) == 0 {
+		return 0
+	}
+	return l[0].IPSizeBits()
+}
+
+// Contains returns true if ip is within any of the ranges
+func (l IPRangeList) Contains(ip net.IP) bool {
+	for _, r := range l {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the number of addresses in all of the ranges
+func (l IPRangeList) Size() *big.Int {
+	size := big.NewInt(0)
+	for _, r := range l {
+		size.Add(size, r.Size())
+	}
+	return size
+}
+
+// Offset returns the position of ip from the start of the list, or nil if ip isn't within any of the ranges
+func (l IPRangeList) Offset(ip net.IP) *big.Int {
+	base := big.NewInt(0)
+	for _, r := range l {
+		if r.Contains(ip) {
+			return base.Add(base, r.Offset(ip))
+		}
+		base.Add(base, r.Size())
+	}
+	return nil
+}
+
+// AddressAt returns the address at offset from the start of the list, or nil if offset is past the end of the list
+func (l IPRangeList) AddressAt(offset *big.Int) net.IP {
+	remaining := new(big.Int).Set(offset)
+	for _, r := range l {
+		size := r.Size()
+		if remaining.Cmp(size) < 0 {
+			return r.AddressAt(remaining)
+		}
+		remaining.Sub(remaining, size)
+	}
+	return nil
+}
+
+// subnet returns the network the pool's addresses are on, derived from its first range and NetmaskBits
+func (s IPPoolSpec) subnet() net.IPNet {
+	ranges := s.AllRanges()
+	if len(ranges) == 0 {
+		return net.IPNet{}
+	}
+	start, _ := ranges[0].Bounds()
+	mask := net.CIDRMask(s.NetmaskBits, len(start)*8)
+	return net.IPNet{IP: start.Mask(mask), Mask: mask}
+}
+
+// rangePath returns the path of the field holding the range at index i of AllRanges
+func (s IPPoolSpec) rangePath(path *field.Path, i int) *field.Path {
+	if s.Range != "" {
+		if i == 0 {
+			return path.Child("range")
+		}
+		i--
+	}
+	return path.Child("ranges").Index(i)
+}
+
+// validateRanges returns errors if the pool has no ranges, or its ranges can't be parsed, mix address families,
+// overlap or aren't within the netmask.  The netmask and overlaps are only checked once every range parses.
+func (s IPPoolSpec) validateRanges(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	ranges := s.AllRanges()
+	if len(ranges) == 0 {
+		return append(allErrs, field.Required(path.Child("ranges"), "at least one IP range is required"))
+	}
+
+	for i, r := range ranges {
+		if err := r.Validate(); err != nil {
+			allErrs = append(allErrs, field.Invalid(s.rangePath(path, i), string(r), fmt.Sprintf("please check your syntax: %v", err)))
+		} else if bits := ranges.IPSizeBits(); bits != 0 && r.IPSizeBits() != bits {
+			allErrs = append(allErrs, field.Invalid(s.rangePath(path, i), string(r), fmt.Sprintf("isn't in the same address family as %v", ranges[0])))
+		}
+	}
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+
+	// NetmaskBits are valid and less than or equal to Range Bits
+	if s.NetmaskBits < 0 || s.NetmaskBits > ranges.IPSizeBits() {
+		return append(allErrs, field.Invalid(path.Child("netmaskBits"), s.NetmaskBits, "specified netmask is invalid"))
+	}
+
+	subnet := s.subnet()
+	for i, r := range ranges {
+		start, end := r.Bounds()
+		if !subnet.Contains(start) || !subnet.Contains(end) {
+			allErrs = append(allErrs, field.Invalid(s.rangePath(path, i), string(r), "specified netmask doesn't completely contain the range"))
+		}
+
+		for _, other := range ranges[:i] {
+			otherStart, otherEnd := other.Bounds()
+			if ipInRange(start, otherStart, otherEnd) || ipInRange(otherStart, start, end) {
+				allErrs = append(allErrs, field.Invalid(s.rangePath(path, i), string(r), fmt.Sprintf("overlaps %v", other)))
+			}
+		}
+	}
+	return allErrs
+}
+
+// low64 returns the low 64 bits of ip
+func low64(ip net.IP) uint64 {
+	ip = ip.To16()
+	return binary.BigEndian.Uint64(ip[net.IPv6len-8:])
+}
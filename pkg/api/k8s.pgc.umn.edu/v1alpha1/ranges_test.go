@@ -0,0 +1,154 @@
+package v1alpha1
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+func TestIPRangeStartEnd(t *testing.T) {
+	tests := []struct {
+		r          IPRange
+		size       int64
+		first      string
+		last       string
+		bits       int
+		rangeBits  int
+		validRange bool
+	}{
+		{"10.2.3.64/28", 16, "10.2.3.64", "10.2.3.79", 32, 28, true},
+		{"10.2.3.10-10.2.3.20", 11, "10.2.3.10", "10.2.3.20", 32, 27, true},
+		{"2001:db8::10-2001:db8::1f", 16, "2001:db8::10", "2001:db8::1f", 128, 124, true},
+		{"10.2.3.20-10.2.3.10", 0, "", "", 0, 0, false},
+		{"10.2.3.10-2001:db8::1", 0, "", "", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		if err := test.r.Validate(); (err == nil) != test.validRange {
+			t.Errorf("%s: expected valid to be %t, got %v", test.r, test.validRange, err)
+		}
+		if !test.validRange {
+			continue
+		}
+
+		if size := test.r.Size(); size.Int64() != test.size {
+			t.Errorf("%s: expected size %d, got %s", test.r, test.size, size)
+		}
+		if first := test.r.AddressAt(big.NewInt(0)); !first.Equal(net.ParseIP(test.first)) {
+			t.Errorf("%s: expected first address %s, got %s", test.r, test.first, first)
+		}
+		if last := test.r.AddressAt(big.NewInt(test.size - 1)); !last.Equal(net.ParseIP(test.last)) {
+			t.Errorf("%s: expected last address %s, got %s", test.r, test.last, last)
+		}
+		if offset := test.r.Offset(net.ParseIP(test.last)); offset.Int64() != test.size-1 {
+			t.Errorf("%s: expected offset %d for %s, got %s", test.r, test.size-1, test.last, offset)
+		}
+		if bits := test.r.IPSizeBits(); bits != test.bits {
+			t.Errorf("%s: expected %d bits, got %d", test.r, test.bits, bits)
+		}
+		if rangeBits := test.r.RangeMaskBits(); rangeBits != test.rangeBits {
+			t.Errorf("%s: expected %d range mask bits, got %d", test.r, test.rangeBits, rangeBits)
+		}
+	}
+}
+
+func TestIPRangeList(t *testing.T) {
+	p := &IPPool{}
+	p.Spec.Range = IPRange("10.2.3.10-10.2.3.12")
+	p.Spec.Ranges = []IPRange{"10.2.3.20/30", "10.2.3.40-10.2.3.40"}
+	p.Spec.NetmaskBits = 24
+	ranges := p.Spec.AllRanges()
+
+	expected := []string{"10.2.3.10", "10.2.3.11", "10.2.3.12", "10.2.3.20", "10.2.3.21", "10.2.3.22", "10.2.3.23", "10.2.3.40"}
+	if size := ranges.Size(); size.Int64() != int64(len(expected)) {
+		t.Fatalf("expected size %d, got %s", len(expected), size)
+	}
+
+	for i, address := range expected {
+		ip := net.ParseIP(address)
+		if got := ranges.AddressAt(big.NewInt(int64(i))); !got.Equal(ip) {
+			t.Errorf("expected %s at offset %d, got %s", address, i, got)
+		}
+		if offset := ranges.Offset(ip); offset == nil || offset.Int64() != int64(i) {
+			t.Errorf("expected offset %d for %s, got %v", i, address, offset)
+		}
+		if !p.RangeContains(ip) {
+			t.Errorf("%s isn't in the pool's ranges", address)
+		}
+	}
+
+	for _, address := range []string{"10.2.3.13", "10.2.3.19", "10.2.3.24", "10.2.3.41"} {
+		if p.RangeContains(net.ParseIP(address)) {
+			t.Errorf("%s is between the pool's ranges but was contained", address)
+		}
+	}
+
+	if ip := ranges.AddressAt(big.NewInt(int64(len(expected)))); ip != nil {
+		t.Errorf("expected no address past the end of the ranges, got %s", ip)
+	}
+
+	// Every address in every range is a candidate, and none outside them
+	strategy := (&IPPool{Spec: IPPoolSpec{Range: p.Spec.Range, Ranges: p.Spec.Ranges, AllocationStrategy: AllocationStrategyLowestFree}}).NewAllocationStrategy("foo", "bar")
+	for i, address := range expected {
+		if ip := strategy.Next(); !ip.Equal(net.ParseIP(address)) {
+			t.Errorf("expected candidate %d to be %s, got %s", i, address, ip)
+		}
+	}
+	if ip := strategy.Next(); ip != nil {
+		t.Errorf("expected strategy to end, got %s", ip)
+	}
+
+	for i := 0; i < 100; i++ {
+		if ip := p.RandomIP(); !p.RangeContains(ip) {
+			t.Fatalf("random ip %s isn't in the pool's ranges", ip)
+		}
+	}
+
+	p.Spec.Gateway = net.ParseIP("10.2.3.1")
+	p.Spec.Exclusions = []IPExclusion{"10.2.3.11-10.2.3.21"}
+	if capacity := p.Capacity(); capacity.Int64() != 4 {
+		t.Errorf("expected capacity of 4, got %s", capacity)
+	}
+
+	p.Reserve("foo", "bar", "eth0", IPReservation{IP: net.ParseIP("10.2.3.40")})
+	index := p.NewReservationIndex()
+	for offset := int64(0); offset < 64; offset++ {
+		ip := net.IPv4(10, 2, 3, byte(offset))
+		if reserved := p.AlreadyReserved(ip); index.AlreadyReserved(ip) != reserved {
+			t.Errorf("index returned %t for %s being reserved, expected %t", !reserved, ip, reserved)
+		}
+	}
+}
+
+func TestIPPoolSpecValidateRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      IPRange
+		ranges []IPRange
+		valid  bool
+	}{
+		{"cidr", "10.2.3.64/28", nil, true},
+		{"start-end", "10.2.3.10-10.2.3.20", nil, true},
+		{"ranges only", "", []IPRange{"10.2.3.10-10.2.3.20", "10.2.3.64/28"}, true},
+		{"range and ranges", "10.2.3.64/28", []IPRange{"10.2.3.10-10.2.3.20"}, true},
+		{"no ranges", "", nil, false},
+		{"invalid", "10.2.3.10-10.2.3", nil, false},
+		{"outside netmask", "10.2.3.64/28", []IPRange{"10.2.4.10-10.2.4.20"}, false},
+		{"straddles netmask", "10.2.3.250-10.2.4.5", nil, false},
+		{"overlapping", "10.2.3.64/28", []IPRange{"10.2.3.70-10.2.3.100"}, false},
+		{"containing", "10.2.3.70-10.2.3.72", []IPRange{"10.2.3.64/28"}, false},
+		{"duplicate", "", []IPRange{"10.2.3.64/28", "10.2.3.64/28"}, false},
+		{"mixed families", "10.2.3.64/28", []IPRange{"2001:db8::/120"}, false},
+	}
+
+	for _, test := range tests {
+		spec := IPPoolSpec{Range: test.r, Ranges: test.ranges, NetmaskBits: 24}
+		err := spec.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected spec to be invalid", test.name)
+		}
+	}
+}
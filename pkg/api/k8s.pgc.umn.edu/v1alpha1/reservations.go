@@ -0,0 +1,127 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// SelectorReservation sets addresses aside for the pods matching a label selector.  Matching pods are only given
+// addresses from the set, and no other pod is given one.
+type SelectorReservation struct {
+	Name string `json:"name"`
+	// Namespace limits the reservation to pods in one namespace.  Pods in any namespace match if it's empty.
+	Namespace   string               `json:"namespace,omitempty"`
+	PodSelector metav1.LabelSelector `json:"podSelector"`
+	// Addresses are the addresses set aside, each an address, a CIDR or an inclusive start-end range
+	Addresses []IPRange `json:"addresses"`
+}
+
+// Matches returns true if a pod in namespace with podLabels matches the reservation.  An invalid selector matches no
+// pods.
+func (r SelectorReservation) Matches(namespace string, podLabels map[string]string) bool {
+	if r.Namespace != "" && r.Namespace != namespace {
+		return false
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&r.PodSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(podLabels))
+}
+
+// Contains returns true if ip is one of the reservation's addresses
+func (r SelectorReservation) Contains(ip net.IP) bool {
+	return IPRangeList(r.Addresses).Contains(ip)
+}
+
+// SelectorReservationFor returns the first selector reservation matching a pod in namespace with podLabels, nil if
+// none match
+func (s IPPoolSpec) SelectorReservationFor(namespace string, podLabels map[string]string) *SelectorReservation {
+	for i := range s.SelectorReservations {
+		if s.SelectorReservations[i].Matches(namespace, podLabels) {
+			return &s.SelectorReservations[i]
+		}
+	}
+	return nil
+}
+
+// SelectorReserved returns true if ip is set aside by any of the spec's selector reservations
+func (s IPPoolSpec) SelectorReserved(ip net.IP) bool {
+	for _, reservation := range s.SelectorReservations {
+		if reservation.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSelectorReservationStrategy returns a strategy trying each of the reservation's addresses within the pool's
+// ranges, in order
+func (p *IPPool) NewSelectorReservationStrategy(r SelectorReservation) AllocationStrategy {
+	ranges := p.Spec.AllRanges()
+	addresses := make(IPRangeList, 0, len(r.Addresses))
+	for _, address := range r.Addresses {
+		if start, end := address.Bounds(); start != nil {
+			addresses = append(addresses, ranges.intersectBounds(start, end)...)
+		}
+	}
+	return newScanStrategy(addresses, big.NewInt(0))
+}
+
+// validateSelectorReservations returns errors for selector reservations that are unnamed, have an invalid selector or
+// namespace, have addresses outside the pool's ranges or overlap another selector reservation
+func (s IPPoolSpec) validateSelectorReservations(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	ranges := s.AllRanges()
+	names := make(map[string]bool)
+	for i, reservation := range s.SelectorReservations {
+		reservationPath := path.Index(i)
+		if reservation.Name == "" {
+			allErrs = append(allErrs, field.Required(reservationPath.Child("name"), "selector reservations must be named"))
+		} else if names[reservation.Name] {
+			allErrs = append(allErrs, field.Duplicate(reservationPath.Child("name"), reservation.Name))
+		}
+		names[reservation.Name] = true
+
+		if len(reservation.PodSelector.MatchLabels) == 0 && len(reservation.PodSelector.MatchExpressions) == 0 {
+			allErrs = append(allErrs, field.Required(reservationPath.Child("podSelector"), "an empty selector would match every pod"))
+		} else if _, err := metav1.LabelSelectorAsSelector(&reservation.PodSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(reservationPath.Child("podSelector"), reservation.PodSelector.String(), err.Error()))
+		}
+
+		if reservation.Namespace != "" && s.NamespaceSelector == nil && !s.AllowsNamespace(reservation.Namespace, nil) {
+			allErrs = append(allErrs, field.Invalid(reservationPath.Child("namespace"), reservation.Namespace, "isn't one of the pool's allowed namespaces"))
+		}
+
+		if len(reservation.Addresses) == 0 {
+			allErrs = append(allErrs, field.Required(reservationPath.Child("addresses"), "at least one address is required"))
+		}
+		for j, address := range reservation.Addresses {
+			addressPath := reservationPath.Child("addresses").Index(j)
+			start, end, err := parseAddressRange(string(address))
+			if err != nil {
+				allErrs = append(allErrs, field.Invalid(addressPath, string(address), err.Error()))
+				continue
+			}
+			if !ranges.Contains(start) || !ranges.Contains(end) {
+				allErrs = append(allErrs, field.Invalid(addressPath, string(address), "isn't within the pool's ranges"))
+			}
+
+			for _, other := range s.SelectorReservations[:i] {
+				for _, otherAddress := range other.Addresses {
+					otherStart, otherEnd := otherAddress.Bounds()
+					if otherStart != nil && (ipInRange(start, otherStart, otherEnd) || ipInRange(otherStart, start, end)) {
+						allErrs = append(allErrs, field.Invalid(addressPath, string(address), fmt.Sprintf("overlaps selector reservation %s", other.Name)))
+					}
+				}
+			}
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,90 @@
+package v1alpha1
+
+import (
+	"net"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelectorReservationFor(t *testing.T) {
+	spec := IPPoolSpec{SelectorReservations: []SelectorReservation{
+		{Name: "web", Namespace: "team-a", PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}, Addresses: []IPRange{"10.2.3.70-10.2.3.71"}},
+		{Name: "db", PodSelector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"db", "cache"}}}}, Addresses: []IPRange{"10.2.3.72/31"}},
+	}}
+
+	tests := []struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		expected  string
+	}{
+		{"matching", "team-a", map[string]string{"app": "web", "tier": "frontend"}, "web"},
+		{"other namespace", "team-b", map[string]string{"app": "web"}, ""},
+		{"expression", "team-b", map[string]string{"app": "cache"}, "db"},
+		{"no labels", "team-a", nil, ""},
+	}
+
+	for _, test := range tests {
+		name := ""
+		if reservation := spec.SelectorReservationFor(test.namespace, test.labels); reservation != nil {
+			name = reservation.Name
+		}
+		if name != test.expected {
+			t.Errorf("%s: expected reservation %q, got %q", test.name, test.expected, name)
+		}
+	}
+
+	for address, reserved := range map[string]bool{"10.2.3.69": false, "10.2.3.70": true, "10.2.3.73": true, "10.2.3.74": false} {
+		if spec.SelectorReserved(net.ParseIP(address)) != reserved {
+			t.Errorf("expected %s to be reserved to be %t", address, reserved)
+		}
+	}
+}
+
+func TestSelectorReservationStrategy(t *testing.T) {
+	p := &IPPool{}
+	p.Spec.Range = IPRange("10.2.3.64/28")
+	p.Spec.Ranges = []IPRange{"10.2.3.100-10.2.3.101"}
+
+	strategy := p.NewSelectorReservationStrategy(SelectorReservation{Addresses: []IPRange{"10.2.3.100-10.2.3.101", "10.2.3.78/31"}})
+	for _, expected := range []string{"10.2.3.100", "10.2.3.101", "10.2.3.78", "10.2.3.79"} {
+		if ip := strategy.Next(); !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected candidate %s, got %s", expected, ip)
+		}
+	}
+	if ip := strategy.Next(); ip != nil {
+		t.Errorf("expected strategy to end, got %s", ip)
+	}
+}
+
+func TestIPPoolSpecValidateSelectorReservations(t *testing.T) {
+	web := metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	tests := []struct {
+		name         string
+		reservations []SelectorReservation
+		valid        bool
+	}{
+		{"valid", []SelectorReservation{{Name: "web", PodSelector: web, Addresses: []IPRange{"10.2.3.70-10.2.3.72", "10.2.3.76/30"}}}, true},
+		{"unnamed", []SelectorReservation{{PodSelector: web, Addresses: []IPRange{"10.2.3.70"}}}, false},
+		{"duplicate name", []SelectorReservation{{Name: "web", PodSelector: web, Addresses: []IPRange{"10.2.3.70"}}, {Name: "web", PodSelector: web, Addresses: []IPRange{"10.2.3.71"}}}, false},
+		{"invalid selector", []SelectorReservation{{Name: "web", PodSelector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Bogus"}}}, Addresses: []IPRange{"10.2.3.70"}}}, false},
+		{"empty selector", []SelectorReservation{{Name: "web", Namespace: "team-a", Addresses: []IPRange{"10.2.3.70"}}}, false},
+		{"no addresses", []SelectorReservation{{Name: "web", PodSelector: web}}, false},
+		{"invalid address", []SelectorReservation{{Name: "web", PodSelector: web, Addresses: []IPRange{"10.2.3"}}}, false},
+		{"outside range", []SelectorReservation{{Name: "web", PodSelector: web, Addresses: []IPRange{"10.2.3.78-10.2.3.82"}}}, false},
+		{"overlapping", []SelectorReservation{{Name: "web", PodSelector: web, Addresses: []IPRange{"10.2.3.70-10.2.3.72"}}, {Name: "db", PodSelector: web, Addresses: []IPRange{"10.2.3.72/30"}}}, false},
+		{"namespace not allowed", []SelectorReservation{{Name: "web", Namespace: "team-c", PodSelector: web, Addresses: []IPRange{"10.2.3.70"}}}, false},
+	}
+
+	for _, test := range tests {
+		spec := IPPoolSpec{Range: "10.2.3.64/28", NetmaskBits: 27, AllowedNamespaces: []string{"team-a"}, SelectorReservations: test.reservations}
+		err := spec.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected spec to be invalid", test.name)
+		}
+	}
+}
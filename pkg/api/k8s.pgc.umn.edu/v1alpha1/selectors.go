@@ -0,0 +1,69 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// MatchesNodeLabels returns true if the pool's node selector matches a node with nodeLabels.  Pools without a node
+// selector match every node, and pools with an invalid one match none.
+func (s IPPoolSpec) MatchesNodeLabels(nodeLabels map[string]string) bool {
+	if s.NodeSelector == nil {
+		return true
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(s.NodeSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(nodeLabels))
+}
+
+// RestrictsNamespaces returns true if only some namespaces may allocate from the pool
+func (s IPPoolSpec) RestrictsNamespaces() bool {
+	return len(s.AllowedNamespaces) > 0 || s.NamespaceSelector != nil
+}
+
+// AllowsNamespace returns true if pods in the namespace, which has nsLabels, may allocate from the pool.  An invalid
+// namespace selector matches no namespaces.
+func (s IPPoolSpec) AllowsNamespace(namespace string, nsLabels map[string]string) bool {
+	if !s.RestrictsNamespaces() {
+		return true
+	}
+
+	for _, allowed := range s.AllowedNamespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+
+	if s.NamespaceSelector == nil {
+		return false
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(s.NamespaceSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(nsLabels))
+}
+
+// validateSelectors returns errors for label selectors that can't be parsed and empty allowed namespaces
+func (s IPPoolSpec) validateSelectors(path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if _, err := metav1.LabelSelectorAsSelector(s.NodeSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("nodeSelector"), s.NodeSelector.String(), err.Error()))
+	}
+
+	if _, err := metav1.LabelSelectorAsSelector(s.NamespaceSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("namespaceSelector"), s.NamespaceSelector.String(), err.Error()))
+	}
+
+	for i, namespace := range s.AllowedNamespaces {
+		if namespace == "" {
+			allErrs = append(allErrs, field.Required(path.Child("allowedNamespaces").Index(i), "allowed namespaces must not be empty"))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,64 @@
+package v1alpha1
+
+import (
+	"net"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIPPoolSpecAllowsNamespace(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}
+	tests := []struct {
+		name      string
+		spec      IPPoolSpec
+		namespace string
+		labels    map[string]string
+		allowed   bool
+	}{
+		{"unrestricted", IPPoolSpec{}, "team-c", nil, true},
+		{"listed", IPPoolSpec{AllowedNamespaces: []string{"team-a"}}, "team-a", nil, true},
+		{"not listed", IPPoolSpec{AllowedNamespaces: []string{"team-a"}}, "team-c", nil, false},
+		{"selected", IPPoolSpec{NamespaceSelector: selector}, "team-b", map[string]string{"team": "b"}, true},
+		{"not selected", IPPoolSpec{NamespaceSelector: selector}, "team-c", map[string]string{"team": "c"}, false},
+		{"listed but not selected", IPPoolSpec{AllowedNamespaces: []string{"team-a"}, NamespaceSelector: selector}, "team-a", nil, true},
+		{"empty selector", IPPoolSpec{NamespaceSelector: &metav1.LabelSelector{}}, "team-c", nil, true},
+	}
+
+	for _, test := range tests {
+		if allowed := test.spec.AllowsNamespace(test.namespace, test.labels); allowed != test.allowed {
+			t.Errorf("%s: expected allowed to be %t, got %t", test.name, test.allowed, allowed)
+		}
+	}
+}
+
+func TestIPPoolSpecValidateNamespaces(t *testing.T) {
+	static := NewIPReservationMap()
+	static.Reserve("team-b", "web", "", IPReservation{IP: net.ParseIP("10.2.3.70")})
+
+	tests := []struct {
+		name  string
+		spec  IPPoolSpec
+		valid bool
+	}{
+		{"unrestricted", IPPoolSpec{}, true},
+		{"static reservation in allowed namespace", IPPoolSpec{AllowedNamespaces: []string{"team-b"}}, true},
+		{"static reservation outside allowed namespaces", IPPoolSpec{AllowedNamespaces: []string{"team-a"}}, false},
+		{"static reservation possibly selected", IPPoolSpec{AllowedNamespaces: []string{"team-a"}, NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}}}, true},
+		{"invalid selector", IPPoolSpec{NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Bogus"}}}}, false},
+		{"empty namespace", IPPoolSpec{AllowedNamespaces: []string{"team-b", ""}}, false},
+	}
+
+	for _, test := range tests {
+		test.spec.Range = IPRange("10.2.3.64/28")
+		test.spec.NetmaskBits = 27
+		test.spec.StaticReservations = static
+		err := test.spec.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected spec to be invalid", test.name)
+		}
+	}
+}
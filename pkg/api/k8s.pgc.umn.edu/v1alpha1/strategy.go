@@ -0,0 +1,157 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net"
+)
+
+// Strategies for choosing the address allocated to a pod
+const (
+	// AllocationStrategyRandom picks addresses at random from the range.  This is the default.
+	AllocationStrategyRandom = "random"
+	// AllocationStrategySequential picks the next address after the last one allocated, wrapping around at the end
+	// of the range
+	AllocationStrategySequential = "sequential"
+	// AllocationStrategyLowestFree picks the lowest address in the range that's free
+	AllocationStrategyLowestFree = "lowestFree"
+	// AllocationStrategyHash starts at an address derived from the pod's namespace and name, so a pod tends to get the
+	// same address wherever its reservation has been lost
+	AllocationStrategyHash = "hash"
+)
+
+// AllocationStrategy produces the candidate addresses tried, in order, when allocating from a pool
+type AllocationStrategy interface {
+	// Next returns the next candidate address, or nil once every candidate has been returned
+	Next() net.IP
+}
+
+// NewAllocationStrategy returns the strategy configured for the pool, used to allocate an address for the pod
+func (p *IPPool) NewAllocationStrategy(namespace, podName string) AllocationStrategy {
+	ranges := p.Spec.AllRanges()
+	switch p.Spec.AllocationStrategy {
+	case AllocationStrategySequential:
+		start := big.NewInt(0)
+		if p.Status.LastAllocated != nil && ranges.Contains(p.Status.LastAllocated) {
+			start = ranges.Offset(p.Status.LastAllocated)
+			start.Add(start, big.NewInt(1))
+		}
+		return newScanStrategy(ranges, start)
+	case AllocationStrategyLowestFree:
+		return newScanStrategy(ranges, big.NewInt(0))
+	case AllocationStrategyHash:
+		return newScanStrategy(ranges, hashOffset(ranges, namespace, podName))
+	default:
+		return &randomStrategy{pool: p}
+	}
+}
+
+// ValidateAllocationStrategy returns an error if strategy isn't one of the AllocationStrategy* values.  An empty
+// strategy is valid and selects the default.
+func ValidateAllocationStrategy(strategy string) error {
+	switch strategy {
+	case "", AllocationStrategyRandom, AllocationStrategySequential, AllocationStrategyLowestFree, AllocationStrategyHash:
+		return nil
+	}
+	return fmt.Errorf("unknown allocation strategy %s", strategy)
+}
+
+// randomAttempts is the number of random candidates tried before the random strategy scans the rest of the range
+const randomAttempts = 32
+
+// randomStrategy returns random addresses from the range.  Once randomAttempts candidates have been returned, every
+// address is returned in order from a random starting point, so a nearly full range is still searched completely.
+type randomStrategy struct {
+	pool     *IPPool
+	attempts int
+	scan     *scanStrategy
+}
+
+func (s *randomStrategy) Next() net.IP {
+	if s.attempts < randomAttempts {
+		s.attempts++
+		return s.pool.RandomIP()
+	}
+
+	if s.scan == nil {
+		ranges := s.pool.Spec.AllRanges()
+		s.scan = newScanStrategy(ranges, ranges.Offset(s.pool.RandomIP()))
+	}
+	return s.scan.Next()
+}
+
+// scanStrategy returns every address in the ranges once, in order, beginning at start and wrapping around at the end
+type scanStrategy struct {
+	r     IPRangeList
+	start *big.Int
+	size  *big.Int
+	count *big.Int
+}
+
+func newScanStrategy(r IPRangeList, start *big.Int) *scanStrategy {
+	size := r.Size()
+	if size.Sign() > 0 {
+		start = new(big.Int).Mod(start, size)
+	}
+	return &scanStrategy{
+		r:     r,
+		start: start,
+		size:  size,
+		count: big.NewInt(0),
+	}
+}
+
+func (s *scanStrategy) Next() net.IP {
+	if s.count.Cmp(s.size) >= 0 {
+		return nil
+	}
+
+	offset := new(big.Int).Add(s.start, s.count)
+	offset.Mod(offset, s.size)
+	s.count.Add(s.count, big.NewInt(1))
+	return s.r.AddressAt(offset)
+}
+
+// hashOffset returns an offset into the ranges derived from the pod's namespace and name
+func hashOffset(r IPRangeList, namespace, podName string) *big.Int {
+	h := fnv.New64a()
+	h.Write([]byte(namespace + "/" + podName))
+	offset := new(big.Int).SetUint64(h.Sum64())
+	return offset.Mod(offset, r.Size())
+}
+
+// Size returns the number of addresses in the range
+func (r IPRange) Size() *big.Int {
+	start, end := r.Bounds()
+	size := new(big.Int).SetBytes(end)
+	size.Sub(size, new(big.Int).SetBytes(start))
+	return size.Add(size, big.NewInt(1))
+}
+
+// Offset returns the position of ip from the start of the range
+func (r IPRange) Offset(ip net.IP) *big.Int {
+	start, _ := r.Bounds()
+	offset := new(big.Int).SetBytes(normalizeIP(ip, start))
+	return offset.Sub(offset, new(big.Int).SetBytes(start))
+}
+
+// AddressAt returns the address at offset from the start of the range
+func (r IPRange) AddressAt(offset *big.Int) net.IP {
+	start, _ := r.Bounds()
+	value := new(big.Int).SetBytes(start)
+	value.Add(value, offset)
+
+	ip := make(net.IP, len(start))
+	valueBytes := value.Bytes()
+	copy(ip[len(ip)-len(valueBytes):], valueBytes)
+	return ip
+}
+
+// normalizeIP returns ip in the same byte length as like
+func normalizeIP(ip, like net.IP) net.IP {
+	if len(like) == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
@@ -0,0 +1,246 @@
+package v1alpha1
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+// candidates returns up to limit candidates from the strategy
+func candidates(s AllocationStrategy, limit int) []string {
+	ips := make([]string, 0)
+	for i := 0; i < limit; i++ {
+		ip := s.Next()
+		if ip == nil {
+			break
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+func testPool(strategy string) *IPPool {
+	p := &IPPool{}
+	p.Spec.Range = IPRange("10.2.3.64/30")
+	p.Spec.NetmaskBits = 27
+	p.Spec.AllocationStrategy = strategy
+	return p
+}
+
+func equalCandidates(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomStrategy(t *testing.T) {
+	for _, strategy := range []string{"", AllocationStrategyRandom} {
+		p := testPool(strategy)
+		ips := candidates(p.NewAllocationStrategy("foo", "bar"), 1000)
+		if len(ips) != randomAttempts+4 {
+			t.Errorf("%q: expected %d random candidates followed by every address once, got %d", strategy, randomAttempts, len(ips))
+		}
+
+		for _, ip := range ips {
+			if !p.RangeContains(net.ParseIP(ip)) {
+				t.Errorf("%q: candidate %s isn't in the range", strategy, ip)
+			}
+		}
+
+		scanned := make(map[string]bool)
+		for _, ip := range ips[randomAttempts:] {
+			scanned[ip] = true
+		}
+		if len(scanned) != 4 {
+			t.Errorf("%q: expected every address to be scanned once random candidates ran out, got %v", strategy, ips[randomAttempts:])
+		}
+	}
+}
+
+func TestSequentialStrategy(t *testing.T) {
+	tests := []struct {
+		lastAllocated net.IP
+		expected      []string
+	}{
+		{nil, []string{"10.2.3.64", "10.2.3.65", "10.2.3.66", "10.2.3.67"}},
+		{net.ParseIP("10.2.3.65"), []string{"10.2.3.66", "10.2.3.67", "10.2.3.64", "10.2.3.65"}},
+		{net.ParseIP("10.2.3.67"), []string{"10.2.3.64", "10.2.3.65", "10.2.3.66", "10.2.3.67"}},
+		// a last allocation outside the range, e.g. after the range was changed, starts at the beginning
+		{net.ParseIP("10.2.3.90"), []string{"10.2.3.64", "10.2.3.65", "10.2.3.66", "10.2.3.67"}},
+	}
+
+	for _, test := range tests {
+		p := testPool(AllocationStrategySequential)
+		p.Status.LastAllocated = test.lastAllocated
+		if ips := candidates(p.NewAllocationStrategy("foo", "bar"), 10); !equalCandidates(ips, test.expected) {
+			t.Errorf("last allocated %v: got %v, expected %v", test.lastAllocated, ips, test.expected)
+		}
+	}
+}
+
+func TestSequentialStrategyFollowsReservations(t *testing.T) {
+	p := testPool(AllocationStrategySequential)
+	p.Reserve("foo", "bar", "eth0", IPReservation{IP: net.ParseIP("10.2.3.66")})
+
+	if ip := p.NewAllocationStrategy("foo", "baz").Next(); !ip.Equal(net.ParseIP("10.2.3.67")) {
+		t.Errorf("expected the address after the last reservation, got %v", ip)
+	}
+}
+
+func TestLowestFreeStrategy(t *testing.T) {
+	p := testPool(AllocationStrategyLowestFree)
+	p.Status.LastAllocated = net.ParseIP("10.2.3.66")
+
+	expected := []string{"10.2.3.64", "10.2.3.65", "10.2.3.66", "10.2.3.67"}
+	if ips := candidates(p.NewAllocationStrategy("foo", "bar"), 10); !equalCandidates(ips, expected) {
+		t.Errorf("got %v, expected %v", ips, expected)
+	}
+}
+
+func TestHashStrategy(t *testing.T) {
+	p := &IPPool{}
+	p.Spec.Range = IPRange("2001:db8::/120")
+	p.Spec.NetmaskBits = 64
+	p.Spec.AllocationStrategy = AllocationStrategyHash
+
+	first := candidates(p.NewAllocationStrategy("foo", "bar"), 1000)
+	if len(first) != 256 {
+		t.Errorf("expected every address in the range once, got %d candidates", len(first))
+	}
+
+	seen := make(map[string]bool)
+	for _, ip := range first {
+		if seen[ip] {
+			t.Errorf("candidate %s returned twice", ip)
+		}
+		seen[ip] = true
+	}
+
+	if again := candidates(p.NewAllocationStrategy("foo", "bar"), 1000); !equalCandidates(first, again) {
+		t.Errorf("candidates for the same pod differ")
+	}
+
+	// With 256 addresses, a handful of pods shouldn't all hash to the same start
+	starts := make(map[string]bool)
+	for _, podName := range []string{"bar", "baz", "qux", "web-0", "web-1"} {
+		starts[p.NewAllocationStrategy("foo", podName).Next().String()] = true
+	}
+	if len(starts) < 2 {
+		t.Errorf("every pod hashed to the same address: %v", starts)
+	}
+}
+
+func TestIPRangeOffsets(t *testing.T) {
+	tests := []struct {
+		r      IPRange
+		ip     string
+		offset int64
+		size   int64
+	}{
+		{"10.2.3.64/28", "10.2.3.64", 0, 16},
+		{"10.2.3.64/28", "10.2.3.79", 15, 16},
+		{"2001:db8::/120", "2001:db8::ff", 255, 256},
+	}
+
+	for _, test := range tests {
+		if size := test.r.Size(); size.Cmp(big.NewInt(test.size)) != 0 {
+			t.Errorf("%s: got size %v, expected %d", test.r, size, test.size)
+		}
+
+		if offset := test.r.Offset(net.ParseIP(test.ip)); offset.Cmp(big.NewInt(test.offset)) != 0 {
+			t.Errorf("%s: got offset %v for %s, expected %d", test.r, offset, test.ip, test.offset)
+		}
+
+		if ip := test.r.AddressAt(big.NewInt(test.offset)); !ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%s: got %v at offset %d, expected %s", test.r, ip, test.offset, test.ip)
+		}
+	}
+}
+
+func TestIPPoolHostAddress(t *testing.T) {
+	tests := []struct {
+		r           IPRange
+		netmaskBits int
+		ip          string
+		host        bool
+	}{
+		{"10.2.3.64/28", 27, "10.2.3.64", false},
+		{"10.2.3.64/28", 27, "10.2.3.65", true},
+		{"10.2.3.80/28", 27, "10.2.3.95", false},
+		{"10.2.3.80/28", 27, "10.2.3.94", true},
+		{"10.2.3.64/31", 31, "10.2.3.64", true},
+		{"2001:db8::/65", 64, "2001:db8::", false},
+		{"2001:db8::/65", 64, "2001:db8::ffff", true},
+	}
+
+	for _, test := range tests {
+		p := &IPPool{}
+		p.Spec.Range = test.r
+		p.Spec.NetmaskBits = test.netmaskBits
+		if host := p.HostAddress(net.ParseIP(test.ip)); host != test.host {
+			t.Errorf("%s in %s/%d: got %t, expected %t", test.ip, test.r, test.netmaskBits, host, test.host)
+		}
+	}
+}
+
+func TestValidateAllocationStrategy(t *testing.T) {
+	for _, strategy := range []string{"", AllocationStrategyRandom, AllocationStrategySequential, AllocationStrategyLowestFree, AllocationStrategyHash} {
+		if err := ValidateAllocationStrategy(strategy); err != nil {
+			t.Errorf("%q: unexpected error: %v", strategy, err)
+		}
+	}
+
+	if err := ValidateAllocationStrategy("roundRobin"); err == nil {
+		t.Errorf("expected an unknown strategy to be rejected")
+	}
+}
+
+func TestIPPoolCapacity(t *testing.T) {
+	tests := []struct {
+		name      string
+		r         IPRange
+		bits      int
+		gateway   string
+		static    map[string]string
+		dynamic   map[string]string
+		capacity  int64
+		available int64
+	}{
+		{"ipv4 subnet", "10.2.3.0/24", 24, "10.2.3.1", nil, nil, 253, 253},
+		{"ipv4 partial range", "10.2.3.64/28", 24, "10.2.3.1", nil, nil, 16, 16},
+		{"ipv4 point to point", "10.2.3.64/31", 31, "", nil, nil, 2, 2},
+		{"ipv6", "2001:db8::/120", 64, "2001:db8::1", nil, nil, 254, 254},
+		{"static reservations", "10.2.3.64/28", 24, "10.2.3.65",
+			map[string]string{"a": "10.2.3.66", "b": "10.2.3.67", "c": "10.2.3.1"}, nil, 13, 13},
+		{"dynamic reservations", "10.2.3.64/28", 24, "",
+			map[string]string{"a": "10.2.3.66"},
+			map[string]string{"b": "10.2.3.67", "c": "10.2.3.66", "d": "10.2.3.200"}, 15, 14},
+	}
+
+	for _, test := range tests {
+		p := &IPPool{}
+		p.Spec.Range = test.r
+		p.Spec.NetmaskBits = test.bits
+		p.Spec.Gateway = net.ParseIP(test.gateway)
+		p.Spec.StaticReservations = NewIPReservationMap()
+		for pod, ip := range test.static {
+			p.Spec.StaticReservations.Reserve("foo", pod, "", IPReservation{IP: net.ParseIP(ip)})
+		}
+		for pod, ip := range test.dynamic {
+			p.Reserve("foo", pod, "", IPReservation{IP: net.ParseIP(ip)})
+		}
+
+		if capacity := p.Capacity(); capacity.Cmp(big.NewInt(test.capacity)) != 0 {
+			t.Errorf("%s: got capacity %v, expected %d", test.name, capacity, test.capacity)
+		}
+		if available := p.Available(); available.Cmp(big.NewInt(test.available)) != 0 {
+			t.Errorf("%s: got %v available, expected %d", test.name, available, test.available)
+		}
+	}
+}
@@ -23,9 +23,58 @@ package v1alpha1
 import (
 	net "net"
 
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BlockAffinity) DeepCopyInto(out *BlockAffinity) {
+	*out = *in
+	in.Claimed.DeepCopyInto(&out.Claimed)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BlockAffinity.
+func (in *BlockAffinity) DeepCopy() *BlockAffinity {
+	if in == nil {
+		return nil
+	}
+	out := new(BlockAffinity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DNS) DeepCopyInto(out *DNS) {
+	*out = *in
+	if in.Nameservers != nil {
+		in, out := &in.Nameservers, &out.Nameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Search != nil {
+		in, out := &in.Search, &out.Search
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Options != nil {
+		in, out := &in.Options, &out.Options
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DNS.
+func (in *DNS) DeepCopy() *DNS {
+	if in == nil {
+		return nil
+	}
+	out := new(DNS)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPPool) DeepCopyInto(out *IPPool) {
 	*out = *in
@@ -90,6 +139,11 @@ func (in *IPPoolList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
 	*out = *in
+	if in.Ranges != nil {
+		in, out := &in.Ranges, &out.Ranges
+		*out = make([]IPRange, len(*in))
+		copy(*out, *in)
+	}
 	if in.Gateway != nil {
 		in, out := &in.Gateway, &out.Gateway
 		*out = make(net.IP, len(*in))
@@ -99,27 +153,59 @@ func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
 		in, out := &in.StaticReservations, &out.StaticReservations
 		*out = make(IPReservationMap, len(*in))
 		for key, val := range *in {
-			var outVal map[string]net.IP
+			var outVal map[string]IPReservation
 			if val == nil {
 				(*out)[key] = nil
 			} else {
 				in, out := &val, &outVal
-				*out = make(map[string]net.IP, len(*in))
+				*out = make(map[string]IPReservation, len(*in))
 				for key, val := range *in {
-					var outVal []byte
-					if val == nil {
-						(*out)[key] = nil
-					} else {
-						in, out := &val, &outVal
-						*out = make(net.IP, len(*in))
-						copy(*out, *in)
-					}
-					(*out)[key] = outVal
+					(*out)[key] = *val.DeepCopy()
 				}
 			}
 			(*out)[key] = outVal
 		}
 	}
+	if in.Exclusions != nil {
+		in, out := &in.Exclusions, &out.Exclusions
+		*out = make([]IPExclusion, len(*in))
+		copy(*out, *in)
+	}
+	if in.Routes != nil {
+		in, out := &in.Routes, &out.Routes
+		*out = make([]Route, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.DNS.DeepCopyInto(&out.DNS)
+	if in.ReuseCooldown != nil {
+		in, out := &in.ReuseCooldown, &out.ReuseCooldown
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedNamespaces != nil {
+		in, out := &in.AllowedNamespaces, &out.AllowedNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SelectorReservations != nil {
+		in, out := &in.SelectorReservations, &out.SelectorReservations
+		*out = make([]SelectorReservation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -140,27 +226,38 @@ func (in *IPPoolStatus) DeepCopyInto(out *IPPoolStatus) {
 		in, out := &in.DynamicReservations, &out.DynamicReservations
 		*out = make(IPReservationMap, len(*in))
 		for key, val := range *in {
-			var outVal map[string]net.IP
+			var outVal map[string]IPReservation
 			if val == nil {
 				(*out)[key] = nil
 			} else {
 				in, out := &val, &outVal
-				*out = make(map[string]net.IP, len(*in))
+				*out = make(map[string]IPReservation, len(*in))
 				for key, val := range *in {
-					var outVal []byte
-					if val == nil {
-						(*out)[key] = nil
-					} else {
-						in, out := &val, &outVal
-						*out = make(net.IP, len(*in))
-						copy(*out, *in)
-					}
-					(*out)[key] = outVal
+					(*out)[key] = *val.DeepCopy()
 				}
 			}
 			(*out)[key] = outVal
 		}
 	}
+	if in.LastAllocated != nil {
+		in, out := &in.LastAllocated, &out.LastAllocated
+		*out = make(net.IP, len(*in))
+		copy(*out, *in)
+	}
+	if in.Quarantine != nil {
+		in, out := &in.Quarantine, &out.Quarantine
+		*out = make([]QuarantinedAddress, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Blocks != nil {
+		in, out := &in.Blocks, &out.Blocks
+		*out = make([]BlockAffinity, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -174,28 +271,69 @@ func (in *IPPoolStatus) DeepCopy() *IPPoolStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in IPRangeList) DeepCopyInto(out *IPRangeList) {
+	{
+		in := &in
+		*out = make(IPRangeList, len(*in))
+		copy(*out, *in)
+		return
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPRangeList.
+func (in IPRangeList) DeepCopy() IPRangeList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPRangeList)
+	in.DeepCopyInto(out)
+	return *out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPReservation) DeepCopyInto(out *IPReservation) {
+	*out = *in
+	if in.IP != nil {
+		in, out := &in.IP, &out.IP
+		*out = make(net.IP, len(*in))
+		copy(*out, *in)
+	}
+	if in.Created != nil {
+		in, out := &in.Created, &out.Created
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSeen != nil {
+		in, out := &in.LastSeen, &out.LastSeen
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPReservation.
+func (in *IPReservation) DeepCopy() *IPReservation {
+	if in == nil {
+		return nil
+	}
+	out := new(IPReservation)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in IPReservationMap) DeepCopyInto(out *IPReservationMap) {
 	{
 		in := &in
 		*out = make(IPReservationMap, len(*in))
 		for key, val := range *in {
-			var outVal map[string]net.IP
+			var outVal map[string]IPReservation
 			if val == nil {
 				(*out)[key] = nil
 			} else {
 				in, out := &val, &outVal
-				*out = make(map[string]net.IP, len(*in))
+				*out = make(map[string]IPReservation, len(*in))
 				for key, val := range *in {
-					var outVal []byte
-					if val == nil {
-						(*out)[key] = nil
-					} else {
-						in, out := &val, &outVal
-						*out = make(net.IP, len(*in))
-						copy(*out, *in)
-					}
-					(*out)[key] = outVal
+					(*out)[key] = *val.DeepCopy()
 				}
 			}
 			(*out)[key] = outVal
@@ -213,3 +351,68 @@ func (in IPReservationMap) DeepCopy() IPReservationMap {
 	in.DeepCopyInto(out)
 	return *out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuarantinedAddress) DeepCopyInto(out *QuarantinedAddress) {
+	*out = *in
+	if in.IP != nil {
+		in, out := &in.IP, &out.IP
+		*out = make(net.IP, len(*in))
+		copy(*out, *in)
+	}
+	in.Released.DeepCopyInto(&out.Released)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuarantinedAddress.
+func (in *QuarantinedAddress) DeepCopy() *QuarantinedAddress {
+	if in == nil {
+		return nil
+	}
+	out := new(QuarantinedAddress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Route) DeepCopyInto(out *Route) {
+	*out = *in
+	if in.Gateway != nil {
+		in, out := &in.Gateway, &out.Gateway
+		*out = make(net.IP, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Route.
+func (in *Route) DeepCopy() *Route {
+	if in == nil {
+		return nil
+	}
+	out := new(Route)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SelectorReservation) DeepCopyInto(out *SelectorReservation) {
+	*out = *in
+	in.PodSelector.DeepCopyInto(&out.PodSelector)
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]IPRange, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SelectorReservation.
+func (in *SelectorReservation) DeepCopy() *SelectorReservation {
+	if in == nil {
+		return nil
+	}
+	out := new(SelectorReservation)
+	in.DeepCopyInto(out)
+	return out
+}